@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/BurntSushi/toml"
+	"github.com/d-cheremnov/oauth2_proxy/policy"
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+// AccessPolicyOptions configures one access policy, read from
+// [[access_policies]] tables in the config file
+type AccessPolicyOptions struct {
+	Name       string `toml:"name"`
+	Expression string `toml:"expression"`
+	Action     string `toml:"action"`
+}
+
+// AccessPolicy allows or denies the requests for which its expression holds
+type AccessPolicy struct {
+	Name    string
+	Allow   bool
+	Program *policy.Program
+}
+
+// LoadAccessPolicies reads the [[access_policies]] tables of a config file
+func LoadAccessPolicies(path string) ([]AccessPolicyOptions, error) {
+	var cfg struct {
+		AccessPolicies []AccessPolicyOptions `toml:"access_policies"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.AccessPolicies, err
+}
+
+func parseAccessPolicies(o *Options, msgs []string) []string {
+	o.accessPolicies = nil
+	seen := make(map[string]bool)
+	for i, po := range o.AccessPolicies {
+		prefix := fmt.Sprintf("access_policies[%d]", i)
+		if po.Name != "" {
+			prefix = fmt.Sprintf("access_policies[%s]", po.Name)
+		}
+		if po.Name == "" {
+			msgs = append(msgs, fmt.Sprintf("%s: missing setting: name", prefix))
+			continue
+		}
+		if seen[po.Name] {
+			msgs = append(msgs, fmt.Sprintf("%s: duplicate policy name", prefix))
+			continue
+		}
+		seen[po.Name] = true
+
+		var allow bool
+		switch po.Action {
+		case "", "allow":
+			allow = true
+		case "deny":
+		default:
+			msgs = append(msgs, fmt.Sprintf("%s: action must be allow or deny, not %q", prefix, po.Action))
+			continue
+		}
+		program, err := policy.Compile(po.Expression)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: invalid expression %q: %s", prefix, po.Expression, err))
+			continue
+		}
+		o.accessPolicies = append(o.accessPolicies, &AccessPolicy{Name: po.Name, Allow: allow, Program: program})
+	}
+	return msgs
+}
+
+// accessPolicyInput describes a request from an authenticated session to
+// access policies
+func (p *OAuthProxy) accessPolicyInput(req *http.Request, session *providers.SessionState) *policy.Input {
+	return &policy.Input{
+		Email:    session.Email,
+		User:     session.User,
+		Groups:   session.Groups,
+		Provider: session.Provider,
+		Request: policy.Request{
+			Host:   req.Host,
+			Path:   req.URL.Path,
+			Method: req.Method,
+			IP:     p.clientIP(req),
+		},
+	}
+}
+
+// evaluateAccessPolicies reports whether the access policies allow the
+// request, along with the policy that decided. The first policy whose
+// expression holds decides; requests no policy matches are denied, as are
+// those for which a policy fails to evaluate.
+func (p *OAuthProxy) evaluateAccessPolicies(req *http.Request, session *providers.SessionState) (bool, *AccessPolicy) {
+	in := p.accessPolicyInput(req, session)
+	for _, ap := range p.accessPolicies {
+		matched, err := ap.Program.Eval(in)
+		if err != nil {
+			log.Printf("%s error evaluating access policy %q: %s", p.getRemoteAddr(req), ap.Name, err)
+			return false, ap
+		}
+		if matched {
+			return ap.Allow, ap
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAccessPolicies(t *testing.T) {
+	f, _ := ioutil.TempFile("", "oauth2_proxy_cfg")
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[[access_policies]]
+name = "admins"
+expression = '"admins" in groups'
+
+[[access_policies]]
+name = "no-writes"
+expression = 'request.method != "GET"'
+action = "deny"
+`)
+	f.Close()
+
+	policies, err := LoadAccessPolicies(f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []AccessPolicyOptions{
+		{Name: "admins", Expression: `"admins" in groups`},
+		{Name: "no-writes", Expression: `request.method != "GET"`, Action: "deny"},
+	}, policies)
+}
+
+func TestAccessPoliciesValidation(t *testing.T) {
+	o := testOptions()
+	o.AccessPolicies = []AccessPolicyOptions{
+		{Name: "admins", Expression: `"admins" in groups`},
+		{Expression: "true"},
+		{Name: "admins", Expression: "true"},
+		{Name: "typo", Expression: `"admins" in group`},
+		{Name: "maybe", Expression: "true", Action: "audit"},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "access_policies[1]: missing setting: name")
+	assert.Contains(t, err.Error(), "access_policies[admins]: duplicate policy name")
+	assert.Contains(t, err.Error(), `access_policies[typo]: invalid expression "\"admins\" in group": 1:13: undeclared reference to 'group'`)
+	assert.Contains(t, err.Error(), `access_policies[maybe]: action must be allow or deny, not "audit"`)
+	assert.Equal(t, 1, len(o.accessPolicies))
+}
+
+func TestAccessPolicies(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.EmailDomains = []string{"*"}
+		o.AccessPolicies = []AccessPolicyOptions{
+			{Name: "no-writes-outside-vpn", Expression: `request.method != "GET" && !request.ip.inCIDR("10.0.0.0/8")`, Action: "deny"},
+			{Name: "admins", Expression: `"admins" in groups`},
+			{Name: "sre-read-only", Expression: `email.endsWith("@sre.example.com") && request.method == "GET"`},
+		}
+	})
+	defer test.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	admin := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane", Groups: []string{"admins"}})
+	sre := test.SessionCookie(t, &providers.SessionState{Email: "bob@sre.example.com", User: "bob"})
+	other := test.SessionCookie(t, &providers.SessionState{Email: "eve@example.com", User: "eve"})
+
+	assert.Equal(t, http.StatusOK, test.Serve("/private", admin).StatusCode)
+	assert.Contains(t, logs.String(), `access policy "admins" allowed Session{email:jane@example.com user:jane groups:admins} GET /private`)
+	assert.Equal(t, http.StatusOK, test.Serve("/private", sre).StatusCode)
+	assert.Contains(t, logs.String(), `access policy "sre-read-only" allowed`)
+
+	assert.Equal(t, http.StatusForbidden, test.Serve("/private", other).StatusCode)
+	assert.Contains(t, logs.String(), "no access policy matched, denied Session{email:eve@example.com user:eve} GET /private")
+
+	req, _ := http.NewRequest("POST", "/private", nil)
+	req.Host = "localhost"
+	req.RemoteAddr = "192.0.2.1:1234"
+	for _, c := range admin {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, logs.String(), `access policy "no-writes-outside-vpn" denied`)
+
+	req.RemoteAddr = "10.0.0.5:1234"
+	rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
@@ -10,8 +10,8 @@ import (
 	"github.com/bitly/go-simplejson"
 )
 
-func Request(req *http.Request) (*simplejson.Json, error) {
-	resp, err := http.DefaultClient.Do(req)
+func Request(c *http.Client, req *http.Request) (*simplejson.Json, error) {
+	resp, err := c.Do(req)
 	if err != nil {
 		log.Printf("%s %s %s", req.Method, req.URL, err)
 		return nil, err
@@ -32,8 +32,8 @@ func Request(req *http.Request) (*simplejson.Json, error) {
 	return data, nil
 }
 
-func RequestJson(req *http.Request, v interface{}) error {
-	resp, err := http.DefaultClient.Do(req)
+func RequestJson(c *http.Client, req *http.Request, v interface{}) error {
+	resp, err := c.Do(req)
 	if err != nil {
 		log.Printf("%s %s %s", req.Method, req.URL, err)
 		return err
@@ -50,12 +50,12 @@ func RequestJson(req *http.Request, v interface{}) error {
 	return json.Unmarshal(body, v)
 }
 
-func RequestUnparsedResponse(url string, header http.Header) (resp *http.Response, err error) {
+func RequestUnparsedResponse(c *http.Client, url string, header http.Header) (resp *http.Response, err error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header = header
 
-	return http.DefaultClient.Do(req)
+	return c.Do(req)
 }
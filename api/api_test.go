@@ -24,7 +24,7 @@ func TestRequest(t *testing.T) {
 	defer backend.Close()
 
 	req, _ := http.NewRequest("GET", backend.URL, nil)
-	response, err := Request(req)
+	response, err := Request(http.DefaultClient, req)
 	assert.Equal(t, nil, err)
 	result, err := response.Get("foo").String()
 	assert.Equal(t, nil, err)
@@ -39,7 +39,7 @@ func TestRequestFailure(t *testing.T) {
 
 	req, err := http.NewRequest("GET", backend.URL, nil)
 	assert.Equal(t, nil, err)
-	resp, err := Request(req)
+	resp, err := Request(http.DefaultClient, req)
 	assert.Equal(t, (*simplejson.Json)(nil), resp)
 	assert.NotEqual(t, nil, err)
 	if !strings.Contains(err.Error(), "refused") {
@@ -53,7 +53,7 @@ func TestHttpErrorCode(t *testing.T) {
 
 	req, err := http.NewRequest("GET", backend.URL, nil)
 	assert.Equal(t, nil, err)
-	resp, err := Request(req)
+	resp, err := Request(http.DefaultClient, req)
 	assert.Equal(t, (*simplejson.Json)(nil), resp)
 	assert.NotEqual(t, nil, err)
 }
@@ -64,7 +64,7 @@ func TestJsonParsingError(t *testing.T) {
 
 	req, err := http.NewRequest("GET", backend.URL, nil)
 	assert.Equal(t, nil, err)
-	resp, err := Request(req)
+	resp, err := Request(http.DefaultClient, req)
 	assert.Equal(t, (*simplejson.Json)(nil), resp)
 	assert.NotEqual(t, nil, err)
 }
@@ -83,7 +83,7 @@ func TestRequestUnparsedResponseUsingAccessTokenParameter(t *testing.T) {
 		}))
 	defer backend.Close()
 
-	response, err := RequestUnparsedResponse(
+	response, err := RequestUnparsedResponse(http.DefaultClient,
 		backend.URL+"?access_token=my_token", nil)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 200, response.StatusCode)
@@ -98,7 +98,7 @@ func TestRequestUnparsedResponseUsingAccessTokenParameterFailedResponse(t *testi
 	// Close the backend now to force a request failure.
 	backend.Close()
 
-	response, err := RequestUnparsedResponse(
+	response, err := RequestUnparsedResponse(http.DefaultClient,
 		backend.URL+"?access_token=my_token", nil)
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, (*http.Response)(nil), response)
@@ -118,7 +118,7 @@ func TestRequestUnparsedResponseUsingHeaders(t *testing.T) {
 
 	headers := make(http.Header)
 	headers.Set("Auth", "my_token")
-	response, err := RequestUnparsedResponse(backend.URL, headers)
+	response, err := RequestUnparsedResponse(http.DefaultClient, backend.URL, headers)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 200, response.StatusCode)
 	body, err := ioutil.ReadAll(response.Body)
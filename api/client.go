@@ -0,0 +1,96 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientOptions configures the HTTP client used for calls to the identity
+// provider and its APIs
+type ClientOptions struct {
+	// CAFile is a PEM bundle of additional CAs trusted for provider TLS
+	CAFile string
+	// CertFile and KeyFile hold an optional client certificate for mTLS
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables verification of provider certificates
+	InsecureSkipVerify bool
+	// Timeout bounds a whole request, DialTimeout only connection setup
+	Timeout     time.Duration
+	DialTimeout time.Duration
+	// ProxyURL is an explicit egress proxy; by default the HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY environment variables are honoured
+	ProxyURL string
+}
+
+// NewClient builds a dedicated *http.Client from the options, leaving
+// http.DefaultClient and http.DefaultTransport untouched
+func NewClient(opts ClientOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+
+	if opts.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file %q: %v", opts.CAFile, err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, errors.New("both a client certificate and key are required for mTLS")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proxy url %q: %v", opts.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	dialTimeout := opts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 30 * time.Second
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+	}, nil
+}
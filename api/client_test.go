@@ -0,0 +1,168 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePEMFile(t *testing.T, blockType string, der []byte) string {
+	f, err := ioutil.TempFile("", "client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	return f.Name()
+}
+
+func testClientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "oauth2_proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, writePEMFile(t, "CERTIFICATE", der), writePEMFile(t, "EC PRIVATE KEY", keyDER)
+}
+
+func TestNewClientDefaults(t *testing.T) {
+	client, err := NewClient(ClientOptions{Timeout: 5 * time.Second})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 5*time.Second, client.Timeout)
+	assert.NotSame(t, http.DefaultTransport, client.Transport)
+}
+
+func TestNewClientUntrustedServer(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	client, err := NewClient(ClientOptions{})
+	assert.Equal(t, nil, err)
+	_, err = client.Get(backend.URL)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestNewClientCAFile(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	caFile := writePEMFile(t, "CERTIFICATE", backend.Certificate().Raw)
+	defer os.Remove(caFile)
+
+	client, err := NewClient(ClientOptions{CAFile: caFile})
+	assert.Equal(t, nil, err)
+	resp, err := client.Get(backend.URL)
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestNewClientInsecureSkipVerify(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	client, err := NewClient(ClientOptions{InsecureSkipVerify: true})
+	assert.Equal(t, nil, err)
+	resp, err := client.Get(backend.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestNewClientCertificate(t *testing.T) {
+	clientCert, certFile, keyFile := testClientCertificate(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	backend.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+	caFile := writePEMFile(t, "CERTIFICATE", backend.Certificate().Raw)
+	defer os.Remove(caFile)
+
+	client, err := NewClient(ClientOptions{CAFile: caFile})
+	assert.Equal(t, nil, err)
+	_, err = client.Get(backend.URL)
+	assert.NotEqual(t, nil, err)
+
+	client, err = NewClient(ClientOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	assert.Equal(t, nil, err)
+	resp, err := client.Get(backend.URL)
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "oauth2_proxy", string(body))
+}
+
+func TestNewClientProxyURL(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+
+	client, err := NewClient(ClientOptions{ProxyURL: proxy.URL})
+	assert.Equal(t, nil, err)
+	resp, err := client.Get("http://provider.example.com/userinfo")
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, "http://provider.example.com/userinfo", proxied)
+}
+
+func TestNewClientInvalidOptions(t *testing.T) {
+	_, certFile, keyFile := testClientCertificate(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+	notPEM := writePEMFile(t, "CERTIFICATE", []byte("nope"))
+	defer os.Remove(notPEM)
+
+	tests := map[string]ClientOptions{
+		"missing ca file":  {CAFile: "/does/not/exist.pem"},
+		"invalid ca file":  {CAFile: notPEM},
+		"cert without key": {CertFile: certFile},
+		"key without cert": {KeyFile: keyFile},
+		"mismatched pair":  {CertFile: certFile, KeyFile: certFile},
+		"bad proxy url":    {ProxyURL: "http://[::1"},
+	}
+	for name, opts := range tests {
+		_, err := NewClient(opts)
+		assert.NotEqual(t, nil, err, name)
+	}
+}
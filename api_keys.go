@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+// APIKey is the service identity an API key authenticates as
+type APIKey struct {
+	User   string
+	Email  string
+	Groups []string
+}
+
+// APIKeys looks up API keys by their SHA-256 hash. The file holds one key per
+// line as sha256:<hex digest>,<user>[,<email>[,<groups>]] with groups
+// separated by spaces, and is reloaded when it changes.
+type APIKeys struct {
+	path string
+	keys unsafe.Pointer
+}
+
+func NewAPIKeysFromFile(path string) (*APIKeys, error) {
+	return newAPIKeysFromFileImpl(path, nil, func() {})
+}
+
+func newAPIKeysFromFileImpl(path string, done <-chan bool, onUpdate func()) (*APIKeys, error) {
+	k := &APIKeys{path: path}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	WatchForUpdates(path, done, func() {
+		if err := k.load(); err != nil {
+			log.Printf("error reloading api-keys-file=%q, %s", path, err)
+		}
+		onUpdate()
+	})
+	return k, nil
+}
+
+func (k *APIKeys) load() error {
+	r, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	csv_reader := csv.NewReader(r)
+	csv_reader.Comma = ','
+	csv_reader.Comment = '#'
+	csv_reader.TrimLeadingSpace = true
+	csv_reader.FieldsPerRecord = -1
+	records, err := csv_reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]*APIKey)
+	for n, r := range records {
+		hash, key, err := parseAPIKey(r)
+		if err != nil {
+			log.Printf("skipping entry %d in api-keys-file=%q, %s", n+1, k.path, err)
+			continue
+		}
+		keys[hash] = key
+	}
+	atomic.StorePointer(&k.keys, unsafe.Pointer(&keys))
+	return nil
+}
+
+func parseAPIKey(r []string) (string, *APIKey, error) {
+	if len(r) < 2 || len(r) > 4 {
+		return "", nil, fmt.Errorf("expected 2 to 4 columns")
+	}
+	hash := strings.ToLower(strings.TrimSpace(r[0]))
+	if !strings.HasPrefix(hash, "sha256:") {
+		return "", nil, fmt.Errorf("unsupported key hash, expected sha256:<hex digest>")
+	}
+	if b, err := hex.DecodeString(strings.TrimPrefix(hash, "sha256:")); err != nil || len(b) != sha256.Size {
+		return "", nil, fmt.Errorf("invalid sha256 digest")
+	}
+	key := &APIKey{User: strings.TrimSpace(r[1])}
+	if key.User == "" {
+		return "", nil, fmt.Errorf("missing user")
+	}
+	if len(r) > 2 {
+		key.Email = strings.TrimSpace(r[2])
+	}
+	if len(r) > 3 {
+		key.Groups = strings.Fields(r[3])
+	}
+	return strings.TrimPrefix(hash, "sha256:"), key, nil
+}
+
+// Lookup returns the identity of an API key
+func (k *APIKeys) Lookup(apiKey string) (*APIKey, bool) {
+	keys := *(*map[string]*APIKey)(atomic.LoadPointer(&k.keys))
+	sum := sha256.Sum256([]byte(apiKey))
+	key, ok := keys[hex.EncodeToString(sum[:])]
+	return key, ok
+}
+
+// CheckAPIKey authenticates req by an API key in the API key header or as a
+// bearer token. It returns the session and the header the key came from.
+func (p *OAuthProxy) CheckAPIKey(req *http.Request) (*providers.SessionState, string) {
+	if p.APIKeys == nil {
+		return nil, ""
+	}
+	header, value := p.APIKeyHeader, ""
+	if header != "" {
+		value = req.Header.Get(header)
+	}
+	if value == "" {
+		auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+		if len(auth) != 2 || !strings.EqualFold(auth[0], "Bearer") {
+			return nil, ""
+		}
+		header, value = "Authorization", auth[1]
+	}
+	key, ok := p.APIKeys.Lookup(value)
+	if !ok {
+		return nil, ""
+	}
+	session := &providers.SessionState{User: key.User, Email: key.Email, Groups: key.Groups, AuthTime: time.Now()}
+	if err := p.refuseSession(session); err != nil {
+		log.Printf("%s %s via API key", p.getRemoteAddr(req), err)
+		return nil, ""
+	}
+	log.Printf("authenticated %q via API key", key.User)
+	return session, header
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the keys are "k-ci-0123456789" and "k-backup-9876543210"
+const testAPIKeysFile = `# sha256, user, email, groups
+sha256:63123d507d507a78de4fb598bd39ce895d6efa47472f895e9744e45058a09e42, ci, ci@example.com, deploy readers
+SHA256:570fe7c503fcb93524340cb05bb5af7bf132d9c78c9b90d6a6352136116cacc1, backup
+md5:0123456789abcdef, legacy
+sha256:abcd, short
+sha256:63123d507d507a78de4fb598bd39ce895d6efa47472f895e9744e45058a09e42,
+`
+
+func writeAPIKeysFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "test_api_keys_")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	f.WriteString(contents)
+	f.Close()
+	return f.Name()
+}
+
+func TestAPIKeysLookup(t *testing.T) {
+	path := writeAPIKeysFile(t, testAPIKeysFile)
+	defer os.Remove(path)
+
+	done := make(chan bool)
+	updated := make(chan bool, 1)
+	keys, err := newAPIKeysFromFileImpl(path, done, func() {
+		select {
+		case updated <- true:
+		default:
+		}
+	})
+	defer func() { done <- true }()
+	assert.Equal(t, nil, err)
+
+	key, ok := keys.Lookup("k-ci-0123456789")
+	assert.True(t, ok)
+	assert.Equal(t, &APIKey{User: "ci", Email: "ci@example.com", Groups: []string{"deploy", "readers"}}, key)
+	key, ok = keys.Lookup("k-backup-9876543210")
+	assert.True(t, ok)
+	assert.Equal(t, &APIKey{User: "backup"}, key)
+	_, ok = keys.Lookup("63123d507d507a78de4fb598bd39ce895d6efa47472f895e9744e45058a09e42")
+	assert.False(t, ok)
+	_, ok = keys.Lookup("")
+	assert.False(t, ok)
+
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("sha256:fec4421d43014c13a864d10ff2726b73d97f177972edd382c003e3f2ff928834, new\n")
+	f.Close()
+	<-updated
+	_, ok = keys.Lookup("k-new")
+	assert.True(t, ok)
+
+	_, err = NewAPIKeysFromFile(path + ".missing")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	path := writeAPIKeysFile(t, testAPIKeysFile)
+	defer os.Remove(path)
+
+	var upstreamHeaders http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeaders = r.Header
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"example.org"}
+	opts.PassBasicAuth = false
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return email == "ci@example.com" })
+	var err error
+	proxy.APIKeys, err = NewAPIKeysFromFile(path)
+	assert.Equal(t, nil, err)
+
+	tests := []struct {
+		name, header, value string
+		code                int
+		user, email, groups string
+	}{
+		{"header", "X-API-Key", "k-ci-0123456789", 200, "ci", "ci@example.com", "deploy,readers"},
+		{"bearer", "Authorization", "Bearer k-backup-9876543210", 200, "backup", "", ""},
+		{"unknown key", "X-API-Key", "k-unknown", 403, "", "", ""},
+		{"unknown bearer", "Authorization", "Bearer k-unknown", 403, "", "", ""},
+	}
+	for _, tc := range tests {
+		upstreamHeaders = nil
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(tc.header, tc.value)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, tc.code, rw.Code, tc.name)
+		if tc.code != 200 {
+			continue
+		}
+		gapAuth := tc.email
+		if gapAuth == "" {
+			gapAuth = tc.user
+		}
+		assert.Equal(t, gapAuth, rw.Header().Get("GAP-Auth"), tc.name)
+		assert.Equal(t, tc.user, upstreamHeaders.Get("X-Forwarded-User"), tc.name)
+		assert.Equal(t, tc.email, upstreamHeaders.Get("X-Forwarded-Email"), tc.name)
+		assert.Equal(t, tc.groups, upstreamHeaders.Get("X-Forwarded-Groups"), tc.name)
+		// the key is not passed upstream
+		assert.Equal(t, "", upstreamHeaders.Get(tc.header), tc.name)
+	}
+
+	// keys with an email are held to the email validation
+	proxy.Validator = func(string) bool { return false }
+	auth := func(key string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-Key", key)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusForbidden, auth("k-ci-0123456789"))
+	assert.Equal(t, http.StatusOK, auth("k-backup-9876543210"))
+	proxy.Validator = func(string) bool { return true }
+
+	denyFile := writeAPIKeysFile(t, "ci@example.com\n")
+	defer os.Remove(denyFile)
+	proxy.denyList, err = NewDenyList(denyFile, nil, func() {})
+	assert.Equal(t, nil, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-API-Key", "k-ci-0123456789")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
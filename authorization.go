@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+// AuthorizationRuleOptions configures one authorization rule, read from
+// [[authorization_rules]] tables in the config file
+type AuthorizationRuleOptions struct {
+	Host       string   `toml:"host"`
+	PathPrefix string   `toml:"path_prefix"`
+	PathRegex  string   `toml:"path_regex"`
+	Methods    []string `toml:"methods"`
+
+	AllowedEmails  []string `toml:"allowed_emails"`
+	AllowedDomains []string `toml:"allowed_domains"`
+	AllowedGroups  []string `toml:"allowed_groups"`
+}
+
+// AuthorizationRule restricts the requests it matches to sessions with one
+// of the allowed emails, email domains or groups. Empty match fields match
+// every request.
+type AuthorizationRule struct {
+	Host       string
+	PathPrefix string
+	PathRegex  *regexp.Regexp
+	Methods    []string
+
+	AllowedEmails  []string
+	AllowedDomains []string
+	AllowedGroups  []string
+}
+
+// LoadAuthorizationRules reads the [[authorization_rules]] tables of a
+// config file
+func LoadAuthorizationRules(path string) ([]AuthorizationRuleOptions, error) {
+	var cfg struct {
+		AuthorizationRules []AuthorizationRuleOptions `toml:"authorization_rules"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.AuthorizationRules, err
+}
+
+var methodRegexp = regexp.MustCompile("^[A-Z]+$")
+
+func parseAuthorizationRules(o *Options, msgs []string) []string {
+	o.authorizationRules = nil
+	for i, ro := range o.AuthorizationRules {
+		prefix := fmt.Sprintf("authorization_rules[%d]", i)
+		rule := &AuthorizationRule{
+			Host:       strings.ToLower(ro.Host),
+			PathPrefix: ro.PathPrefix,
+		}
+		var ruleMsgs []string
+		if strings.Contains(strings.TrimPrefix(rule.Host, "*."), "*") {
+			ruleMsgs = append(ruleMsgs, fmt.Sprintf("invalid host %q wildcards are only supported as a leading \"*.\"", ro.Host))
+		}
+		if ro.PathPrefix != "" && ro.PathRegex != "" {
+			ruleMsgs = append(ruleMsgs, "path_prefix and path_regex are mutually exclusive")
+		}
+		if ro.PathRegex != "" {
+			var err error
+			if rule.PathRegex, err = regexp.Compile(ro.PathRegex); err != nil {
+				ruleMsgs = append(ruleMsgs, fmt.Sprintf("error compiling path_regex=%q %s", ro.PathRegex, err))
+			}
+		}
+		for _, m := range ro.Methods {
+			m = strings.ToUpper(m)
+			if !methodRegexp.MatchString(m) {
+				ruleMsgs = append(ruleMsgs, fmt.Sprintf("invalid method %q", m))
+			}
+			rule.Methods = append(rule.Methods, m)
+		}
+		if len(ro.AllowedEmails) == 0 && len(ro.AllowedDomains) == 0 && len(ro.AllowedGroups) == 0 {
+			ruleMsgs = append(ruleMsgs, "at least one of allowed_emails, allowed_domains or allowed_groups is required")
+		}
+		for _, e := range ro.AllowedEmails {
+			rule.AllowedEmails = append(rule.AllowedEmails, strings.ToLower(e))
+		}
+		for _, d := range ro.AllowedDomains {
+			rule.AllowedDomains = append(rule.AllowedDomains, strings.ToLower(strings.TrimPrefix(d, "@")))
+		}
+		rule.AllowedGroups = ro.AllowedGroups
+
+		if len(ruleMsgs) != 0 {
+			for _, m := range ruleMsgs {
+				msgs = append(msgs, fmt.Sprintf("%s: %s", prefix, m))
+			}
+			continue
+		}
+		o.authorizationRules = append(o.authorizationRules, rule)
+	}
+	return msgs
+}
+
+// Matches reports whether req falls under the rule
+func (r *AuthorizationRule) Matches(req *http.Request) bool {
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return false
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.PathRegex != nil && !r.PathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost compares the host of a request, ignoring any port, with an
+// exact host name or a "*.example.com" wildcard
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// Allows reports whether the rule grants access to session
+func (r *AuthorizationRule) Allows(session *providers.SessionState) bool {
+	if session.Email != "" {
+		email := strings.ToLower(session.Email)
+		for _, e := range r.AllowedEmails {
+			if e == email {
+				return true
+			}
+		}
+		for _, d := range r.AllowedDomains {
+			if d == "*" || strings.HasSuffix(email, "@"+d) {
+				return true
+			}
+		}
+	}
+	for _, allowed := range r.AllowedGroups {
+		for _, g := range session.Groups {
+			if g == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authRequestRule returns the rule given by the allowed_emails,
+// allowed_email_domains and allowed_groups query parameters of an auth
+// request, or nil when none is present. Parameters may be repeated and hold
+// comma separated values. A parameter present without values allows nobody.
+func authRequestRule(query url.Values) *AuthorizationRule {
+	var present bool
+	values := func(name string) []string {
+		var out []string
+		for _, v := range query[name] {
+			present = true
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					out = append(out, s)
+				}
+			}
+		}
+		return out
+	}
+	rule := &AuthorizationRule{AllowedGroups: values("allowed_groups")}
+	for _, e := range values("allowed_emails") {
+		rule.AllowedEmails = append(rule.AllowedEmails, strings.ToLower(e))
+	}
+	for _, d := range values("allowed_email_domains") {
+		rule.AllowedDomains = append(rule.AllowedDomains, strings.ToLower(strings.TrimPrefix(d, "@")))
+	}
+	if !present {
+		return nil
+	}
+	return rule
+}
+
+func (r *AuthorizationRule) String() string {
+	var match []string
+	if r.Host != "" {
+		match = append(match, "host:"+r.Host)
+	}
+	if r.PathPrefix != "" {
+		match = append(match, "path_prefix:"+r.PathPrefix)
+	}
+	if r.PathRegex != nil {
+		match = append(match, "path_regex:"+r.PathRegex.String())
+	}
+	if len(r.Methods) != 0 {
+		match = append(match, "methods:"+strings.Join(r.Methods, ","))
+	}
+	if len(match) == 0 {
+		match = append(match, "all requests")
+	}
+	return fmt.Sprintf("Rule{%s}", strings.Join(match, " "))
+}
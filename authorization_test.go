@@ -0,0 +1,187 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAuthorizationRules(t *testing.T) {
+	f, _ := ioutil.TempFile("", "oauth2_proxy_cfg")
+	defer os.Remove(f.Name())
+	f.WriteString(`
+email_domains = ["example.com"]
+
+[[authorization_rules]]
+path_prefix = "/admin/"
+allowed_emails = ["jane@example.com"]
+allowed_groups = ["ops"]
+
+[[authorization_rules]]
+host = "metrics.example.com"
+methods = ["GET"]
+allowed_domains = ["sre.example.com"]
+`)
+	f.Close()
+
+	rules, err := LoadAuthorizationRules(f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []AuthorizationRuleOptions{
+		{PathPrefix: "/admin/", AllowedEmails: []string{"jane@example.com"}, AllowedGroups: []string{"ops"}},
+		{Host: "metrics.example.com", Methods: []string{"GET"}, AllowedDomains: []string{"sre.example.com"}},
+	}, rules)
+}
+
+func TestAuthorizationRulesValidation(t *testing.T) {
+	o := testOptions()
+	o.AuthorizationRules = []AuthorizationRuleOptions{
+		{PathPrefix: "/admin/", AllowedGroups: []string{"ops"}},
+		{PathPrefix: "/a", PathRegex: "^/b", AllowedGroups: []string{"ops"}},
+		{PathRegex: "(", AllowedGroups: []string{"ops"}},
+		{Host: "a.*.example.com", Methods: []string{"get", "BAD METHOD"}, AllowedGroups: []string{"ops"}},
+		{PathPrefix: "/metrics"},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "authorization_rules[1]: path_prefix and path_regex are mutually exclusive")
+	assert.Contains(t, err.Error(), "authorization_rules[2]: error compiling path_regex=\"(\"")
+	assert.Contains(t, err.Error(), "authorization_rules[3]: invalid host \"a.*.example.com\"")
+	assert.Contains(t, err.Error(), "authorization_rules[3]: invalid method \"BAD METHOD\"")
+	assert.Contains(t, err.Error(), "authorization_rules[4]: at least one of allowed_emails, allowed_domains or allowed_groups is required")
+	assert.Equal(t, 1, len(o.authorizationRules))
+}
+
+func TestAuthorizationRuleMatches(t *testing.T) {
+	o := testOptions()
+	o.AuthorizationRules = []AuthorizationRuleOptions{
+		{Host: "*.example.com", PathRegex: "^/api/v[0-9]+/", Methods: []string{"post", "PUT"}, AllowedGroups: []string{"ops"}},
+	}
+	assert.Equal(t, nil, o.Validate())
+	rule := o.authorizationRules[0]
+
+	match := func(method, host, target string) bool {
+		req := httptest.NewRequest(method, target, nil)
+		req.Host = host
+		return rule.Matches(req)
+	}
+	assert.True(t, match("POST", "app.example.com", "/api/v1/users"))
+	assert.True(t, match("PUT", "APP.example.com:8443", "/api/v2/users"))
+	assert.False(t, match("GET", "app.example.com", "/api/v1/users"))
+	assert.False(t, match("POST", "example.com", "/api/v1/users"))
+	assert.False(t, match("POST", "app.example.org", "/api/v1/users"))
+	assert.False(t, match("POST", "app.example.com", "/api/users"))
+}
+
+func TestAuthorizationRuleAllows(t *testing.T) {
+	rule := &AuthorizationRule{
+		AllowedEmails:  []string{"jane@example.com"},
+		AllowedDomains: []string{"sre.example.com"},
+		AllowedGroups:  []string{"ops"},
+	}
+	assert.True(t, rule.Allows(&providers.SessionState{Email: "Jane@Example.com"}))
+	assert.True(t, rule.Allows(&providers.SessionState{Email: "bob@sre.example.com"}))
+	assert.True(t, rule.Allows(&providers.SessionState{Email: "bob@example.com", Groups: []string{"dev", "ops"}}))
+	assert.True(t, rule.Allows(&providers.SessionState{User: "robot", Groups: []string{"ops"}}))
+	assert.False(t, rule.Allows(&providers.SessionState{Email: "bob@example.com", Groups: []string{"dev"}}))
+	assert.False(t, rule.Allows(&providers.SessionState{Email: "bob@notsre.example.com"}))
+	assert.False(t, rule.Allows(&providers.SessionState{User: "jane@example.com"}))
+
+	anyone := &AuthorizationRule{AllowedDomains: []string{"*"}}
+	assert.True(t, anyone.Allows(&providers.SessionState{Email: "bob@example.org"}))
+}
+
+func TestAuthorizationRulesFirstMatchWins(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.AuthorizationRules = []AuthorizationRuleOptions{
+			{PathPrefix: "/admin/public", AllowedDomains: []string{"*"}},
+			{PathPrefix: "/admin/", AllowedEmails: []string{"jane@example.com"}, AllowedGroups: []string{"ops"}},
+			{PathPrefix: "/metrics", Methods: []string{"GET"}, AllowedDomains: []string{"sre.example.com"}},
+		}
+	})
+	defer test.Close()
+
+	jane := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane"})
+	bob := test.SessionCookie(t, &providers.SessionState{Email: "bob@example.com", User: "bob"})
+	bobOps := test.SessionCookie(t, &providers.SessionState{Email: "bob@example.com", User: "bob", Groups: []string{"ops"}})
+
+	assert.Equal(t, http.StatusOK, test.Serve("/private", bob).StatusCode)
+	assert.Equal(t, http.StatusOK, test.Serve("/admin/users", jane).StatusCode)
+	assert.Equal(t, http.StatusOK, test.Serve("/admin/users", bobOps).StatusCode)
+	assert.Equal(t, http.StatusOK, test.Serve("/admin/public/docs", bob).StatusCode)
+	assert.Equal(t, http.StatusForbidden, test.Serve("/metrics", jane).StatusCode)
+
+	resp := test.Serve("/admin/users", bob)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "bob@example.com is not authorized to access /admin/users")
+	// the session stays valid for other paths
+	assert.Equal(t, 0, len(test.SessionCookies(resp)))
+}
+
+func TestAuthorizationRulesAuthOnlyEndpoint(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.AuthorizationRules = []AuthorizationRuleOptions{
+			{PathPrefix: "/oauth2/auth", AllowedGroups: []string{"ops"}},
+		}
+	})
+	defer test.Close()
+
+	assert.Equal(t, http.StatusUnauthorized, test.Serve("/oauth2/auth", nil).StatusCode)
+	bob := test.SessionCookie(t, &providers.SessionState{Email: "bob@example.com", User: "bob"})
+	assert.Equal(t, http.StatusForbidden, test.Serve("/oauth2/auth", bob).StatusCode)
+	bobOps := test.SessionCookie(t, &providers.SessionState{Email: "bob@example.com", User: "bob", Groups: []string{"ops"}})
+	assert.Equal(t, http.StatusAccepted, test.Serve("/oauth2/auth", bobOps).StatusCode)
+}
+
+func TestAuthRequestRule(t *testing.T) {
+	assert.Nil(t, authRequestRule(url.Values{"rd": {"/"}}))
+
+	rule := authRequestRule(url.Values{
+		"allowed_groups":        {"ops, admins", "sre"},
+		"allowed_emails":        {"Jane@Example.com"},
+		"allowed_email_domains": {"@partner.example.org"},
+	})
+	assert.Equal(t, []string{"ops", "admins", "sre"}, rule.AllowedGroups)
+	assert.Equal(t, []string{"jane@example.com"}, rule.AllowedEmails)
+	assert.Equal(t, []string{"partner.example.org"}, rule.AllowedDomains)
+
+	// an empty parameter allows nobody rather than everybody
+	rule = authRequestRule(url.Values{"allowed_groups": {""}})
+	if assert.NotNil(t, rule) {
+		assert.False(t, rule.Allows(&providers.SessionState{Email: "jane@example.com", Groups: []string{"ops"}}))
+	}
+}
+
+func TestAuthOnlyEndpointQueryRequirements(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.EmailDomains = []string{"example.com", "partner.example.org"}
+	})
+	defer test.Close()
+
+	jane := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane", Groups: []string{"ops"}})
+	bob := test.SessionCookie(t, &providers.SessionState{Email: "bob@partner.example.org", User: "bob"})
+
+	assert.Equal(t, http.StatusUnauthorized, test.Serve("/oauth2/auth?allowed_groups=ops", nil).StatusCode)
+	assert.Equal(t, http.StatusAccepted, test.Serve("/oauth2/auth", bob).StatusCode)
+
+	assert.Equal(t, http.StatusAccepted, test.Serve("/oauth2/auth?allowed_groups=admins,ops", jane).StatusCode)
+	assert.Equal(t, http.StatusForbidden, test.Serve("/oauth2/auth?allowed_groups=admins,ops", bob).StatusCode)
+
+	assert.Equal(t, http.StatusAccepted, test.Serve("/oauth2/auth?allowed_emails=JANE@example.com", jane).StatusCode)
+	assert.Equal(t, http.StatusForbidden, test.Serve("/oauth2/auth?allowed_emails=jane@example.com", bob).StatusCode)
+
+	assert.Equal(t, http.StatusAccepted, test.Serve("/oauth2/auth?allowed_email_domains=partner.example.org", bob).StatusCode)
+	assert.Equal(t, http.StatusForbidden, test.Serve("/oauth2/auth?allowed_email_domains=partner.example.org", jane).StatusCode)
+
+	// any of the parameters grants access
+	assert.Equal(t, http.StatusAccepted, test.Serve("/oauth2/auth?allowed_groups=ops&allowed_email_domains=partner.example.org", bob).StatusCode)
+
+	// the parameters only apply to the auth endpoint
+	assert.Equal(t, http.StatusOK, test.Serve("/private?allowed_groups=admins", bob).StatusCode)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+// BearerSessionCache holds device flow sessions refreshed after their bearer
+// token was issued. Clients keep sending the token they were given, so
+// without it every request would refresh the session again.
+type BearerSessionCache struct {
+	mu       sync.Mutex
+	sessions map[string]*bearerSession
+	now      func() time.Time
+}
+
+type bearerSession struct {
+	session *providers.SessionState
+	saved   time.Time
+	expires time.Time
+}
+
+func NewBearerSessionCache() *BearerSessionCache {
+	return &BearerSessionCache{
+		sessions: make(map[string]*bearerSession),
+		now:      time.Now,
+	}
+}
+
+// Load returns a copy of the session saved for key and when it was saved
+func (c *BearerSessionCache) Load(key string) (*providers.SessionState, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.sessions[key]
+	if !ok || !c.now().Before(s.expires) {
+		return nil, time.Time{}, false
+	}
+	session := *s.session
+	return &session, s.saved, true
+}
+
+// Save keeps a copy of session for key until expires, when its bearer token
+// expires
+func (c *BearerSessionCache) Save(key string, session *providers.SessionState, expires time.Time) {
+	now := c.now()
+	saved := *session
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, s := range c.sessions {
+		if !now.Before(s.expires) {
+			delete(c.sessions, k)
+		}
+	}
+	c.sessions[key] = &bearerSession{session: &saved, saved: now, expires: expires}
+}
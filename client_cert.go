@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidUPN            = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+// ClientCertAuthenticator verifies TLS client certificates against a CA
+// bundle and maps them to sessions. Certificates listed in the CRL file are
+// refused; the file is reloaded when it changes.
+type ClientCertAuthenticator struct {
+	CAs      *x509.CertPool
+	Required bool
+
+	caCerts []*x509.Certificate
+	crlPath string
+	revoked unsafe.Pointer
+}
+
+func NewClientCertAuthenticator(caFile, crlFile string, required bool) (*ClientCertAuthenticator, error) {
+	return newClientCertAuthenticatorImpl(caFile, crlFile, required, nil, func() {})
+}
+
+func newClientCertAuthenticatorImpl(caFile, crlFile string, required bool, done <-chan bool, onUpdate func()) (*ClientCertAuthenticator, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	a := &ClientCertAuthenticator{CAs: x509.NewCertPool(), Required: required, crlPath: crlFile}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", caFile, err)
+		}
+		a.CAs.AddCert(cert)
+		a.caCerts = append(a.caCerts, cert)
+	}
+	if len(a.caCerts) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	revoked := make(map[string]bool)
+	atomic.StorePointer(&a.revoked, unsafe.Pointer(&revoked))
+	if crlFile != "" {
+		if err := a.loadCRL(); err != nil {
+			return nil, err
+		}
+		WatchForUpdates(crlFile, done, func() {
+			if err := a.loadCRL(); err != nil {
+				log.Printf("error reloading tls-client-crl-file=%q, %s", crlFile, err)
+			}
+			onUpdate()
+		})
+	}
+	return a, nil
+}
+
+// loadCRL reads the PEM or DER encoded CRLs in the CRL file. Each must be
+// signed by one of the CAs.
+func (a *ClientCertAuthenticator) loadCRL() error {
+	data, err := ioutil.ReadFile(a.crlPath)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = append(ders, data)
+	}
+
+	revoked := make(map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseCRL(der)
+		if err != nil {
+			return err
+		}
+		issuer, err := a.crlIssuer(crl)
+		if err != nil {
+			return err
+		}
+		if crl.HasExpired(time.Now()) {
+			log.Printf("tls-client-crl-file=%q has a CRL from %s past its next update", a.crlPath, issuer.Subject)
+		}
+		for _, c := range crl.TBSCertList.RevokedCertificates {
+			revoked[revocationKey(issuer.RawSubject, c.SerialNumber.String())] = true
+		}
+	}
+	atomic.StorePointer(&a.revoked, unsafe.Pointer(&revoked))
+	return nil
+}
+
+// crlIssuer returns the CA that issued and signed crl
+func (a *ClientCertAuthenticator) crlIssuer(crl *pkix.CertificateList) (*x509.Certificate, error) {
+	name := crl.TBSCertList.Issuer.String()
+	for _, ca := range a.caCerts {
+		if ca.Subject.String() != name {
+			continue
+		}
+		if err := ca.CheckCRLSignature(crl); err != nil {
+			return nil, fmt.Errorf("invalid CRL signature from %s: %v", name, err)
+		}
+		return ca, nil
+	}
+	return nil, fmt.Errorf("CRL issuer %s is not in the client CA bundle", name)
+}
+
+func revocationKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
+
+// Revoked reports whether cert is listed in the CRL file
+func (a *ClientCertAuthenticator) Revoked(cert *x509.Certificate) bool {
+	revoked := *(*map[string]bool)(atomic.LoadPointer(&a.revoked))
+	return revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())]
+}
+
+// ConfigureTLS makes config request client certificates, verify them against
+// the CAs and refuse revoked ones
+func (a *ClientCertAuthenticator) ConfigureTLS(config *tls.Config) {
+	config.ClientCAs = a.CAs
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if a.Required {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if a.Revoked(cert) {
+					return fmt.Errorf("client certificate %s serial %s is revoked", cert.Subject, cert.SerialNumber)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// Session returns the session of the verified client certificate of req. The
+// user is the certificate's UPN, SAN email or subject common name, and the
+// email its SAN email or UPN.
+func (a *ClientCertAuthenticator) Session(req *http.Request) *providers.SessionState {
+	if a == nil || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	// the CRL may have been updated since the connection was established
+	for _, cert := range req.TLS.VerifiedChains[0] {
+		if a.Revoked(cert) {
+			log.Printf("refusing revoked client certificate %s serial %s", cert.Subject, cert.SerialNumber)
+			return nil
+		}
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	upn := certUPN(cert)
+	session := &providers.SessionState{User: upn, Email: upn, Subject: cert.Subject.String(), AuthTime: time.Now()}
+	if len(cert.EmailAddresses) != 0 {
+		session.Email = cert.EmailAddresses[0]
+	}
+	if session.User == "" {
+		session.User = session.Email
+	}
+	if session.User == "" {
+		session.User = cert.Subject.CommonName
+	}
+	if session.User == "" {
+		return nil
+	}
+	return session
+}
+
+// certUPN returns the Microsoft user principal name in the subject
+// alternative names of cert
+func certUPN(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return ""
+		}
+		for _, name := range names {
+			// otherName [0] { type-id OID, value [0] EXPLICIT ANY }
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var other struct {
+				ID    asn1.ObjectIdentifier
+				Value asn1.RawValue `asn1:"explicit,tag:0"`
+			}
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil || !other.ID.Equal(oidUPN) {
+				continue
+			}
+			var upn string
+			if _, err := asn1.Unmarshal(other.Value.Bytes, &upn); err == nil {
+				return upn
+			}
+		}
+	}
+	return ""
+}
+
+// CheckClientCert authenticates req by its TLS client certificate
+func (p *OAuthProxy) CheckClientCert(req *http.Request) *providers.SessionState {
+	session := p.ClientCerts.Session(req)
+	if session == nil {
+		return nil
+	}
+	if err := p.refuseSession(session); err != nil {
+		log.Printf("%s %s via client certificate", p.getRemoteAddr(req), err)
+		return nil
+	}
+	return session
+}
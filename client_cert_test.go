@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	f, _ := ioutil.TempFile("", "client-ca")
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	f.Close()
+	return &testCA{cert: cert, key: key, file: f.Name()}
+}
+
+// issue returns a client certificate with the given subject alternative
+// name extension, or none when san is nil
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, san []asn1.RawValue) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if san != nil {
+		value, err := asn1.Marshal(san)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: oidSubjectAltName, Value: value}}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) crl(t *testing.T, number int64, serials ...int64) []byte {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, s := range serials {
+		template.RevokedCertificates = append(template.RevokedCertificates,
+			pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func sanEmail(email string) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(email)}
+}
+
+func sanUPN(t *testing.T, upn string) asn1.RawValue {
+	value, _ := asn1.MarshalWithParams(upn, "utf8")
+	other, err := asn1.MarshalWithParams(struct {
+		ID    asn1.ObjectIdentifier
+		Value asn1.RawValue
+	}{oidUPN, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value}}, "tag:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return asn1.RawValue{FullBytes: other}
+}
+
+func clientCertRequest(a *ClientCertAuthenticator, cert tls.Certificate) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	chains, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: a.CAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err == nil {
+		req.TLS.VerifiedChains = chains
+	}
+	return req
+}
+
+func TestClientCertSession(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.Remove(ca.file)
+	a, err := NewClientCertAuthenticator(ca.file, "", false)
+	assert.Equal(t, nil, err)
+
+	session := a.Session(clientCertRequest(a, ca.issue(t, 2, "Jane Doe", []asn1.RawValue{sanUPN(t, "jdoe@corp.example.com"), sanEmail("jane@example.com")})))
+	if assert.NotNil(t, session) {
+		assert.Equal(t, "jdoe@corp.example.com", session.User)
+		assert.Equal(t, "jane@example.com", session.Email)
+		assert.Equal(t, "CN=Jane Doe,O=Example", session.Subject)
+	}
+
+	session = a.Session(clientCertRequest(a, ca.issue(t, 3, "Jane Doe", []asn1.RawValue{sanUPN(t, "jdoe@corp.example.com")})))
+	if assert.NotNil(t, session) {
+		assert.Equal(t, "jdoe@corp.example.com", session.User)
+		assert.Equal(t, "jdoe@corp.example.com", session.Email)
+	}
+
+	session = a.Session(clientCertRequest(a, ca.issue(t, 4, "Jane Doe", []asn1.RawValue{sanEmail("jane@example.com")})))
+	if assert.NotNil(t, session) {
+		assert.Equal(t, "jane@example.com", session.User)
+		assert.Equal(t, "jane@example.com", session.Email)
+	}
+
+	session = a.Session(clientCertRequest(a, ca.issue(t, 5, "build-agent-7", nil)))
+	if assert.NotNil(t, session) {
+		assert.Equal(t, "build-agent-7", session.User)
+		assert.Equal(t, "", session.Email)
+	}
+
+	// certificates from other CAs are not verified
+	other := newTestCA(t)
+	defer os.Remove(other.file)
+	assert.Nil(t, a.Session(clientCertRequest(a, other.issue(t, 2, "Jane Doe", nil))))
+	assert.Nil(t, a.Session(httptest.NewRequest("GET", "/", nil)))
+}
+
+func TestClientCertCRLReload(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.Remove(ca.file)
+	crlFile, _ := ioutil.TempFile("", "client-crl")
+	defer os.Remove(crlFile.Name())
+	crlFile.Write(ca.crl(t, 1, 3))
+	crlFile.Close()
+
+	updated := make(chan bool, 1)
+	done := make(chan bool)
+	defer func() { done <- true }()
+	a, err := newClientCertAuthenticatorImpl(ca.file, crlFile.Name(), false, done, func() {
+		select {
+		case updated <- true:
+		default:
+		}
+	})
+	assert.Equal(t, nil, err)
+
+	jane := ca.issue(t, 2, "jane", nil)
+	bob := ca.issue(t, 3, "bob", nil)
+	assert.NotNil(t, a.Session(clientCertRequest(a, jane)))
+	assert.Nil(t, a.Session(clientCertRequest(a, bob)))
+
+	f, _ := os.OpenFile(crlFile.Name(), os.O_APPEND|os.O_WRONLY, 0600)
+	f.Write(ca.crl(t, 2, 2, 3))
+	f.Close()
+	<-updated
+	assert.True(t, a.Revoked(jane.Leaf))
+	assert.Nil(t, a.Session(clientCertRequest(a, jane)))
+}
+
+func TestClientCertCRLMustBeSignedByCA(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.Remove(ca.file)
+	other := newTestCA(t)
+	defer os.Remove(other.file)
+	crlFile, _ := ioutil.TempFile("", "client-crl")
+	defer os.Remove(crlFile.Name())
+	crlFile.Write(other.crl(t, 1, 2))
+	crlFile.Close()
+
+	_, err := NewClientCertAuthenticator(ca.file, crlFile.Name(), false)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.Remove(ca.file)
+	crlFile, _ := ioutil.TempFile("", "client-crl")
+	defer os.Remove(crlFile.Name())
+	crlFile.Write(ca.crl(t, 1, 3))
+	crlFile.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.TLSCertFile = "cert.pem"
+	opts.TLSKeyFile = "key.pem"
+	opts.TLSClientCAFile = ca.file
+	opts.TLSClientCRLFile = crlFile.Name()
+	opts.DenyFile = crlFile.Name() + ".deny"
+	opts.SetXAuthRequest = true
+	assert.Equal(t, nil, opts.Validate())
+	ioutil.WriteFile(opts.DenyFile, []byte("mallory@example.com\n"), 0600)
+	defer os.Remove(opts.DenyFile)
+	proxy := NewOAuthProxy(opts, func(email string) bool { return strings.HasSuffix(email, "@example.com") })
+	proxy.ClientCerts, _ = NewClientCertAuthenticator(ca.file, crlFile.Name(), false)
+
+	server := httptest.NewUnstartedServer(proxy)
+	server.TLS = &tls.Config{}
+	proxy.ClientCerts.ConfigureTLS(server.TLS)
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cert *tls.Certificate) (*http.Response, error) {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		return (&http.Client{Transport: transport}).Get(server.URL + "/oauth2/auth")
+	}
+
+	jane := ca.issue(t, 2, "Jane Doe", []asn1.RawValue{sanEmail("jane@example.com")})
+	resp, err := get(&jane)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "jane@example.com", resp.Header.Get("X-Auth-Request-User"))
+		assert.Equal(t, "jane@example.com", resp.Header.Get("X-Auth-Request-Email"))
+	}
+
+	// the certificate is optional, other ways of signing in remain
+	resp, err = get(nil)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	mallory := ca.issue(t, 4, "Mallory", []asn1.RawValue{sanEmail("mallory@example.com")})
+	resp, err = get(&mallory)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// certificates are held to the email validation
+	eve := ca.issue(t, 5, "Eve", []asn1.RawValue{sanEmail("eve@example.net")})
+	resp, err = get(&eve)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	agent := ca.issue(t, 6, "build-agent-7", nil)
+	resp, err = get(&agent)
+	if assert.Equal(t, nil, err) {
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "build-agent-7", resp.Header.Get("X-Auth-Request-User"))
+	}
+
+	// revoked certificates fail the handshake
+	bob := ca.issue(t, 3, "Bob", nil)
+	_, err = get(&bob)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestClientCertRequired(t *testing.T) {
+	ca := newTestCA(t)
+	defer os.Remove(ca.file)
+	a, err := NewClientCertAuthenticator(ca.file, "", true)
+	assert.Equal(t, nil, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(a.Session(req).User))
+	}))
+	server.TLS = &tls.Config{}
+	a.ConfigureTLS(server.TLS)
+	server.StartTLS()
+	defer server.Close()
+
+	_, err = server.Client().Get(server.URL)
+	assert.NotEqual(t, nil, err)
+
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{ca.issue(t, 2, "jane", nil)}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if assert.Equal(t, nil, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "jane", string(body))
+	}
+}
+
+func TestClientCertOptions(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.TLSClientCAFile = "ca.pem"
+	opts.TLSClientAuth = "always"
+	err := opts.Validate()
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "tls-client-ca-file requires tls-cert-file")
+		assert.Contains(t, err.Error(), `invalid tls-client-auth="always"`)
+		assert.NotContains(t, err.Error(), "email-domain")
+	}
+
+	opts = NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.TLSClientCRLFile = "crl.pem"
+	err = opts.Validate()
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "tls-client-crl-file requires tls-client-ca-file")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+type denyEntries struct {
+	emails   map[string]bool
+	patterns []string
+	subjects map[string]bool
+}
+
+// DenyList refuses access to accounts regardless of the email domains,
+// authenticated emails and groups that would allow them. Its file holds one
+// email address, glob pattern or sub:<subject> per line and is reloaded when
+// it changes.
+type DenyList struct {
+	denyFile string
+	m        unsafe.Pointer
+}
+
+func NewDenyList(denyFile string, done <-chan bool, onUpdate func()) (*DenyList, error) {
+	dl := &DenyList{denyFile: denyFile}
+	atomic.StorePointer(&dl.m, unsafe.Pointer(&denyEntries{}))
+	if denyFile != "" {
+		log.Printf("using deny file %s", denyFile)
+		if err := dl.LoadDenyFile(); err != nil {
+			return nil, err
+		}
+		// a reload that fails keeps the previous entries
+		WatchForUpdates(denyFile, done, func() {
+			if err := dl.LoadDenyFile(); err != nil {
+				log.Printf("error reloading deny-file=%q, %s", denyFile, err)
+			}
+			onUpdate()
+		})
+	}
+	return dl, nil
+}
+
+func (dl *DenyList) LoadDenyFile() error {
+	r, err := os.Open(dl.denyFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	updated := &denyEntries{emails: make(map[string]bool), subjects: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "sub:"):
+			updated.subjects[strings.TrimPrefix(line, "sub:")] = true
+		case strings.ContainsAny(line, "*?["):
+			pattern := strings.ToLower(line)
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Printf("skipping entry %q in deny-file=%q, %s", line, dl.denyFile, err)
+				continue
+			}
+			updated.patterns = append(updated.patterns, pattern)
+		default:
+			updated.emails[strings.ToLower(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	atomic.StorePointer(&dl.m, unsafe.Pointer(updated))
+	return nil
+}
+
+// Denies reports whether the account of session is on the deny list
+func (dl *DenyList) Denies(session *providers.SessionState) bool {
+	if dl == nil {
+		return false
+	}
+	m := (*denyEntries)(atomic.LoadPointer(&dl.m))
+	if session.Subject != "" && m.subjects[session.Subject] {
+		return true
+	}
+	if session.Email == "" {
+		return false
+	}
+	email := strings.ToLower(session.Email)
+	if m.emails[email] {
+		return true
+	}
+	for _, pattern := range m.patterns {
+		if ok, _ := path.Match(pattern, email); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/d-cheremnov/oauth2_proxy/mockidp"
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDenyList(t *testing.T) {
+	f, _ := ioutil.TempFile("", "test_deny_")
+	defer os.Remove(f.Name())
+	f.WriteString(`# offboarded
+Bob@example.com
+*.contractor@example.com
+sub:248289761001
+[broken
+`)
+	f.Close()
+
+	done := make(chan bool)
+	updated := make(chan bool, 1)
+	dl, err := NewDenyList(f.Name(), done, func() {
+		select {
+		case updated <- true:
+		default:
+		}
+	})
+	assert.Equal(t, nil, err)
+	defer func() { done <- true }()
+
+	tests := []struct {
+		session *providers.SessionState
+		denied  bool
+	}{
+		{&providers.SessionState{Email: "bob@example.com"}, true},
+		{&providers.SessionState{Email: "BOB@EXAMPLE.COM"}, true},
+		{&providers.SessionState{Email: "alice.contractor@example.com"}, true},
+		{&providers.SessionState{Email: "alice@example.com"}, false},
+		{&providers.SessionState{Email: "alice@example.com", Subject: "248289761001"}, true},
+		{&providers.SessionState{User: "bob"}, false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.denied, dl.Denies(tc.session), tc.session.String())
+	}
+
+	f, _ = os.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("alice@example.com\n")
+	f.Close()
+	<-updated
+	assert.True(t, dl.Denies(&providers.SessionState{Email: "alice@example.com"}))
+
+	var nilList *DenyList
+	assert.False(t, nilList.Denies(&providers.SessionState{Email: "bob@example.com"}))
+}
+
+func TestDenyListMissingFile(t *testing.T) {
+	f, _ := ioutil.TempFile("", "test_deny_")
+	f.WriteString("bob@example.com\n")
+	f.Close()
+	dl := &DenyList{denyFile: f.Name()}
+	assert.Equal(t, nil, dl.LoadDenyFile())
+
+	// a reload that fails keeps the previous entries
+	os.Remove(f.Name())
+	assert.NotEqual(t, nil, dl.LoadDenyFile())
+	assert.True(t, dl.Denies(&providers.SessionState{Email: "bob@example.com"}))
+
+	_, err := NewDenyList(f.Name(), nil, func() {})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDenyFileOverridesAllows(t *testing.T) {
+	f, _ := ioutil.TempFile("", "test_deny_")
+	defer os.Remove(f.Name())
+	f.Close()
+
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.EmailDomains = []string{"*"}
+		o.DenyFile = f.Name()
+	}, mockidp.User{Subject: "jane", Email: "jane@example.com"})
+	defer test.Close()
+
+	csrf, callback := test.Login(t)
+	signedIn := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusFound, signedIn.StatusCode)
+	session := test.SessionCookies(signedIn)
+	assert.Equal(t, http.StatusOK, test.Serve("/private", session).StatusCode)
+
+	// existing sessions are cut off on their next request
+	ioutil.WriteFile(f.Name(), []byte("sub:jane\n"), 0600)
+	test.proxy.denyList.LoadDenyFile()
+	assert.Equal(t, http.StatusForbidden, test.Serve("/private", session).StatusCode)
+
+	csrf, callback = test.Login(t)
+	assert.Equal(t, http.StatusForbidden, test.Serve(callback.RequestURI(), csrf).StatusCode)
+}
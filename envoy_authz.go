@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// EnvoyAuthzServer implements the Envoy external authorization gRPC API. It
+// authenticates the request Envoy describes like a proxied request: allowed
+// requests get the identity headers the proxy would pass upstream, others a
+// redirect to sign in or an error status.
+type EnvoyAuthzServer struct {
+	proxy *OAuthProxy
+}
+
+func NewEnvoyAuthzServer(proxy *OAuthProxy) *EnvoyAuthzServer {
+	return &EnvoyAuthzServer{proxy: proxy}
+}
+
+// ServeEnvoyAuthz answers Envoy ext_authz checks on addr
+func ServeEnvoyAuthz(addr string, proxy *OAuthProxy) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
+	}
+	log.Printf("Envoy ext_authz: listening on %s", ln.Addr())
+	srv := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(srv, NewEnvoyAuthzServer(proxy))
+	if err := srv.Serve(ln); err != nil {
+		log.Printf("ERROR: ext_authz Serve() - %s", err)
+	}
+}
+
+// headerRecorder is a ResponseWriter keeping only the headers written
+type headerRecorder struct {
+	header http.Header
+}
+
+func (r *headerRecorder) Header() http.Header         { return r.header }
+func (r *headerRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (r *headerRecorder) WriteHeader(int)             {}
+
+// envoyRequest rebuilds the HTTP request an ext_authz check describes
+func envoyRequest(check *authv3.CheckRequest) (*http.Request, bool) {
+	attrs := check.GetAttributes()
+	h := attrs.GetRequest().GetHttp()
+	if h == nil || h.GetHost() == "" || strings.ContainsAny(h.GetHost(), "/?#@, ") {
+		return nil, false
+	}
+	u, err := url.ParseRequestURI(h.GetPath())
+	if err != nil {
+		return nil, false
+	}
+	if h.GetQuery() != "" && u.RawQuery == "" {
+		u.RawQuery = h.GetQuery()
+	}
+	req := &http.Request{
+		Method:     h.GetMethod(),
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       h.GetHost(),
+		RequestURI: u.RequestURI(),
+	}
+	for k, v := range h.GetHeaders() {
+		// HTTP/2 pseudo headers such as :authority are in the fields above
+		if !strings.HasPrefix(k, ":") {
+			req.Header.Set(k, v)
+		}
+	}
+	if sa := attrs.GetSource().GetAddress().GetSocketAddress(); sa != nil {
+		req.RemoteAddr = net.JoinHostPort(sa.GetAddress(), strconv.Itoa(int(sa.GetPortValue())))
+	}
+	return req, true
+}
+
+// envoySignInURL returns the absolute URL of the sign in page for req,
+// returning to it afterwards. The page is on the original host unless the
+// redirect URL names a central one.
+func (p *OAuthProxy) envoySignInURL(req *http.Request, scheme string) string {
+	if scheme != "http" {
+		scheme = "https"
+	}
+	original := &url.URL{Scheme: scheme, Host: req.Host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+	signIn := &url.URL{Scheme: scheme, Host: req.Host, Path: p.SignInPath}
+	rd := original.RequestURI()
+	if p.redirectURL.Host != "" {
+		signIn.Scheme, signIn.Host = p.redirectURL.Scheme, p.redirectURL.Host
+		rd = original.String()
+	}
+	signIn.RawQuery = url.Values{"rd": {rd}}.Encode()
+	return signIn.String()
+}
+
+func headerOptions(h http.Header) []*core.HeaderValueOption {
+	var opts []*core.HeaderValueOption
+	for k, vs := range h {
+		for i, v := range vs {
+			opts = append(opts, &core.HeaderValueOption{
+				Header: &core.HeaderValue{Key: k, Value: v},
+				// replace the client's value, keep further values
+				Append: &wrappers.BoolValue{Value: i > 0},
+			})
+		}
+	}
+	return opts
+}
+
+func envoyDenied(code int, grpcCode codes.Code, header http.Header, body string) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(grpcCode)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode(code)},
+			Headers: headerOptions(header),
+			Body:    body,
+		}},
+	}
+}
+
+// Check authorizes the request described by check
+func (s *EnvoyAuthzServer) Check(ctx context.Context, check *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	p := s.proxy
+	req, ok := envoyRequest(check)
+	if !ok {
+		return envoyDenied(http.StatusBadRequest, codes.InvalidArgument, nil, "Bad Request"), nil
+	}
+	before := req.Header.Clone()
+	rw := &headerRecorder{header: make(http.Header)}
+
+	// Envoy cannot tell us where a request is routed, so the proxy's own
+	// endpoints are authenticated like any other path; routes to the proxy
+	// disable the ext_authz filter instead
+	var status int
+	if p.IsWhitelistedRequest(req) {
+		p.stripAuthHeaders(req)
+		status = http.StatusAccepted
+	} else {
+		var session *providers.SessionState
+		status, session = p.authenticate(rw, req)
+		if status == http.StatusForbidden && session == nil {
+			status = http.StatusUnauthorized
+		}
+	}
+
+	switch status {
+	case http.StatusAccepted:
+	case http.StatusUnauthorized:
+		// browsers are sent to sign in, other requests cannot follow it
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return envoyDenied(http.StatusUnauthorized, codes.Unauthenticated, rw.header, "Unauthorized"), nil
+		}
+		rw.header.Set("Location", p.envoySignInURL(req, check.GetAttributes().GetRequest().GetHttp().GetScheme()))
+		return envoyDenied(http.StatusFound, codes.Unauthenticated, rw.header, ""), nil
+	case http.StatusForbidden:
+		return envoyDenied(http.StatusForbidden, codes.PermissionDenied, rw.header, "Forbidden"), nil
+	case http.StatusTooManyRequests:
+		return envoyDenied(http.StatusTooManyRequests, codes.ResourceExhausted, rw.header, "Too Many Requests"), nil
+	default:
+		return envoyDenied(http.StatusInternalServerError, codes.Internal, rw.header, "Internal Error"), nil
+	}
+
+	// the request headers the proxy changed go upstream, the cookies it set
+	// back to the client
+	allowed := &authv3.OkHttpResponse{}
+	upstream := make(http.Header)
+	for k, vs := range req.Header {
+		if strings.Join(vs, ",") != strings.Join(before[k], ",") {
+			upstream[k] = vs
+		}
+	}
+	for k := range before {
+		if _, ok := req.Header[k]; !ok {
+			allowed.HeadersToRemove = append(allowed.HeadersToRemove, k)
+		}
+	}
+	for k, vs := range rw.header {
+		if k != "Set-Cookie" {
+			upstream[k] = vs
+		}
+	}
+	allowed.Headers = headerOptions(upstream)
+	if cookies := rw.header["Set-Cookie"]; len(cookies) != 0 {
+		allowed.ResponseHeadersToAdd = headerOptions(http.Header{"Set-Cookie": cookies})
+	}
+	return &authv3.CheckResponse{
+		Status:       &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: allowed},
+	}, nil
+}
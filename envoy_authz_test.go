@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func envoyHeader(opts []*core.HeaderValueOption) http.Header {
+	h := make(http.Header)
+	for _, o := range opts {
+		h.Add(o.GetHeader().GetKey(), o.GetHeader().GetValue())
+	}
+	return h
+}
+
+func TestEnvoyAuthz(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.AuthorizationRules = []AuthorizationRuleOptions{
+			{PathPrefix: "/admin/", AllowedGroups: []string{"ops"}},
+		}
+		o.MaxAuthAge = []string{"^/reports/=15m"}
+	})
+	defer test.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(srv, NewEnvoyAuthzServer(test.proxy))
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := authv3.NewAuthorizationClient(conn)
+
+	check := func(method, path string, cookies []*http.Cookie) *authv3.CheckResponse {
+		headers := map[string]string{
+			":authority":        "app.example.com",
+			"x-forwarded-email": "spoofed@example.com",
+		}
+		if len(cookies) != 0 {
+			req, _ := http.NewRequest("GET", "/", nil)
+			for _, c := range cookies {
+				req.AddCookie(c)
+			}
+			headers["cookie"] = req.Header.Get("Cookie")
+		}
+		resp, err := client.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{
+						Method:  method,
+						Host:    "app.example.com",
+						Path:    path,
+						Scheme:  "https",
+						Headers: headers,
+					},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	jane := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane"})
+	resp := check("GET", "/private", jane)
+	assert.Equal(t, int32(codes.OK), resp.GetStatus().GetCode())
+	upstream := envoyHeader(resp.GetOkResponse().GetHeaders())
+	assert.Equal(t, "jane@example.com", upstream.Get("X-Forwarded-Email"))
+	assert.Equal(t, "jane", upstream.Get("X-Forwarded-User"))
+
+	// the proxy's paths may be routed upstream too, so they are not exempt
+	resp = check("GET", "/oauth2/userinfo", nil)
+	assert.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+
+	resp = check("GET", "/private?page=2", nil)
+	assert.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+	denied := resp.GetDeniedResponse()
+	assert.Equal(t, http.StatusFound, int(denied.GetStatus().GetCode()))
+	assert.Equal(t, "https://app.example.com/oauth2/sign_in?rd=%2Fprivate%3Fpage%3D2",
+		envoyHeader(denied.GetHeaders()).Get("Location"))
+
+	// sessions older than the max-auth-age of the path sign in again
+	stale := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane",
+		AuthTime: time.Now().Add(-time.Hour)})
+	assert.Equal(t, int32(codes.OK), check("GET", "/private", stale).GetStatus().GetCode())
+	resp = check("GET", "/reports/q3", stale)
+	assert.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+	assert.Equal(t, "https://app.example.com/oauth2/sign_in?rd=%2Freports%2Fq3",
+		envoyHeader(resp.GetDeniedResponse().GetHeaders()).Get("Location"))
+
+	resp = check("POST", "/private", nil)
+	assert.Equal(t, int32(codes.Unauthenticated), resp.GetStatus().GetCode())
+	assert.Equal(t, http.StatusUnauthorized, int(resp.GetDeniedResponse().GetStatus().GetCode()))
+
+	resp = check("GET", "/admin/users", jane)
+	assert.Equal(t, int32(codes.PermissionDenied), resp.GetStatus().GetCode())
+	assert.Equal(t, http.StatusForbidden, int(resp.GetDeniedResponse().GetStatus().GetCode()))
+
+	janeOps := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane", Groups: []string{"ops"}})
+	resp = check("GET", "/admin/users", janeOps)
+	assert.Equal(t, int32(codes.OK), resp.GetStatus().GetCode())
+}
+
+func TestEnvoySignInURL(t *testing.T) {
+	test := NewMockIdPTest(t, nil)
+	defer test.Close()
+	req, _ := http.NewRequest("GET", "/private?page=2", nil)
+	req.Host = "app.example.com:8443"
+	assert.Equal(t, "https://app.example.com:8443/oauth2/sign_in?rd=%2Fprivate%3Fpage%3D2", test.proxy.envoySignInURL(req, "https"))
+	assert.Equal(t, "http://app.example.com:8443/oauth2/sign_in?rd=%2Fprivate%3Fpage%3D2", test.proxy.envoySignInURL(req, "http"))
+
+	// with a central callback host the sign in page is there
+	test = NewMockIdPTest(t, func(o *Options) {
+		o.RedirectURL = "https://auth.example.com/oauth2/callback"
+	})
+	defer test.Close()
+	assert.Equal(t, "https://auth.example.com/oauth2/sign_in?rd=https%3A%2F%2Fapp.example.com%3A8443%2Fprivate%3Fpage%3D2",
+		test.proxy.envoySignInURL(req, ""))
+}
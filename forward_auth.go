@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/d-cheremnov/oauth2_proxy/cookie"
+)
+
+// forwardedURL rebuilds the URL of the request a forward-auth proxy, such as
+// Traefik or Caddy, asks about from its X-Forwarded-Proto, X-Forwarded-Host
+// and X-Forwarded-Uri headers
+func forwardedURL(req *http.Request) (*url.URL, bool) {
+	host := req.Header.Get("X-Forwarded-Host")
+	uri := req.Header.Get("X-Forwarded-Uri")
+	if host == "" || strings.Contains(host, ",") || !strings.HasPrefix(uri, "/") {
+		return nil, false
+	}
+	proto := strings.ToLower(req.Header.Get("X-Forwarded-Proto"))
+	if proto == "" {
+		proto = "https"
+	}
+	if proto != "http" && proto != "https" {
+		return nil, false
+	}
+	u, err := url.Parse(proto + "://" + host + uri)
+	if err != nil || u.Host != host {
+		return nil, false
+	}
+	return u, true
+}
+
+// forwardAuthStart answers a forward-auth request without a session by
+// redirecting to the provider, returning to the original URL afterwards.
+// Requests it cannot redirect get a 401.
+func (p *OAuthProxy) forwardAuthStart(rw http.ResponseWriter, req *http.Request) {
+	remoteAddr := p.getRemoteAddr(req)
+	u, ok := forwardedURL(req)
+	if !ok {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	// a redirect would turn other requests into a GET of the sign in page
+	if method := req.Header.Get("X-Forwarded-Method"); method != "" && method != "GET" && method != "HEAD" {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	redirect := u.String()
+	if p.redirectURL.Host == "" {
+		// the callback is served on the original host, so its path is enough
+		redirect = u.RequestURI()
+	}
+	if !p.IsValidRedirect(redirect) {
+		log.Printf("%s forward auth: refusing redirect to %q", remoteAddr, u)
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+
+	preventCaching(rw)
+	name, provider, ok := p.selectProvider(req)
+	if !ok {
+		http.Error(rw, fmt.Sprintf("unknown provider %q", name), http.StatusBadRequest)
+		return
+	}
+	nonce, err := cookie.Nonce()
+	if err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+		return
+	}
+	p.redirectToProvider(rw, req, name, provider, nonce, redirect, u.Host)
+}
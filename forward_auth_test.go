@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/d-cheremnov/oauth2_proxy/mockidp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardedURL(t *testing.T) {
+	header := func(proto, host, uri string) *http.Request {
+		req := httptest.NewRequest("GET", "/oauth2/auth", nil)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Host", host)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		return req
+	}
+
+	u, ok := forwardedURL(header("http", "app.example.com:8080", "/private?page=2"))
+	assert.True(t, ok)
+	assert.Equal(t, "http://app.example.com:8080/private?page=2", u.String())
+	u, ok = forwardedURL(header("", "app.example.com", "/"))
+	assert.True(t, ok)
+	assert.Equal(t, "https://app.example.com/", u.String())
+
+	for _, req := range []*http.Request{
+		header("https", "", "/private"),
+		header("https", "app.example.com", ""),
+		header("https", "app.example.com, evil.example.org", "/"),
+		header("https", "evil.example.org/x?", "/"),
+		header("ftp", "app.example.com", "/"),
+	} {
+		_, ok = forwardedURL(req)
+		assert.False(t, ok, req.Header)
+	}
+}
+
+func TestForwardAuthFlow(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.ForwardAuth = true
+	}, mockidp.User{Subject: "jane", Email: "jane@example.com"})
+	defer test.Close()
+
+	serve := func(target string, cookies []*http.Cookie, header http.Header) *http.Response {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Host = "app.example.com"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, req)
+		return rw.Result()
+	}
+	forwarded := http.Header{
+		"X-Forwarded-Method": {"GET"},
+		"X-Forwarded-Proto":  {"http"},
+		"X-Forwarded-Host":   {"app.example.com"},
+		"X-Forwarded-Uri":    {"/private?page=2"},
+	}
+
+	start := serve("/oauth2/auth", nil, forwarded)
+	assert.Equal(t, http.StatusFound, start.StatusCode)
+	login, _ := url.Parse(start.Header.Get("Location"))
+	assert.Equal(t, "http://app.example.com/oauth2/callback", login.Query().Get("redirect_uri"))
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(login.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	signedIn := serve(callback.RequestURI(), start.Cookies(), nil)
+	assert.Equal(t, http.StatusFound, signedIn.StatusCode)
+	assert.Equal(t, "/private?page=2", signedIn.Header.Get("Location"))
+
+	// identity headers are returned without -set-xauthrequest
+	auth := serve("/oauth2/auth", test.SessionCookies(signedIn), forwarded)
+	assert.Equal(t, http.StatusAccepted, auth.StatusCode)
+	assert.Equal(t, "jane@example.com", auth.Header.Get("X-Auth-Request-Email"))
+	assert.Equal(t, "jane", auth.Header.Get("X-Auth-Request-User"))
+
+	// the path alone must be a valid redirect when the callback is on the
+	// original host
+	forwarded.Set("X-Forwarded-Uri", "//evil.example.org/")
+	assert.Equal(t, http.StatusUnauthorized, serve("/oauth2/auth", nil, forwarded).StatusCode)
+}
+
+func TestForwardAuthRefusesRedirect(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.ForwardAuth = true
+		o.RedirectURL = "https://auth.example.com/oauth2/callback"
+		o.WhitelistDomains = []string{".example.com"}
+	})
+	defer test.Close()
+
+	auth := func(method, host, uri string) *http.Response {
+		req := httptest.NewRequest("GET", "/oauth2/auth", nil)
+		req.Header.Set("X-Forwarded-Method", method)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", host)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, req)
+		return rw.Result()
+	}
+
+	// with a central callback the original URL must be a whitelisted domain
+	resp := auth("GET", "app.example.com", "/private")
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	login, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "https://auth.example.com/oauth2/callback", login.Query().Get("redirect_uri"))
+
+	assert.Equal(t, http.StatusUnauthorized, auth("GET", "app.example.org", "/private").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, auth("POST", "app.example.com", "/private").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, auth("GET", "app.example.com", "/oauth2/sign_in").StatusCode)
+
+	// without the forwarded headers the auth endpoint answers as before
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/auth", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
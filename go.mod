@@ -5,22 +5,30 @@ go 1.15
 require (
 	cloud.google.com/go v0.35.1
 	github.com/BurntSushi/toml v0.3.1
+	github.com/beevik/etree v1.1.0
 	github.com/bitly/go-simplejson v0.5.0
 	github.com/coreos/go-oidc v2.0.1-0.20181101194249-66476e026701+incompatible
 	github.com/davecgh/go-spew v1.1.1
+	github.com/envoyproxy/go-control-plane v0.9.9
 	github.com/fsnotify/fsnotify v1.4.7
-	github.com/golang/protobuf v1.2.0
+	github.com/go-asn1-ber/asn1-ber v1.3.1
+	github.com/go-ldap/ldap/v3 v3.1.10
+	github.com/golang/protobuf v1.4.3
+	github.com/google/cel-go v0.7.3
 	github.com/mbland/hmacauth v0.0.0-20170912224942-107c17adcc5e
 	github.com/mreiferson/go-options v0.0.0-20190302064952-20ba7d382d05
 	github.com/pmezard/go-difflib v1.0.0
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35
-	github.com/stretchr/testify v1.2.2
+	github.com/russellhaering/goxmldsig v1.2.0
+	github.com/stretchr/testify v1.6.1
 	github.com/yhat/wsutil v0.0.0-20170731153501-1d66fa95c997
-	golang.org/x/crypto v0.0.0-20190130090550-b01c7a725664
-	golang.org/x/net v0.0.0-20190125091013-d26f9f9a57f3
-	golang.org/x/oauth2 v0.0.0-20181203162652-d668ce993890
-	golang.org/x/sys v0.0.0-20190130150945-aca44879d564
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd
 	google.golang.org/api v0.1.1-0.20190130182524-d236112f5713
 	google.golang.org/appengine v1.4.0
+	google.golang.org/genproto v0.0.0-20201102152239-715cce707fb0
+	google.golang.org/grpc v1.36.0
 	gopkg.in/square/go-jose.v2 v2.2.2
 )
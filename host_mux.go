@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Upstream is a parsed -upstream value. Upstreams with an empty Host serve
+// every host that has no upstreams of its own.
+type Upstream struct {
+	Host string
+	URL  *url.URL
+}
+
+// hostPatternRegexp matches host names, optionally with a leading "*."
+// wildcard label
+var hostPatternRegexp = regexp.MustCompile(`^(\*\.)?[a-z0-9-]+(\.[a-z0-9-]+)*$`)
+
+// splitHostPrefix splits an optional "<host>=" prefix off an option value.
+// Only a host name or "*." wildcard before the first "=" is a prefix, so
+// URLs and regular expressions containing "=" are returned whole.
+func splitHostPrefix(spec string) (host, value string) {
+	i := strings.Index(spec, "=")
+	if i == -1 || !hostPatternRegexp.MatchString(strings.ToLower(spec[:i])) {
+		return "", spec
+	}
+	return strings.ToLower(spec[:i]), spec[i+1:]
+}
+
+// String returns the upstream in the form it is configured in
+func (u *Upstream) String() string {
+	if u.Host == "" {
+		return u.URL.String()
+	}
+	return u.Host + "=" + u.URL.String()
+}
+
+// parseUpstream parses an upstream of the form "[<host>=]<url>"
+func parseUpstream(spec string) (*Upstream, error) {
+	host, rawURL := splitHostPrefix(spec)
+	// a URL has a scheme before any "=", so anything else was meant as a host
+	if i := strings.Index(rawURL, "="); host == "" && i != -1 && !strings.ContainsAny(rawURL[:i], ":/") {
+		return nil, fmt.Errorf("invalid host %q", rawURL[:i])
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return &Upstream{Host: host, URL: u}, nil
+}
+
+// HostMux routes requests by host, then by path. Exact hosts take
+// precedence over wildcards, and the most specific wildcard wins. Requests
+// for hosts without upstreams of their own go to the default upstreams.
+type HostMux struct {
+	hosts      map[string]*http.ServeMux
+	defaultMux *http.ServeMux
+}
+
+func NewHostMux() *HostMux {
+	return &HostMux{
+		hosts:      make(map[string]*http.ServeMux),
+		defaultMux: http.NewServeMux(),
+	}
+}
+
+// Handle registers handler for path on hosts matching host, or on the
+// default upstreams when host is empty
+func (m *HostMux) Handle(host, path string, handler http.Handler) {
+	if host == "" {
+		m.defaultMux.Handle(path, handler)
+		return
+	}
+	mux, ok := m.hosts[host]
+	if !ok {
+		mux = http.NewServeMux()
+		m.hosts[host] = mux
+	}
+	mux.Handle(path, handler)
+}
+
+func (m *HostMux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	m.mux(req.Host).ServeHTTP(rw, req)
+}
+
+// Handler returns the handler that will serve req
+func (m *HostMux) Handler(req *http.Request) (h http.Handler, pattern string) {
+	return m.mux(req.Host).Handler(req)
+}
+
+func (m *HostMux) mux(host string) *http.ServeMux {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if mux, ok := m.hosts[host]; ok {
+		return mux
+	}
+	for labels := strings.Split(host, "."); len(labels) > 1; labels = labels[1:] {
+		if mux, ok := m.hosts["*."+strings.Join(labels[1:], ".")]; ok {
+			return mux
+		}
+	}
+	return m.defaultMux
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func namedHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	})
+}
+
+func TestHostMux(t *testing.T) {
+	mux := NewHostMux()
+	mux.Handle("", "/", namedHandler("default"))
+	mux.Handle("grafana.example.com", "/", namedHandler("grafana"))
+	mux.Handle("*.example.com", "/", namedHandler("wildcard"))
+	mux.Handle("*.kibana.example.com", "/app/", namedHandler("kibana"))
+
+	serve := func(host, path string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, req)
+		return rw.Code, rw.Body.String()
+	}
+	tests := []struct {
+		host, path string
+		code       int
+		body       string
+	}{
+		{"grafana.example.com", "/d/1", 200, "grafana"},
+		{"GRAFANA.example.com:8443", "/", 200, "grafana"},
+		{"prometheus.example.com", "/", 200, "wildcard"},
+		{"a.b.example.com", "/", 200, "wildcard"},
+		{"eu.kibana.example.com", "/app/discover", 200, "kibana"},
+		// a host with upstreams of its own does not fall back to others
+		{"eu.kibana.example.com", "/", 404, "404 page not found\n"},
+		{"example.com", "/", 200, "default"},
+		{"other.org", "/", 200, "default"},
+		{"127.0.0.1:4180", "/", 200, "default"},
+	}
+	for _, tc := range tests {
+		code, body := serve(tc.host, tc.path)
+		assert.Equal(t, tc.code, code, tc.host+tc.path)
+		assert.Equal(t, tc.body, body, tc.host+tc.path)
+	}
+}
+
+func TestHostMuxWithoutDefault(t *testing.T) {
+	mux := NewHostMux()
+	mux.Handle("grafana.example.com", "/", namedHandler("grafana"))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "kibana.example.com"
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestHostUpstreamsProxy(t *testing.T) {
+	grafana := httptest.NewServer(namedHandler("grafana"))
+	defer grafana.Close()
+	kibana := httptest.NewServer(namedHandler("kibana"))
+	defer kibana.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{"grafana.example.com=" + grafana.URL, "*.kibana.example.com=" + kibana.URL}
+	opts.SkipAuthRegex = []string{"grafana.example.com=^/public/"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	serve := func(host, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	rw := serve("grafana.example.com", "/public/dashboard")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "grafana", rw.Body.String())
+	// the skip-auth-regex only applies to its own host
+	assert.Equal(t, http.StatusForbidden, serve("eu.kibana.example.com", "/public/dashboard").Code)
+	assert.Equal(t, http.StatusForbidden, serve("grafana.example.com", "/private/").Code)
+}
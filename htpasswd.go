@@ -1,68 +1,124 @@
 package main
 
 import (
+	"bufio"
 	"crypto/sha1"
+	"crypto/subtle"
 	"encoding/base64"
-	"encoding/csv"
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync/atomic"
+	"unsafe"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Lookup passwords in a htpasswd file
-// Passwords must be generated with -B for bcrypt or -s for SHA1.
+// Passwords may be generated with -B for bcrypt, -s for SHA1, -m for apr1,
+// with mkpasswd for SHA-256/512-crypt or with argon2 for argon2id.
 
 type HtpasswdFile struct {
-	Users map[string]string
+	path  string
+	users unsafe.Pointer
 }
 
 func NewHtpasswdFromFile(path string) (*HtpasswdFile, error) {
-	r, err := os.Open(path)
-	if err != nil {
+	return newHtpasswdFromFileImpl(path, nil, func() {})
+}
+
+// newHtpasswdFromFileImpl loads the file at path and reloads it whenever it
+// changes. A reload that fails keeps the previous users.
+func newHtpasswdFromFileImpl(path string, done <-chan bool, onUpdate func()) (*HtpasswdFile, error) {
+	h := &HtpasswdFile{path: path}
+	if err := h.load(); err != nil {
 		return nil, err
 	}
+	WatchForUpdates(path, done, func() {
+		if err := h.load(); err != nil {
+			log.Printf("error reloading htpasswd-file=%q, %s", path, err)
+		}
+		onUpdate()
+	})
+	return h, nil
+}
+
+func (h *HtpasswdFile) load() error {
+	r, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
 	defer r.Close()
-	return NewHtpasswd(r)
+	users, err := readHtpasswd(r)
+	if err != nil {
+		return err
+	}
+	atomic.StorePointer(&h.users, unsafe.Pointer(&users))
+	return nil
 }
 
 func NewHtpasswd(file io.Reader) (*HtpasswdFile, error) {
-	csv_reader := csv.NewReader(file)
-	csv_reader.Comma = ':'
-	csv_reader.Comment = '#'
-	csv_reader.TrimLeadingSpace = true
-
-	records, err := csv_reader.ReadAll()
+	users, err := readHtpasswd(file)
 	if err != nil {
 		return nil, err
 	}
-	h := &HtpasswdFile{Users: make(map[string]string)}
-	for _, record := range records {
-		h.Users[record[0]] = record[1]
-	}
+	h := &HtpasswdFile{}
+	atomic.StorePointer(&h.users, unsafe.Pointer(&users))
 	return h, nil
 }
 
+// readHtpasswd reads user:hash lines, skipping comments and logging lines
+// that are malformed
+func readHtpasswd(file io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 || pair[0] == "" || strings.TrimSpace(pair[1]) == "" {
+			log.Printf("skipping malformed htpasswd line %d", n)
+			continue
+		}
+		users[pair[0]] = strings.TrimSpace(pair[1])
+	}
+	return users, scanner.Err()
+}
+
 func (h *HtpasswdFile) Validate(user string, password string) bool {
-	realPassword, exists := h.Users[user]
+	users := *(*map[string]string)(atomic.LoadPointer(&h.users))
+	realPassword, exists := users[user]
 	if !exists {
 		return false
 	}
 
-	shaPrefix := realPassword[:5]
-	if shaPrefix == "{SHA}" {
-		shaValue := realPassword[5:]
+	switch {
+	case strings.HasPrefix(realPassword, "{SHA}"):
 		d := sha1.New()
 		d.Write([]byte(password))
-		return shaValue == base64.StdEncoding.EncodeToString(d.Sum(nil))
-	}
-
-	bcryptPrefix := realPassword[:4]
-	if bcryptPrefix == "$2a$" || bcryptPrefix == "$2b$" || bcryptPrefix == "$2x$" || bcryptPrefix == "$2y$" {
+		shaValue := base64.StdEncoding.EncodeToString(d.Sum(nil))
+		return subtle.ConstantTimeCompare([]byte(realPassword[5:]), []byte(shaValue)) == 1
+	case strings.HasPrefix(realPassword, "$2a$"), strings.HasPrefix(realPassword, "$2b$"),
+		strings.HasPrefix(realPassword, "$2x$"), strings.HasPrefix(realPassword, "$2y$"):
 		return bcrypt.CompareHashAndPassword([]byte(realPassword), []byte(password)) == nil
+	case strings.HasPrefix(realPassword, "$argon2id$"):
+		ok, err := compareArgon2id(realPassword, password)
+		if err != nil {
+			log.Printf("Invalid htpasswd entry for %s. %s", user, err)
+		}
+		return ok
+	case strings.HasPrefix(realPassword, "$apr1$"), strings.HasPrefix(realPassword, "$1$"),
+		strings.HasPrefix(realPassword, "$5$"), strings.HasPrefix(realPassword, "$6$"):
+		ok, err := compareCrypt(realPassword, password)
+		if err != nil {
+			log.Printf("Invalid htpasswd entry for %s. %s", user, err)
+		}
+		return ok
 	}
 
-	log.Printf("Invalid htpasswd entry for %s. Must be a SHA or bcrypt entry.", user)
+	log.Printf("Invalid htpasswd entry for %s. Must be a SHA, bcrypt, apr1, SHA-crypt or argon2id entry.", user)
 	return false
 }
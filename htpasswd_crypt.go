@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha256CryptOrder and sha512CryptOrder list the digest bytes encoded by
+// each group of four characters in SHA-crypt hashes
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// compareCrypt checks password against an apr1, MD5-crypt, SHA-256-crypt or
+// SHA-512-crypt hash
+func compareCrypt(hashed, password string) (bool, error) {
+	parts := strings.SplitN(hashed, "$", 4)
+	if len(parts) != 4 {
+		return false, fmt.Errorf("malformed crypt hash")
+	}
+	var computed string
+	switch parts[1] {
+	case "1", "apr1":
+		salt := parts[2]
+		if len(salt) > 8 {
+			salt = salt[:8]
+		}
+		computed = md5Crypt([]byte(password), []byte(salt), []byte("$"+parts[1]+"$"))
+	case "5", "6":
+		salt, rest := parts[2], parts[3]
+		rounds, customRounds := 5000, false
+		if strings.HasPrefix(salt, "rounds=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(salt, "rounds="))
+			if err != nil || n < 1000 || n > 999999999 {
+				return false, fmt.Errorf("invalid crypt rounds %q", salt)
+			}
+			rounds, customRounds = n, true
+			if i := strings.Index(rest, "$"); i != -1 {
+				salt = rest[:i]
+			} else {
+				return false, fmt.Errorf("malformed crypt hash")
+			}
+		}
+		if len(salt) > 16 {
+			salt = salt[:16]
+		}
+		computed = shaCrypt(parts[1], []byte(password), []byte(salt), rounds, customRounds)
+	default:
+		return false, fmt.Errorf("unsupported crypt scheme %q", parts[1])
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1, nil
+}
+
+func cryptEncode(out []byte, b2, b1, b0 byte, n int) []byte {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
+
+// md5Crypt implements the MD5-based crypt of FreeBSD, also used by Apache
+// with the $apr1$ magic
+func md5Crypt(password, salt, magic []byte) string {
+	d := md5.New()
+	d.Write(password)
+	d.Write(salt)
+	d.Write(password)
+	alt := d.Sum(nil)
+
+	d = md5.New()
+	d.Write(password)
+	d.Write(magic)
+	d.Write(salt)
+	for i := len(password); i > 0; i -= 16 {
+		if i > 16 {
+			d.Write(alt)
+		} else {
+			d.Write(alt[:i])
+		}
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write([]byte{0})
+		} else {
+			d.Write(password[:1])
+		}
+	}
+	sum := d.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		d = md5.New()
+		if i&1 != 0 {
+			d.Write(password)
+		} else {
+			d.Write(sum)
+		}
+		if i%3 != 0 {
+			d.Write(salt)
+		}
+		if i%7 != 0 {
+			d.Write(password)
+		}
+		if i&1 != 0 {
+			d.Write(sum)
+		} else {
+			d.Write(password)
+		}
+		sum = d.Sum(nil)
+	}
+
+	out := append(append([]byte{}, magic...), salt...)
+	out = append(out, '$')
+	for i := 0; i < 5; i++ {
+		j := i + 12
+		if j == 16 {
+			j = 5
+		}
+		out = cryptEncode(out, sum[i], sum[i+6], sum[j], 4)
+	}
+	return string(cryptEncode(out, 0, 0, sum[11], 2))
+}
+
+// repeatBytes returns the first n bytes of b repeated
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		m := n - len(out)
+		if m > len(b) {
+			m = len(b)
+		}
+		out = append(out, b[:m]...)
+	}
+	return out
+}
+
+// shaCrypt implements SHA-256-crypt (id 5) and SHA-512-crypt (id 6)
+func shaCrypt(id string, password, salt []byte, rounds int, customRounds bool) string {
+	newHash, order := sha256.New, sha256CryptOrder
+	if id == "6" {
+		newHash, order = sha512.New, sha512CryptOrder
+	}
+	digest := func(chunks ...[]byte) []byte {
+		d := newHash()
+		for _, c := range chunks {
+			d.Write(c)
+		}
+		return d.Sum(nil)
+	}
+
+	b := digest(password, salt, password)
+	d := newHash()
+	d.Write(password)
+	d.Write(salt)
+	i := len(password)
+	for ; i > len(b); i -= len(b) {
+		d.Write(b)
+	}
+	d.Write(b[:i])
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			d.Write(b)
+		} else {
+			d.Write(password)
+		}
+	}
+	a := d.Sum(nil)
+
+	d = newHash()
+	for i := 0; i < len(password); i++ {
+		d.Write(password)
+	}
+	p := repeatBytes(d.Sum(nil), len(password))
+	d = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		d.Write(salt)
+	}
+	s := repeatBytes(d.Sum(nil), len(salt))
+
+	for r := 0; r < rounds; r++ {
+		d = newHash()
+		if r&1 != 0 {
+			d.Write(p)
+		} else {
+			d.Write(a)
+		}
+		if r%3 != 0 {
+			d.Write(s)
+		}
+		if r%7 != 0 {
+			d.Write(p)
+		}
+		if r&1 != 0 {
+			d.Write(a)
+		} else {
+			d.Write(p)
+		}
+		a = d.Sum(nil)
+	}
+
+	out := []byte("$" + id + "$")
+	if customRounds {
+		out = append(out, fmt.Sprintf("rounds=%d$", rounds)...)
+	}
+	out = append(append(out, salt...), '$')
+	for _, o := range order {
+		out = cryptEncode(out, a[o[0]], a[o[1]], a[o[2]], 4)
+	}
+	if id == "6" {
+		out = cryptEncode(out, 0, 0, a[63], 2)
+	} else {
+		out = cryptEncode(out, 0, a[31], a[30], 3)
+	}
+	return string(out)
+}
+
+// compareArgon2id checks password against an argon2id hash in the PHC
+// string format: $argon2id$v=19$m=<KiB>,t=<passes>,p=<lanes>$<salt>$<key>
+func compareArgon2id(hashed, password string) (bool, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return false, fmt.Errorf("malformed argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	var memory, passes uint32
+	var lanes uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &passes, &lanes); err != nil || passes == 0 || lanes == 0 {
+		return false, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, fmt.Errorf("invalid argon2id key")
+	}
+	computed := argon2.IDKey([]byte(password), salt, passes, memory, lanes, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -35,3 +39,91 @@ func TestBcrypt(t *testing.T) {
 	valid = h.Validate("testuser2", "top-secret")
 	assert.Equal(t, valid, true)
 }
+
+func TestCryptHashes(t *testing.T) {
+	contents := `# generated with openssl passwd
+apr1user:$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0
+md5user:$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/
+sha256user:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5
+sha512user:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1
+roundsuser:$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA
+longuser:$6$rounds=1000$short$TEjQCBkLeikN5IfKTeIfgykEjZdK8URJwmlsUvsT5LK.IiU77evU.sqm9rELIsGyw3PSCWqxGsho5zq07Lu/T1
+`
+	h, err := NewHtpasswd(bytes.NewBufferString(contents))
+	assert.Equal(t, nil, err)
+
+	tests := []struct {
+		user, password string
+	}{
+		{"apr1user", "password"},
+		{"md5user", "password"},
+		{"sha256user", "Hello world!"},
+		{"sha512user", "Hello world!"},
+		{"roundsuser", "Hello world!"},
+		{"longuser", "a much longer password than sixty four bytes to exercise the repeated block handling!!"},
+	}
+	for _, tc := range tests {
+		assert.True(t, h.Validate(tc.user, tc.password), tc.user)
+		assert.False(t, h.Validate(tc.user, tc.password+"x"), tc.user)
+	}
+}
+
+func TestArgon2id(t *testing.T) {
+	salt := []byte("somesalt")
+	key := argon2.IDKey([]byte("password"), salt, 2, 1024, 2, 32)
+	contents := fmt.Sprintf("testuser:$argon2id$v=19$m=1024,t=2,p=2$%s$%s\n",
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	h, err := NewHtpasswd(bytes.NewBufferString(contents))
+	assert.Equal(t, nil, err)
+
+	assert.True(t, h.Validate("testuser", "password"))
+	assert.False(t, h.Validate("testuser", "passw0rd"))
+}
+
+func TestMalformedHtpasswd(t *testing.T) {
+	contents := `short:abc
+empty:
+nocolon
+:nouser
+badargon:$argon2id$v=19$m=1024$c29tZXNhbHQ$AAAA
+badcrypt:$5$rounds=abc$salt$hash
+valid:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=
+`
+	h, err := NewHtpasswd(bytes.NewBufferString(contents))
+	assert.Equal(t, nil, err)
+
+	for _, user := range []string{"short", "empty", "nocolon", "", "badargon", "badcrypt"} {
+		assert.False(t, h.Validate(user, "asdf"), user)
+	}
+	assert.True(t, h.Validate("valid", "asdf"))
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	f, _ := ioutil.TempFile("", "test_htpasswd_")
+	defer os.Remove(f.Name())
+	f.WriteString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n")
+	f.Close()
+
+	done := make(chan bool)
+	updated := make(chan bool, 1)
+	h, err := newHtpasswdFromFileImpl(f.Name(), done, func() {
+		select {
+		case updated <- true:
+		default:
+		}
+	})
+	defer func() { done <- true }()
+	assert.Equal(t, nil, err)
+	assert.True(t, h.Validate("testuser", "asdf"))
+	assert.False(t, h.Validate("newuser", "password"))
+
+	f, _ = os.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("newuser:$apr1$r31.....$ARC3pREO82RIm0aQ2zszC0\n")
+	f.Close()
+	<-updated
+	assert.True(t, h.Validate("testuser", "asdf"))
+	assert.True(t, h.Validate("newuser", "password"))
+
+	_, err = NewHtpasswdFromFile(f.Name() + ".missing")
+	assert.NotEqual(t, nil, err)
+}
@@ -10,8 +10,9 @@ import (
 )
 
 type Server struct {
-	Handler http.Handler
-	Opts    *Options
+	Handler     http.Handler
+	Opts        *Options
+	ClientCerts *ClientCertAuthenticator
 }
 
 func (s *Server) ListenAndServe() {
@@ -66,6 +67,9 @@ func (s *Server) ServeHTTPS() {
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"http/1.1"}
 	}
+	if s.ClientCerts != nil {
+		s.ClientCerts.ConfigureTLS(config)
+	}
 
 	var err error
 	config.Certificates = make([]tls.Certificate, 1)
@@ -109,20 +113,6 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 	return tc, nil
 }
 
-// extract client ip address from configured header
-func extractClientIP(req *http.Request, header string) string {
-	if header != "" {
-		val := req.Header.Get(header)
-		if val != "" {
-			if header == "X-Forwarded-For" {
-				val = strings.TrimSpace(strings.SplitN(val, ",", 2)[0])
-			}
-			return val
-		}
-	}
-	return ""
-}
-
 func redirectToHTTPS(h http.Handler, httpsAddr string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto"))
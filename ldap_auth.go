@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrInvalidCredentials is returned for unknown users and wrong passwords
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// LDAPAuthenticator verifies passwords against an LDAP directory. It searches
+// for the user's entry as the bind DN, then binds as the entry with the
+// password. Idle connections are kept for reuse.
+type LDAPAuthenticator struct {
+	URL            string
+	StartTLS       bool
+	TLSConfig      *tls.Config
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string
+	EmailAttribute string
+	GroupAttribute string
+	Timeout        time.Duration
+
+	pool chan *ldap.Conn
+}
+
+// parseLDAP configures the LDAP authenticator from the ldap-* options
+func parseLDAP(o *Options, msgs []string) []string {
+	o.ldap = nil
+	if o.LDAPURL == "" {
+		return msgs
+	}
+	a := &LDAPAuthenticator{
+		URL:            o.LDAPURL,
+		StartTLS:       o.LDAPStartTLS,
+		BindDN:         o.LDAPBindDN,
+		BindPassword:   o.LDAPBindPassword,
+		BaseDN:         o.LDAPBaseDN,
+		UserFilter:     o.LDAPUserFilter,
+		EmailAttribute: o.LDAPEmailAttribute,
+		GroupAttribute: o.LDAPGroupAttribute,
+		Timeout:        o.LDAPTimeout,
+	}
+	u, err := url.Parse(o.LDAPURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("invalid ldap-url=%q expected ldap://<host>[:<port>] or ldaps://<host>[:<port>]", o.LDAPURL))
+	}
+	if err == nil && u.Scheme == "ldaps" && o.LDAPStartTLS {
+		msgs = append(msgs, "ldap-start-tls cannot be combined with an ldaps:// ldap-url")
+	}
+	if o.LDAPBaseDN == "" {
+		msgs = append(msgs, "missing setting: ldap-base-dn")
+	}
+	if strings.Count(o.LDAPUserFilter, "%s") != 1 {
+		msgs = append(msgs, fmt.Sprintf("invalid ldap-user-filter=%q expected a single %%s for the user name", o.LDAPUserFilter))
+	}
+	if o.LDAPPoolSize < 0 {
+		msgs = append(msgs, "ldap-pool-size must not be negative")
+	}
+	if err == nil {
+		a.TLSConfig = &tls.Config{ServerName: u.Hostname(), InsecureSkipVerify: o.SSLInsecureSkipVerify}
+	}
+	if o.LDAPCAFile != "" && a.TLSConfig != nil {
+		pem, err := ioutil.ReadFile(o.LDAPCAFile)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error reading ldap-ca-file=%q %s", o.LDAPCAFile, err))
+		} else {
+			a.TLSConfig.RootCAs = x509.NewCertPool()
+			if !a.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+				msgs = append(msgs, fmt.Sprintf("no certificates found in ldap-ca-file=%q", o.LDAPCAFile))
+			}
+		}
+	}
+	if o.LDAPPoolSize > 0 {
+		a.pool = make(chan *ldap.Conn, o.LDAPPoolSize)
+	}
+	o.ldap = a
+	return msgs
+}
+
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithTLSConfig(a.TLSConfig),
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.Timeout}))
+	if err != nil {
+		return nil, err
+	}
+	if a.Timeout != 0 {
+		conn.SetTimeout(a.Timeout)
+	}
+	if a.StartTLS {
+		if err := conn.StartTLS(a.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// get returns an idle connection from the pool or a new one
+func (a *LDAPAuthenticator) get() (*ldap.Conn, bool, error) {
+	select {
+	case conn := <-a.pool:
+		if !conn.IsClosing() {
+			return conn, true, nil
+		}
+		conn.Close()
+	default:
+	}
+	conn, err := a.dial()
+	return conn, false, err
+}
+
+// put returns conn to the pool, closing it when the pool is full
+func (a *LDAPAuthenticator) put(conn *ldap.Conn) {
+	select {
+	case a.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Authenticate verifies user and password. It returns ErrInvalidCredentials
+// for unknown users and wrong passwords, and other errors when the directory
+// cannot tell.
+func (a *LDAPAuthenticator) Authenticate(user, password string) (*providers.SessionState, error) {
+	// an empty password would be an unauthenticated bind, which succeeds
+	if user == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, pooled, err := a.get()
+	if err != nil {
+		return nil, err
+	}
+	session, err := a.authenticate(conn, user, password)
+	if err != nil && pooled && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		// the server may have closed the idle connection
+		conn.Close()
+		if conn, err = a.dial(); err != nil {
+			return nil, err
+		}
+		session, err = a.authenticate(conn, user, password)
+	}
+	if err != nil && err != ErrInvalidCredentials {
+		conn.Close()
+		return nil, err
+	}
+	a.put(conn)
+	return session, err
+}
+
+func (a *LDAPAuthenticator) authenticate(conn *ldap.Conn, user, password string) (*providers.SessionState, error) {
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return nil, fmt.Errorf("error binding as %s: %v", a.BindDN, err)
+		}
+	} else if err := conn.UnauthenticatedBind(""); err != nil {
+		return nil, err
+	}
+
+	attributes := []string{"dn"}
+	for _, attr := range []string{a.EmailAttribute, a.GroupAttribute} {
+		if attr != "" {
+			attributes = append(attributes, attr)
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(a.UserFilter, ldap.EscapeFilter(user)), attributes, nil))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("error searching for %q: %v", user, err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	session := &providers.SessionState{User: user, Subject: entry.DN, AuthTime: time.Now()}
+	if a.EmailAttribute != "" {
+		session.Email = entry.GetAttributeValue(a.EmailAttribute)
+	}
+	if a.GroupAttribute != "" {
+		for _, g := range entry.GetAttributeValues(a.GroupAttribute) {
+			session.Groups = append(session.Groups, ldapGroupName(g))
+		}
+	}
+	return session, nil
+}
+
+// ldapGroupName returns the value of the first RDN of a group DN, such as
+// "admins" for cn=admins,ou=groups,dc=example,dc=com, or g itself when it is
+// not a DN
+func ldapGroupName(g string) string {
+	dn, err := ldap.ParseDN(g)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 || !strings.Contains(g, "=") {
+		return g
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+type testLDAPEntry struct {
+	Password   string
+	Attributes map[string][]string
+}
+
+// testLDAPServer is a minimal LDAP directory answering simple binds,
+// equality searches and StartTLS
+type testLDAPServer struct {
+	t         *testing.T
+	listener  net.Listener
+	tlsConfig *tls.Config
+	caFile    string
+	entries   map[string]testLDAPEntry
+	conns     int32
+}
+
+const testLDAPServiceDN = "cn=proxy,dc=example,dc=com"
+
+func newTestLDAPServer(t *testing.T, ldaps bool) *testLDAPServer {
+	s := &testLDAPServer{t: t, entries: map[string]testLDAPEntry{
+		testLDAPServiceDN: {Password: "service"},
+		"uid=jane,ou=people,dc=example,dc=com": {Password: "secret", Attributes: map[string][]string{
+			"uid":      {"jane"},
+			"mail":     {"jane@example.com"},
+			"memberOf": {"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+		}},
+		"uid=bob,ou=people,dc=example,dc=com": {Password: "hunter2", Attributes: map[string][]string{
+			"uid": {"bob"},
+		}},
+	}}
+	s.tlsConfig, s.caFile = testLDAPCertificate(t)
+	var err error
+	if ldaps {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testLDAPServer) Close() {
+	s.listener.Close()
+	os.Remove(s.caFile)
+}
+
+func (s *testLDAPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func testLDAPCertificate(t *testing.T) (*tls.Config, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := ioutil.TempFile("", "ldap-ca")
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	f.Close()
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, f.Name()
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if e, ok := s.entries[dn]; (ok && e.Password == password) || (dn == "" && password == "") {
+				code, bound = ldap.LDAPResultSuccess, dn
+			}
+			s.reply(conn, id, ldap.ApplicationBindResponse, code)
+		case ldap.ApplicationSearchRequest:
+			if bound != testLDAPServiceDN {
+				s.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)
+				continue
+			}
+			base := op.Children[0].Value.(string)
+			filter := op.Children[6]
+			if filter.Tag != ldap.FilterEqualityMatch {
+				s.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultUnwillingToPerform)
+				continue
+			}
+			attr, value := filter.Children[0].Value.(string), filter.Children[1].Value.(string)
+			for dn, e := range s.entries {
+				if !strings.HasSuffix(dn, base) || !contains(e.Attributes[attr], value) {
+					continue
+				}
+				s.write(conn, id, s.searchEntry(dn, e))
+			}
+			s.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+		case ldap.ApplicationExtendedRequest:
+			s.reply(conn, id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess)
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *testLDAPServer) searchEntry(dn string, e testLDAPEntry) *ber.Packet {
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+	attributes := ber.NewSequence("Attributes")
+	for name, values := range e.Attributes {
+		attribute := ber.NewSequence("Attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, v := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	entry.AppendChild(attributes)
+	return entry
+}
+
+func (s *testLDAPServer) reply(conn net.Conn, id int64, tag ber.Tag, code int) {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	s.write(conn, id, result)
+}
+
+func (s *testLDAPServer) write(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.NewSequence("LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func testLDAPOptions(s *testLDAPServer, scheme string) *Options {
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.LDAPURL = scheme + "://" + s.Addr()
+	opts.LDAPCAFile = s.caFile
+	opts.LDAPBindDN = testLDAPServiceDN
+	opts.LDAPBindPassword = "service"
+	opts.LDAPBaseDN = "ou=people,dc=example,dc=com"
+	return opts
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ldaps    bool
+		startTLS bool
+	}{
+		{"plain", false, false},
+		{"starttls", false, true},
+		{"ldaps", true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestLDAPServer(t, tc.ldaps)
+			defer s.Close()
+			scheme := "ldap"
+			if tc.ldaps {
+				scheme = "ldaps"
+			}
+			opts := testLDAPOptions(s, scheme)
+			opts.LDAPStartTLS = tc.startTLS
+			assert.Equal(t, nil, opts.Validate())
+
+			session, err := opts.ldap.Authenticate("jane", "secret")
+			assert.Equal(t, nil, err)
+			if assert.NotNil(t, session) {
+				assert.Equal(t, "jane", session.User)
+				assert.Equal(t, "jane@example.com", session.Email)
+				assert.Equal(t, "uid=jane,ou=people,dc=example,dc=com", session.Subject)
+				assert.Equal(t, []string{"admins", "staff"}, session.Groups)
+			}
+
+			for _, creds := range [][2]string{{"jane", "wrong"}, {"jane", ""}, {"nobody", "secret"}, {"*", "secret"}} {
+				session, err = opts.ldap.Authenticate(creds[0], creds[1])
+				assert.Equal(t, ErrInvalidCredentials, err, creds[0])
+				assert.Nil(t, session, creds[0])
+			}
+
+			// connections are reused after failed and successful logins
+			assert.Equal(t, int32(1), atomic.LoadInt32(&s.conns))
+		})
+	}
+}
+
+func TestLDAPAuthenticateServiceBindFails(t *testing.T) {
+	s := newTestLDAPServer(t, false)
+	defer s.Close()
+	opts := testLDAPOptions(s, "ldap")
+	opts.LDAPBindPassword = "wrong"
+	assert.Equal(t, nil, opts.Validate())
+
+	// the directory failing is not a wrong password
+	session, err := opts.ldap.Authenticate("jane", "secret")
+	assert.NotEqual(t, nil, err)
+	assert.NotEqual(t, ErrInvalidCredentials, err)
+	assert.Nil(t, session)
+}
+
+func TestLDAPAuthenticateReconnects(t *testing.T) {
+	s := newTestLDAPServer(t, false)
+	defer s.Close()
+	opts := testLDAPOptions(s, "ldap")
+	assert.Equal(t, nil, opts.Validate())
+
+	session, err := opts.ldap.Authenticate("bob", "hunter2")
+	assert.Equal(t, nil, err)
+	assert.NotNil(t, session)
+
+	// the server closes the pooled connection
+	conn := <-opts.ldap.pool
+	conn.Close()
+	opts.ldap.pool <- conn
+	session, err = opts.ldap.Authenticate("bob", "hunter2")
+	assert.Equal(t, nil, err)
+	assert.NotNil(t, session)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&s.conns))
+}
+
+func TestLDAPOptionsValidation(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.LDAPURL = "ldaps://ldap.example.com"
+	opts.LDAPStartTLS = true
+	opts.LDAPUserFilter = "(uid=*)"
+	err := opts.Validate()
+	if assert.NotEqual(t, nil, err) {
+		assert.Contains(t, err.Error(), "ldap-start-tls cannot be combined with an ldaps:// ldap-url")
+		assert.Contains(t, err.Error(), "missing setting: ldap-base-dn")
+		assert.Contains(t, err.Error(), "invalid ldap-user-filter")
+		// emails read from the directory must be validated
+		assert.Contains(t, err.Error(), "email-domain")
+	}
+
+	// a directory read for passwords and groups alone needs no email-domain
+	opts.LDAPEmailAttribute = ""
+	err = opts.Validate()
+	if assert.NotEqual(t, nil, err) {
+		assert.NotContains(t, err.Error(), "email-domain")
+	}
+}
+
+func TestLDAPGroupName(t *testing.T) {
+	assert.Equal(t, "admins", ldapGroupName("cn=admins,ou=groups,dc=example,dc=com"))
+	assert.Equal(t, "admins", ldapGroupName("admins"))
+}
+
+func TestLDAPSignInAndBasicAuth(t *testing.T) {
+	s := newTestLDAPServer(t, false)
+	defer s.Close()
+	opts := testLDAPOptions(s, "ldap")
+	opts.EmailDomains = []string{"example.com"}
+	opts.LDAPStartTLS = true
+	opts.SetXAuthRequest = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, NewValidator(opts.EmailDomains, ""))
+	proxy.DisplayHtpasswdForm = true
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/sign_in", nil))
+	assert.Contains(t, rw.Body.String(), `name="password"`)
+
+	signIn := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"jane"}, "password": {password}, "rd": {"/"}}
+		req := httptest.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	assert.Equal(t, http.StatusOK, signIn("wrong").Code)
+	rw = signIn("secret")
+	assert.Equal(t, http.StatusFound, rw.Code)
+
+	req := httptest.NewRequest("GET", "/oauth2/auth", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "jane@example.com", rw.Header().Get("X-Auth-Request-Email"))
+	assert.Equal(t, "admins,staff", rw.Header().Get("X-Auth-Request-Groups"))
+
+	auth := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oauth2/auth", nil)
+		req.SetBasicAuth("jane", password)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	rw = auth("secret")
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "jane", rw.Header().Get("X-Auth-Request-User"))
+	assert.Equal(t, "admins,staff", rw.Header().Get("X-Auth-Request-Groups"))
+	assert.Equal(t, http.StatusUnauthorized, auth("wrong").Code)
+
+	denyFile, _ := ioutil.TempFile("", "test_deny_")
+	defer os.Remove(denyFile.Name())
+	denyFile.WriteString("jane@example.com\n")
+	denyFile.Close()
+	var err error
+	proxy.denyList, err = NewDenyList(denyFile.Name(), nil, func() {})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, signIn("secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, auth("secret").Code)
+}
+
+func TestLDAPEmailValidation(t *testing.T) {
+	s := newTestLDAPServer(t, false)
+	defer s.Close()
+	opts := testLDAPOptions(s, "ldap")
+	opts.EmailDomains = []string{"example.org"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, NewValidator(opts.EmailDomains, ""))
+	proxy.DisplayHtpasswdForm = true
+
+	// a directory email outside email-domain cannot sign in, rather than
+	// losing its session on the next request
+	form := url.Values{"username": {"jane"}, "password": {"secret"}, "rd": {"/"}}
+	req := httptest.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	req = httptest.NewRequest("GET", "/oauth2/auth", nil)
+	req.SetBasicAuth("jane", "secret")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
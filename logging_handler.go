@@ -106,15 +106,15 @@ type logMessageData struct {
 type loggingHandler struct {
 	writer      io.Writer
 	handler     http.Handler
-	ipHeader    string
+	ipResolver  *ClientIPResolver
 	logTemplate *template.Template
 }
 
-func LoggingHandler(out io.Writer, h http.Handler, ipHeader, requestLoggingTpl string) http.Handler {
+func LoggingHandler(out io.Writer, h http.Handler, ipResolver *ClientIPResolver, requestLoggingTpl string) http.Handler {
 	return loggingHandler{
 		writer:      out,
 		handler:     h,
-		ipHeader:    ipHeader,
+		ipResolver:  ipResolver,
 		logTemplate: template.Must(template.New("request-log").Parse(requestLoggingTpl + "\n")),
 	}
 }
@@ -143,15 +143,7 @@ func (h loggingHandler) writeLogLine(username, upstream string, req *http.Reques
 		}
 	}
 
-	client := req.RemoteAddr
-	hval := extractClientIP(req, h.ipHeader)
-	if hval != "" {
-		client = hval
-	}
-
-	if c, _, err := net.SplitHostPort(client); err == nil {
-		client = c
-	}
+	client := h.ipResolver.LogClient(req)
 
 	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
 
@@ -34,7 +34,7 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 			w.Write([]byte("test"))
 		}
 
-		h := LoggingHandler(buf, http.HandlerFunc(handler), "", test.Format)
+		h := LoggingHandler(buf, http.HandlerFunc(handler), nil, test.Format)
 		r, _ := http.NewRequest("GET", "/foo/bar", nil)
 		r.RemoteAddr = "127.0.0.1"
 		r.Host = "test-server"
@@ -45,3 +45,55 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		assert.Regexp(t, re, buf.String())
 	}
 }
+
+func TestLoggingHandler_ClientIP(t *testing.T) {
+	resolver := &ClientIPResolver{
+		Header: "X-Forwarded-For",
+	}
+	resolver.TrustedProxies, _ = parseIPSet("trusted-proxy-ip", []string{"127.0.0.1"}, nil)
+	tests := []struct {
+		remoteAddr, forwardedFor, expected string
+	}{
+		{"127.0.0.1:4180", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"192.0.2.1:4180", "203.0.113.9", "192.0.2.1"},
+		{"127.0.0.1:4180", "", "127.0.0.1"},
+	}
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		h := LoggingHandler(buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), resolver, "{{.Client}}")
+
+		r, _ := http.NewRequest("GET", "/foo/bar", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		assert.Equal(t, test.expected+"\n", buf.String())
+	}
+}
+
+func TestLoggingHandler_ClientIPWithoutTrustedProxies(t *testing.T) {
+	// the header is logged as sent, though nothing else believes it
+	resolver := &ClientIPResolver{Header: "X-Forwarded-For"}
+	tests := []struct {
+		remoteAddr, forwardedFor, expected string
+	}{
+		{"192.0.2.1:4180", "203.0.113.9, 198.51.100.7", "203.0.113.9"},
+		{"192.0.2.1:4180", "", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		h := LoggingHandler(buf, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}), resolver, "{{.Client}}")
+
+		r, _ := http.NewRequest("GET", "/foo/bar", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		assert.Equal(t, test.expected+"\n", buf.String())
+		assert.Equal(t, "192.0.2.1", resolver.ClientIP(r).String())
+	}
+}
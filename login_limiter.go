@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LoginLimiter throttles password guessing. Once a key, such as a user name
+// or client IP, has MaxFailures failed logins, each further failure locks it
+// out for Backoff, doubling up to Lockout. A key is forgotten Lockout after
+// its last failure or lockout ends.
+type LoginLimiter struct {
+	MaxFailures int
+	Backoff     time.Duration
+	Lockout     time.Duration
+
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// NewLoginLimiter returns a limiter, or nil when maxFailures is 0 and
+// logins are not throttled
+func NewLoginLimiter(maxFailures int, backoff, lockout time.Duration) *LoginLimiter {
+	if maxFailures <= 0 {
+		return nil
+	}
+	return &LoginLimiter{
+		MaxFailures: maxFailures,
+		Backoff:     backoff,
+		Lockout:     lockout,
+		failures:    make(map[string]*loginFailures),
+		now:         time.Now,
+	}
+}
+
+// RetryAfter returns how long key stays locked out, or 0 when it may log in
+func (l *LoginLimiter) RetryAfter(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.failures[key]; ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// Failure records a failed login for key and returns the lockout it caused
+func (l *LoginLimiter) Failure(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.After(l.nextSweep) {
+		for k, f := range l.failures {
+			if l.forgotten(f, now) {
+				delete(l.failures, k)
+			}
+		}
+		l.nextSweep = now.Add(l.Lockout)
+	}
+
+	f, ok := l.failures[key]
+	if !ok || l.forgotten(f, now) {
+		f = &loginFailures{}
+		l.failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count < l.MaxFailures {
+		return 0
+	}
+	delay := l.Lockout
+	if shift := uint(f.count - l.MaxFailures); shift < 32 && l.Backoff<<shift < l.Lockout {
+		delay = l.Backoff << shift
+	}
+	f.lockedUntil = now.Add(delay)
+	return delay
+}
+
+// Success forgets the failed logins of key
+func (l *LoginLimiter) Success(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+func (l *LoginLimiter) forgotten(f *loginFailures, now time.Time) bool {
+	since := f.last
+	if f.lockedUntil.After(since) {
+		since = f.lockedUntil
+	}
+	return !now.Before(since.Add(l.Lockout))
+}
+
+// loginRetryAfter returns how long the client of req must wait before it
+// may try another password for user
+func (p *OAuthProxy) loginRetryAfter(req *http.Request, user string) time.Duration {
+	wait := p.userLoginLimiter.RetryAfter(user)
+	if w := p.ipLoginLimiter.RetryAfter(p.clientIP(req)); w > wait {
+		wait = w
+	}
+	return wait
+}
+
+// setRetryAfter tells the client how many seconds to wait before retrying
+func setRetryAfter(rw http.ResponseWriter, wait time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginLimiterBackoff(t *testing.T) {
+	l := NewLoginLimiter(3, time.Second, time.Minute)
+	now := time.Unix(1600000000, 0)
+	l.now = func() time.Time { return now }
+
+	assert.Equal(t, time.Duration(0), l.Failure("jane"))
+	assert.Equal(t, time.Duration(0), l.Failure("jane"))
+	assert.Equal(t, time.Duration(0), l.RetryAfter("jane"))
+	assert.Equal(t, time.Second, l.Failure("jane"))
+	assert.Equal(t, time.Second, l.RetryAfter("jane"))
+	assert.Equal(t, time.Duration(0), l.RetryAfter("bob"))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 500*time.Millisecond, l.RetryAfter("jane"))
+
+	// each further failure doubles the lockout, up to the maximum
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for _, d := range expected {
+		now = now.Add(l.RetryAfter("jane"))
+		assert.Equal(t, time.Duration(0), l.RetryAfter("jane"))
+		assert.Equal(t, d, l.Failure("jane"))
+	}
+
+	// failures are forgotten a lockout period after the last lockout ends
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, time.Duration(0), l.RetryAfter("jane"))
+	assert.Equal(t, time.Duration(0), l.Failure("jane"))
+
+	l.Failure("jane")
+	l.Success("jane")
+	assert.Equal(t, time.Duration(0), l.Failure("jane"))
+	assert.Equal(t, time.Duration(0), l.Failure("jane"))
+	assert.Equal(t, time.Second, l.Failure("jane"))
+}
+
+func TestLoginLimiterSweep(t *testing.T) {
+	l := NewLoginLimiter(3, time.Second, time.Minute)
+	now := time.Unix(1600000000, 0)
+	l.now = func() time.Time { return now }
+
+	l.Failure("jane")
+	l.Failure("bob")
+	now = now.Add(2 * time.Minute)
+	l.Failure("alice")
+	assert.Equal(t, 1, len(l.failures))
+}
+
+func TestLoginLimiterDisabled(t *testing.T) {
+	l := NewLoginLimiter(0, time.Second, time.Minute)
+	assert.Nil(t, l)
+	assert.Equal(t, time.Duration(0), l.Failure("jane"))
+	assert.Equal(t, time.Duration(0), l.RetryAfter("jane"))
+	l.Success("jane")
+}
+
+func TestLoginLimiterConcurrent(t *testing.T) {
+	l := NewLoginLimiter(100, time.Second, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				l.Failure("jane")
+				l.RetryAfter("jane")
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 100, l.failures["jane"].count)
+	assert.True(t, l.RetryAfter("jane") > 0)
+}
+
+func NewLoginLimiterTestProxy(t *testing.T) *OAuthProxy {
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.LoginMaxFailures = 2
+	opts.LoginMaxFailuresPerIP = 3
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	var err error
+	proxy.HtpasswdFile, err = NewHtpasswd(bytes.NewBufferString("jane:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\nbob:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"))
+	assert.Equal(t, nil, err)
+	return proxy
+}
+
+func TestSignInFormLockout(t *testing.T) {
+	proxy := NewLoginLimiterTestProxy(t)
+	now := time.Unix(1600000000, 0)
+	proxy.userLoginLimiter.now = func() time.Time { return now }
+	proxy.ipLoginLimiter.now = func() time.Time { return now }
+
+	signIn := func(user, password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {user}, "password": {password}, "rd": {"/"}}
+		req := httptest.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "192.0.2.1:5000"
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusOK, signIn("jane", "wrong").Code)
+	assert.Equal(t, http.StatusOK, signIn("jane", "wrong").Code)
+	// the right password is refused while the user is locked out
+	rw := signIn("jane", "asdf")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusFound, signIn("jane", "asdf").Code)
+
+	// the successful login cleared the client's failures
+	assert.Equal(t, http.StatusOK, signIn("carol", "wrong").Code)
+	assert.Equal(t, http.StatusOK, signIn("dave", "wrong").Code)
+	assert.Equal(t, http.StatusFound, signIn("bob", "asdf").Code)
+
+	// the client is locked out across users
+	assert.Equal(t, http.StatusOK, signIn("carol", "wrong").Code)
+	assert.Equal(t, http.StatusOK, signIn("dave", "wrong").Code)
+	assert.Equal(t, http.StatusOK, signIn("erin", "wrong").Code)
+	rw = signIn("bob", "asdf")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+}
+
+func TestBasicAuthLockout(t *testing.T) {
+	proxy := NewLoginLimiterTestProxy(t)
+	now := time.Unix(1600000000, 0)
+	proxy.userLoginLimiter.now = func() time.Time { return now }
+	proxy.ipLoginLimiter.now = func() time.Time { return now }
+
+	auth := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oauth2/auth", nil)
+		req.SetBasicAuth("jane", password)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusAccepted, auth("asdf").Code)
+	assert.Equal(t, http.StatusUnauthorized, auth("wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, auth("wrong").Code)
+	rw := auth("asdf")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusAccepted, auth("asdf").Code)
+}
+
+func TestPasswordLoginDenyList(t *testing.T) {
+	proxy := NewLoginLimiterTestProxy(t)
+	f, _ := ioutil.TempFile("", "test_deny_")
+	defer os.Remove(f.Name())
+	f.WriteString("sub:jane\n")
+	f.Close()
+	var err error
+	proxy.denyList, err = NewDenyList(f.Name(), nil, func() {})
+	assert.Equal(t, nil, err)
+
+	form := url.Values{"username": {"jane"}, "password": {"asdf"}, "rd": {"/"}}
+	req := httptest.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	auth := func(user string) int {
+		req := httptest.NewRequest("GET", "/oauth2/auth", nil)
+		req.SetBasicAuth(user, "asdf")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, auth("jane"))
+	assert.Equal(t, http.StatusAccepted, auth("bob"))
+}
@@ -21,27 +21,42 @@ func mainFlagSet() *flag.FlagSet {
 	whitelistDomains := StringArray{}
 	upstreams := StringArray{}
 	skipAuthRegex := StringArray{}
+	tokenExchanges := StringArray{}
 	googleGroups := StringArray{}
 	gitlabGroups := StringArray{}
 	githubTeams := StringArray{}
+	oidcRequiredAcr := StringArray{}
+	oidcRequiredAmr := StringArray{}
+	maxAuthAge := StringArray{}
+	trustedIPs := StringArray{}
+	trustedProxyIPs := StringArray{}
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("envoy-authz-address", "", "<addr>:<port> to serve the Envoy ext_authz gRPC API on (disabled when empty)")
 	flagSet.Bool("force-https", false, "redirect http requests to https")
 	flagSet.String("tls-cert-file", "", "path to certificate file")
 	flagSet.String("tls-key-file", "", "path to private key file")
+	flagSet.String("tls-client-ca-file", "", "authenticate users by TLS client certificates signed by these CAs")
+	flagSet.String("tls-client-auth", "optional", "whether HTTPS clients must present a certificate from tls-client-ca-file: optional or require")
+	flagSet.String("tls-client-crl-file", "", "refuse client certificates revoked by the CRLs in this file, reloaded when it changes")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. e.g.: \"https://internalapp.yourcompany.com/oauth2/callback\"")
-	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
-	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
-	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files, optionally prefixed with <host>= to serve only that host. Routing is based on the host and path")
+	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User, X-Auth-Request-Email and X-Auth-Request-Groups response headers (useful in Nginx auth_request mode)")
+	flagSet.Bool("forward-auth", false, "redirect unauthenticated requests to the auth endpoint to the provider, rebuilding the original URL from X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Uri (for Traefik ForwardAuth and Caddy forward_auth); implies set-xauthrequest")
+	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User, X-Forwarded-Email and X-Forwarded-Groups information to upstream")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth header to upstream")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
+	flagSet.Var(&tokenExchanges, "token-exchange", "exchange the access token passed to an upstream for one with its own audience: upstream=[<host>=]<url>,audience=<aud>[,resource=<uri>][,scope=<scopes>] (may be given multiple times)")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
-	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests with paths that match (may be given multiple times)")
+	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests with paths that match, optionally prefixed with <host>= to apply to that host only (may be given multiple times)")
 	flagSet.Bool("skip-auth-strip-headers", true, "strip upstream request http headers that are normally set by this proxy, also for requests allowed by --skip-auth-regex")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
+	flagSet.Bool("device-flow", false, "enable the device authorization endpoints and accept the bearer tokens they issue")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Var(&trustedIPs, "trusted-ip", "skip authentication for clients in this IP address or CIDR (may be given multiple times)")
+	flagSet.Var(&trustedProxyIPs, "trusted-proxy-ip", "trust the real-client-ip-header of requests from proxies in this IP address or CIDR (may be given multiple times)")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
 	flagSet.Duration("flush-interval", 0, "period between response flushing when streaming responses (disabled by default)")
 
@@ -57,9 +72,36 @@ func mainFlagSet() *flag.FlagSet {
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
 	flagSet.String("client-id", "", "the OAuth Client ID: e.g.: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
-	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
-	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
-	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
+	flagSet.String("client-auth-method", "", "token endpoint client authentication: client_secret_post, client_secret_basic or private_key_jwt (default depends on the provider)")
+	flagSet.String("client-assertion-key-file", "", "path to the PEM RSA or EC private key used to sign private_key_jwt client assertions")
+	flagSet.String("client-assertion-key-id", "", "optional key id (kid) for the private_key_jwt client assertion")
+	flagSet.String("provider-ca-file", "", "PEM bundle of additional CAs to trust for calls to the provider")
+	flagSet.String("provider-client-cert-file", "", "path to a client certificate presented to the provider (mTLS)")
+	flagSet.String("provider-client-key-file", "", "path to the private key for provider-client-cert-file")
+	flagSet.Duration("provider-timeout", time.Duration(30)*time.Second, "timeout for requests to the provider; 0 to disable")
+	flagSet.Duration("provider-dial-timeout", time.Duration(30)*time.Second, "timeout for establishing connections to the provider")
+	flagSet.String("provider-proxy", "", "HTTP(S) proxy for calls to the provider (default: HTTP_PROXY/HTTPS_PROXY environment)")
+	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line, optionally followed by groups and an expiry date)")
+	flagSet.String("deny-file", "", "refuse the emails, email patterns and sub:<subject> entries in this file (one per line), overriding every other allow rule")
+	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file, reloaded when it changes. Entries may use bcrypt (\"htpasswd -B\"), SHA (\"htpasswd -s\"), apr1 (\"htpasswd -m\"), SHA-256/512-crypt or argon2id hashes")
+	flagSet.String("api-keys-file", "", "authenticate service accounts with API keys listed by SHA-256 hash in this file, reloaded when it changes")
+	flagSet.String("api-key-header", "X-API-Key", "request header carrying an API key; keys are also accepted as bearer tokens")
+	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file or LDAP directory is provided")
+	flagSet.Int("login-max-failures", 5, "failed password logins for a user before it is locked out (0 to disable)")
+	flagSet.Int("login-max-failures-per-ip", 20, "failed password logins from a client IP before it is locked out (0 to disable)")
+	flagSet.Duration("login-backoff", time.Second, "first lockout after too many failed password logins, doubled on each further failure")
+	flagSet.Duration("login-lockout", 15*time.Minute, "longest lockout after failed password logins; failures are forgotten this long after the last one")
+	flagSet.String("ldap-url", "", "additionally authenticate passwords against this LDAP directory (ldap://host[:port] or ldaps://host[:port])")
+	flagSet.Bool("ldap-start-tls", false, "upgrade ldap:// connections with StartTLS")
+	flagSet.String("ldap-ca-file", "", "CA certificates to verify the LDAP server with (default: system roots)")
+	flagSet.String("ldap-bind-dn", "", "DN to bind as when searching for users (default: anonymous)")
+	flagSet.String("ldap-bind-password", "", "password for ldap-bind-dn")
+	flagSet.String("ldap-base-dn", "", "DN to search for users under")
+	flagSet.String("ldap-user-filter", "(uid=%s)", "LDAP filter finding a user's entry, %s is replaced by the escaped user name")
+	flagSet.String("ldap-email-attribute", "mail", "LDAP attribute holding a user's email")
+	flagSet.String("ldap-group-attribute", "memberOf", "LDAP attribute listing a user's groups; group DNs are reduced to their first value, like cn=<group>")
+	flagSet.Int("ldap-pool-size", 4, "idle LDAP connections kept for reuse")
+	flagSet.Duration("ldap-timeout", 10*time.Second, "timeout for connecting to the LDAP server and for each operation")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("banner", "", "custom sign-in banner text/html. Use \"-\" to disable default banner.")
 	flagSet.String("footer", "", "custom footer text/html. Use \"-\" to disable default footer.")
@@ -78,7 +120,7 @@ func mainFlagSet() *flag.FlagSet {
 
 	flagSet.Bool("request-logging", true, "Log requests to stdout")
 	flagSet.String("request-logging-format", defaultRequestLoggingFormat, "Template for request log lines")
-	flagSet.String("real-client-ip-header", "X-Real-IP", "HTTP header indicating the actual ip address of the client (blank to disable)")
+	flagSet.String("real-client-ip-header", "X-Real-IP", "HTTP header indicating the actual ip address of the client, one of X-Real-IP, X-Forwarded-For, X-ProxyUser-IP or Forwarded (blank to disable)")
 
 	flagSet.String("provider", "google", "OAuth provider")
 	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (e.g. https://accounts.google.com)")
@@ -86,12 +128,23 @@ func mainFlagSet() *flag.FlagSet {
 	flagSet.Bool("skip-oidc-discovery", false, "Skip OIDC discovery (login-url, redeem-url and oidc-jwks-url must be configured)")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
+	flagSet.String("device-auth-url", "", "Device authorization endpoint (RFC 8628)")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
 	flagSet.String("scope", "", "OAuth scope specification")
 	flagSet.String("prompt", "", "OIDC prompt (overrides approval-prompt)")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt (see also: prompt)")
+	flagSet.String("oidc-acr-values", "", "space separated acr_values to request from the OIDC provider")
+	flagSet.Var(&oidcRequiredAcr, "oidc-required-acr", "require the ID token acr claim to be this value (may be given multiple times to allow several)")
+	flagSet.Var(&oidcRequiredAmr, "oidc-required-amr", "require the ID token amr claim to include this value (may be given multiple times)")
+	flagSet.Var(&maxAuthAge, "max-auth-age", "<path regex>=<duration>: re-authenticate users who signed in longer ago than duration when requesting matching paths (may be given multiple times)")
+
+	flagSet.String("saml-idp-cert-file", "", "path to the PEM certificate(s) the SAML IdP signs assertions with")
+	flagSet.String("saml-idp-entity-id", "", "expected Issuer of SAML assertions (optional)")
+	flagSet.String("saml-email-attribute", "email", "SAML attribute holding the user's email (falls back to an email NameID)")
+	flagSet.String("saml-user-attribute", "", "SAML attribute holding the user name (defaults to the NameID)")
+	flagSet.String("saml-groups-attribute", "groups", "SAML attribute holding the user's groups")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
 
@@ -100,6 +153,10 @@ func mainFlagSet() *flag.FlagSet {
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	if len(os.Args) > 1 && os.Args[1] == "mock-idp" {
+		mockIdPMain(os.Args[2:])
+		return
+	}
 	flagSet := mainFlagSet()
 
 	config := flagSet.String("config", "", "path to config file")
@@ -120,6 +177,22 @@ func main() {
 		if err != nil {
 			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
 		}
+		opts.Providers, err = LoadProviderOptions(*config)
+		if err != nil {
+			log.Fatalf("ERROR: failed to load providers from config file %s - %s", *config, err)
+		}
+		opts.AuthorizationRules, err = LoadAuthorizationRules(*config)
+		if err != nil {
+			log.Fatalf("ERROR: failed to load authorization rules from config file %s - %s", *config, err)
+		}
+		opts.AccessPolicies, err = LoadAccessPolicies(*config)
+		if err != nil {
+			log.Fatalf("ERROR: failed to load access policies from config file %s - %s", *config, err)
+		}
+		opts.SkipAuthRules, err = LoadSkipAuthRules(*config)
+		if err != nil {
+			log.Fatalf("ERROR: failed to load skip auth rules from config file %s - %s", *config, err)
+		}
 	}
 	cfg.LoadEnvForStruct(opts)
 	options.Resolve(opts, flagSet, cfg)
@@ -129,8 +202,10 @@ func main() {
 		log.Printf("%s", err)
 		os.Exit(1)
 	}
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	userMap := NewUserMap(opts.AuthenticatedEmailsFile, nil, func() {})
+	validator := NewUserMapValidator(opts.EmailDomains, userMap)
 	oauthproxy := NewOAuthProxy(opts, validator)
+	oauthproxy.UserMap = userMap
 
 	if opts.Banner != "" {
 		if opts.Banner == "-" {
@@ -155,20 +230,46 @@ func main() {
 		}
 	}
 
+	if opts.LDAPURL != "" {
+		log.Printf("using LDAP directory %s", opts.LDAPURL)
+		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
+	}
+
+	if opts.APIKeysFile != "" {
+		log.Printf("using API keys file %s", opts.APIKeysFile)
+		oauthproxy.APIKeys, err = NewAPIKeysFromFile(opts.APIKeysFile)
+		if err != nil {
+			log.Fatalf("FATAL: unable to open %s %s", opts.APIKeysFile, err)
+		}
+	}
+
+	if opts.TLSClientCAFile != "" {
+		log.Printf("using client CA file %s", opts.TLSClientCAFile)
+		oauthproxy.ClientCerts, err = NewClientCertAuthenticator(opts.TLSClientCAFile, opts.TLSClientCRLFile, opts.TLSClientAuth == "require")
+		if err != nil {
+			log.Fatalf("FATAL: unable to load client certificate authorities %s", err)
+		}
+	}
+
+	if opts.EnvoyAuthzAddress != "" {
+		go ServeEnvoyAuthz(opts.EnvoyAuthzAddress, oauthproxy)
+	}
+
 	var handler http.Handler = oauthproxy
 	if opts.ForceHTTPS {
 		handler = redirectToHTTPS(handler, opts.HttpsAddress)
 	}
 	if opts.RequestLogging {
 		handler = LoggingHandler(
-			os.Stdout, handler, opts.RealClientIPHeader, opts.RequestLoggingFormat,
+			os.Stdout, handler, opts.clientIPResolver, opts.RequestLoggingFormat,
 		)
 	} else {
 		handler = NoLoggingHandler(handler)
 	}
 	s := &Server{
-		Handler: handler,
-		Opts:    opts,
+		Handler:     handler,
+		Opts:        opts,
+		ClientCerts: oauthproxy.ClientCerts,
 	}
 	s.ListenAndServe()
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/mockidp"
+)
+
+// mockIdPMain runs a mock OpenID Connect provider for local development.
+// Point the proxy at it with -provider=oidc -oidc-issuer-url=<issuer>.
+func mockIdPMain(args []string) {
+	flagSet := flag.NewFlagSet("oauth2_proxy mock-idp", flag.ExitOnError)
+	httpAddress := flagSet.String("http-address", "127.0.0.1:4181", "<addr>:<port> to listen on")
+	issuer := flagSet.String("issuer", "", "issuer URL (default \"http://<http-address>\")")
+	clientID := flagSet.String("client-id", "oauth2_proxy", "the client id the proxy uses")
+	clientSecret := flagSet.String("client-secret", "secret", "the client secret the proxy uses")
+	usersFile := flagSet.String("users-file", "", "TOML file of [[users]] that can sign in (default a single jane@example.com)")
+	tokenLifetime := flagSet.Duration("token-lifetime", time.Hour, "lifetime of access and ID tokens")
+	flagSet.Parse(args)
+
+	cfg := mockidp.Config{
+		Issuer:        *issuer,
+		ClientID:      *clientID,
+		ClientSecret:  *clientSecret,
+		TokenLifetime: *tokenLifetime,
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = "http://" + *httpAddress
+	}
+	if *usersFile != "" {
+		var err error
+		cfg.Users, err = mockidp.LoadUsers(*usersFile)
+		if err != nil {
+			log.Fatalf("FATAL: unable to load users from %s - %s", *usersFile, err)
+		}
+	}
+	idp, err := mockidp.New(cfg)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
+
+	log.Printf("mock OIDC provider for client %q with %d user(s) at issuer %s", idp.ClientID, len(idp.Users), idp.Issuer)
+	log.Printf("WARNING: the mock provider signs in without a password; use it for development only")
+	log.Printf("HTTP: listening on %s", *httpAddress)
+	log.Fatal(http.ListenAndServe(*httpAddress, idp))
+}
@@ -0,0 +1,453 @@
+// Package mockidp is an in-process OpenID Connect identity provider for local
+// development and tests. It signs in any configured user without a password
+// and must never be exposed to untrusted clients.
+package mockidp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/d-cheremnov/oauth2_proxy/cookie"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Endpoint paths, relative to the issuer
+const (
+	DiscoveryPath = "/.well-known/openid-configuration"
+	AuthorizePath = "/authorize"
+	TokenPath     = "/token"
+	UserInfoPath  = "/userinfo"
+	JWKSPath      = "/jwks"
+
+	codeLifetime = time.Minute
+)
+
+// User is an identity the IdP can sign in. Claims are added to the ID token
+// and userinfo response and override the standard claims.
+type User struct {
+	Subject string                 `toml:"subject"`
+	Email   string                 `toml:"email"`
+	Name    string                 `toml:"name"`
+	Groups  []string               `toml:"groups"`
+	Claims  map[string]interface{} `toml:"claims"`
+}
+
+// DefaultUser is signed in when no users are configured
+var DefaultUser = User{
+	Subject: "jane",
+	Email:   "jane@example.com",
+	Name:    "Jane Doe",
+}
+
+// Config describes the clients and users of an IdP
+type Config struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	Users         []User
+	TokenLifetime time.Duration
+}
+
+// LoadUsers reads [[users]] tables from a TOML file
+func LoadUsers(path string) ([]User, error) {
+	var cfg struct {
+		Users []User `toml:"users"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.Users, err
+}
+
+type grant struct {
+	user        *User
+	redirectURI string
+	nonce       string
+	authTime    time.Time
+	expires     time.Time
+}
+
+// IdP serves the discovery, JWKS, authorize, token and userinfo endpoints
+type IdP struct {
+	Config
+	Now func() time.Time
+
+	key    *rsa.PrivateKey
+	keyID  string
+	signer jose.Signer
+
+	mu            sync.Mutex
+	codes         map[string]*grant
+	accessTokens  map[string]*grant
+	refreshTokens map[string]*grant
+}
+
+// New creates an IdP with a freshly generated signing key
+func New(cfg Config) (*IdP, error) {
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("missing client id")
+	}
+	if len(cfg.Users) == 0 {
+		cfg.Users = []User{DefaultUser}
+	}
+	for i, u := range cfg.Users {
+		if u.Subject == "" {
+			return nil, fmt.Errorf("users[%d]: missing subject", i)
+		}
+	}
+	if cfg.TokenLifetime == 0 {
+		cfg.TokenLifetime = time.Hour
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := cookie.Nonce()
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", keyID))
+	if err != nil {
+		return nil, err
+	}
+	return &IdP{
+		Config:        cfg,
+		Now:           time.Now,
+		key:           key,
+		keyID:         keyID,
+		signer:        signer,
+		codes:         make(map[string]*grant),
+		accessTokens:  make(map[string]*grant),
+		refreshTokens: make(map[string]*grant),
+	}, nil
+}
+
+// Server is an IdP listening on a local test server whose URL is the issuer
+type Server struct {
+	*httptest.Server
+	IdP *IdP
+}
+
+// NewServer starts an IdP on a local test server. Close it when done.
+func NewServer(cfg Config) (*Server, error) {
+	idp, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	server := httptest.NewServer(idp)
+	idp.Issuer = server.URL
+	return &Server{Server: server, IdP: idp}, nil
+}
+
+func (i *IdP) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, i.issuerPath())
+	switch path {
+	case DiscoveryPath:
+		i.discovery(rw)
+	case JWKSPath:
+		writeJSON(rw, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &i.key.PublicKey,
+			KeyID:     i.keyID,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}})
+	case AuthorizePath:
+		i.authorize(rw, req)
+	case TokenPath:
+		i.token(rw, req)
+	case UserInfoPath:
+		i.userInfo(rw, req)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (i *IdP) issuerPath() string {
+	u, err := url.Parse(i.Issuer)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+func (i *IdP) discovery(rw http.ResponseWriter) {
+	issuer := strings.TrimSuffix(i.Issuer, "/")
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                i.Issuer,
+		"authorization_endpoint":                issuer + AuthorizePath,
+		"token_endpoint":                        issuer + TokenPath,
+		"userinfo_endpoint":                     issuer + UserInfoPath,
+		"jwks_uri":                              issuer + JWKSPath,
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{string(jose.RS256)},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups"},
+	})
+}
+
+var chooserTemplate = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Mock IdP Sign In</title></head>
+<body>
+<h1>Sign in as</h1>
+{{range .Users}}<form method="POST">
+{{range $k, $v := $.Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">
+{{end}}<input type="hidden" name="login_hint" value="{{.Subject}}">
+<button type="submit">{{if .Name}}{{.Name}} {{end}}&lt;{{.Email}}&gt;</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// authorize signs in the user named by login_hint, or the only configured
+// user, and otherwise shows a page to choose one
+func (i *IdP) authorize(rw http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	params := req.Form
+	redirectURI := params.Get("redirect_uri")
+	if params.Get("client_id") != i.ClientID {
+		http.Error(rw, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	target, err := url.Parse(redirectURI)
+	if err != nil || !target.IsAbs() {
+		http.Error(rw, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if params.Get("response_type") != "code" {
+		redirectError(rw, req, target, params.Get("state"), "unsupported_response_type")
+		return
+	}
+
+	user := i.findUser(params.Get("login_hint"))
+	if user == nil && len(i.Users) == 1 {
+		user = &i.Users[0]
+	}
+	if user == nil {
+		delete(params, "login_hint")
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		chooserTemplate.Execute(rw, map[string]interface{}{"Users": i.Users, "Params": params})
+		return
+	}
+
+	code, err := i.issue(i.codes, &grant{
+		user:        user,
+		redirectURI: redirectURI,
+		nonce:       params.Get("nonce"),
+		authTime:    i.Now(),
+		expires:     i.Now().Add(codeLifetime),
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := target.Query()
+	q.Set("code", code)
+	if state := params.Get("state"); state != "" {
+		q.Set("state", state)
+	}
+	target.RawQuery = q.Encode()
+	http.Redirect(rw, req, target.String(), http.StatusFound)
+}
+
+func redirectError(rw http.ResponseWriter, req *http.Request, target *url.URL, state, code string) {
+	q := target.Query()
+	q.Set("error", code)
+	if state != "" {
+		q.Set("state", state)
+	}
+	target.RawQuery = q.Encode()
+	http.Redirect(rw, req, target.String(), http.StatusFound)
+}
+
+func (i *IdP) findUser(hint string) *User {
+	if hint == "" {
+		return nil
+	}
+	for n := range i.Users {
+		if u := &i.Users[n]; u.Subject == hint || u.Email == hint {
+			return u
+		}
+	}
+	return nil
+}
+
+// issue stores g under a new random token
+func (i *IdP) issue(tokens map[string]*grant, g *grant) (string, error) {
+	token, err := cookie.Nonce()
+	if err != nil {
+		return "", err
+	}
+	i.mu.Lock()
+	tokens[token] = g
+	i.mu.Unlock()
+	return token, nil
+}
+
+// redeem removes and returns the unexpired grant for token
+func (i *IdP) redeem(tokens map[string]*grant, token string) *grant {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	g, ok := tokens[token]
+	if !ok {
+		return nil
+	}
+	delete(tokens, token)
+	if i.Now().After(g.expires) {
+		return nil
+	}
+	return g
+}
+
+func (i *IdP) authenticateClient(req *http.Request) bool {
+	id, secret, ok := req.BasicAuth()
+	if ok {
+		// RFC 6749 form-encodes the basic credentials
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+	return id == i.ClientID &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(i.ClientSecret)) == 1
+}
+
+func (i *IdP) token(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req.ParseForm()
+	if !i.authenticateClient(req) {
+		tokenError(rw, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	var g *grant
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		g = i.redeem(i.codes, req.PostForm.Get("code"))
+		if g == nil || g.redirectURI != req.PostForm.Get("redirect_uri") {
+			tokenError(rw, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		// refresh tokens are rotated on every use
+		g = i.redeem(i.refreshTokens, req.PostForm.Get("refresh_token"))
+		if g == nil {
+			tokenError(rw, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		tokenError(rw, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	now := i.Now()
+	idToken, err := i.IDToken(g.user, g.nonce, g.authTime, now)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accessToken, err := i.issue(i.accessTokens, &grant{user: g.user, expires: now.Add(i.TokenLifetime)})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// refresh tokens outlive access tokens so that expired sessions can refresh
+	refreshToken, err := i.issue(i.refreshTokens, &grant{
+		user:     g.user,
+		authTime: g.authTime,
+		expires:  now.Add(24 * i.TokenLifetime),
+	})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int64(i.TokenLifetime / time.Second),
+		"refresh_token": refreshToken,
+		"id_token":      idToken,
+	})
+}
+
+func tokenError(rw http.ResponseWriter, status int, code string) {
+	writeJSON(rw, status, map[string]string{"error": code})
+}
+
+// claims are the profile claims for u shared by ID tokens and userinfo
+func (i *IdP) claims(u *User) map[string]interface{} {
+	claims := map[string]interface{}{"sub": u.Subject}
+	if u.Email != "" {
+		claims["email"] = u.Email
+		claims["email_verified"] = true
+	}
+	if u.Name != "" {
+		claims["name"] = u.Name
+	}
+	if len(u.Groups) != 0 {
+		claims["groups"] = u.Groups
+	}
+	for k, v := range u.Claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+// IDToken returns a signed ID token for u issued at now. The user's claims
+// may override auth_time.
+func (i *IdP) IDToken(u *User, nonce string, authTime, now time.Time) (string, error) {
+	std := jwt.Claims{
+		Issuer:   i.Issuer,
+		Subject:  u.Subject,
+		Audience: jwt.Audience{i.ClientID},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(i.TokenLifetime)),
+	}
+	claims := map[string]interface{}{"auth_time": authTime.Unix()}
+	for k, v := range i.claims(u) {
+		claims[k] = v
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	return jwt.Signed(i.signer).Claims(std).Claims(claims).CompactSerialize()
+}
+
+func (i *IdP) userInfo(rw http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	i.mu.Lock()
+	g, ok := i.accessTokens[token]
+	i.mu.Unlock()
+	if !ok || i.Now().After(g.expires) {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(rw, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(rw, http.StatusOK, i.claims(g.user))
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("error writing response: %s", err)
+	}
+}
@@ -0,0 +1,229 @@
+package mockidp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+)
+
+const redirectURI = "http://127.0.0.1:4180/oauth2/callback"
+
+var noRedirect = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}}
+
+func newTestServer(t *testing.T, users ...User) *Server {
+	server, err := NewServer(Config{ClientID: "client", ClientSecret: "secret", Users: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func authorize(t *testing.T, s *Server, params url.Values) *url.URL {
+	q := url.Values{
+		"client_id":     {"client"},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"state":         {"xyz"},
+	}
+	for k, v := range params {
+		q[k] = v
+	}
+	resp, err := noRedirect.Get(s.URL + AuthorizePath + "?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	return location
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+func token(t *testing.T, s *Server, params url.Values) (int, *tokenResponse) {
+	params.Set("client_id", "client")
+	params.Set("client_secret", "secret")
+	resp, err := http.PostForm(s.URL+TokenPath, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var tr tokenResponse
+	json.NewDecoder(resp.Body).Decode(&tr)
+	return resp.StatusCode, &tr
+}
+
+func TestDiscoveryAndIDToken(t *testing.T) {
+	s := newTestServer(t, User{Subject: "jane", Email: "jane@example.com",
+		Groups: []string{"admins"}, Claims: map[string]interface{}{"acr": "mfa"}})
+	defer s.Close()
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, s.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.URL+TokenPath, provider.Endpoint().TokenURL)
+
+	location := authorize(t, s, url.Values{"nonce": {"n-0S6"}})
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	assert.Equal(t, "/oauth2/callback", location.Path)
+
+	status, tr := token(t, s, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {location.Query().Get("code")},
+		"redirect_uri": {redirectURI},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int64(3600), tr.ExpiresIn)
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: "client"}).Verify(ctx, tr.IDToken)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jane", idToken.Subject)
+	assert.Equal(t, "n-0S6", idToken.Nonce)
+	var claims struct {
+		Email    string   `json:"email"`
+		Verified bool     `json:"email_verified"`
+		Groups   []string `json:"groups"`
+		ACR      string   `json:"acr"`
+		AuthTime int64    `json:"auth_time"`
+	}
+	idToken.Claims(&claims)
+	assert.Equal(t, "jane@example.com", claims.Email)
+	assert.True(t, claims.Verified)
+	assert.Equal(t, []string{"admins"}, claims.Groups)
+	assert.Equal(t, "mfa", claims.ACR)
+	assert.InDelta(t, time.Now().Unix(), claims.AuthTime, 5)
+
+	req, _ := http.NewRequest("GET", s.URL+UserInfoPath, nil)
+	req.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), `"email":"jane@example.com"`)
+}
+
+func TestCodeIsSingleUse(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	params := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorize(t, s, nil).Query().Get("code")},
+		"redirect_uri": {redirectURI},
+	}
+	status, _ := token(t, s, params)
+	assert.Equal(t, http.StatusOK, status)
+	status, tr := token(t, s, params)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", tr.Error)
+}
+
+func TestRefreshTokenRotates(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	_, first := token(t, s, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorize(t, s, nil).Query().Get("code")},
+		"redirect_uri": {redirectURI},
+	})
+
+	status, second := token(t, s, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	assert.NotEqual(t, "", second.IDToken)
+
+	status, _ = token(t, s, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestExpiredCode(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	code := authorize(t, s, nil).Query().Get("code")
+	s.IdP.Now = func() time.Time { return time.Now().Add(2 * codeLifetime) }
+	status, _ := token(t, s, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	})
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestInvalidClient(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+	req, _ := http.NewRequest("POST", s.URL+TokenPath, strings.NewReader("grant_type=refresh_token"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("client", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestChooseUser(t *testing.T) {
+	s := newTestServer(t,
+		User{Subject: "jane", Email: "jane@example.com"},
+		User{Subject: "john", Email: "john@example.com"})
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + AuthorizePath + "?" + url.Values{
+		"client_id":     {"client"},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+	}.Encode())
+	assert.Equal(t, nil, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Contains(t, string(body), "&lt;john@example.com&gt;")
+
+	location := authorize(t, s, url.Values{"login_hint": {"john@example.com"}})
+	_, tr := token(t, s, url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {location.Query().Get("code")},
+		"redirect_uri": {redirectURI},
+	})
+	provider, _ := oidc.NewProvider(context.Background(), s.URL)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: "client"}).Verify(context.Background(), tr.IDToken)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "john", idToken.Subject)
+}
+
+func TestLoadUsers(t *testing.T) {
+	f, _ := ioutil.TempFile("", "users.toml")
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[[users]]
+subject = "jane"
+email = "jane@example.com"
+groups = ["admins", "devs"]
+[users.claims]
+acr = "mfa"
+`)
+	f.Close()
+
+	users, err := LoadUsers(f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []User{{
+		Subject: "jane",
+		Email:   "jane@example.com",
+		Groups:  []string{"admins", "devs"},
+		Claims:  map[string]interface{}{"acr": "mfa"},
+	}}, users)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -12,6 +13,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +33,7 @@ var SignatureHeaders []string = []string{
 	"Authorization",
 	"X-Forwarded-User",
 	"X-Forwarded-Email",
+	"X-Forwarded-Groups",
 	"X-Forwarded-Access-Token",
 	"Cookie",
 	"Gap-Auth",
@@ -48,6 +51,7 @@ type OAuthProxy struct {
 	CookieExpire   time.Duration
 	CookieRefresh  time.Duration
 	Validator      func(string) bool
+	UserMap        *UserMap
 
 	RobotsPath        string
 	PingPath          string
@@ -56,36 +60,60 @@ type OAuthProxy struct {
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	SAMLMetadataPath  string
+	SAMLACSPath       string
+	DeviceAuthPath    string
+	DeviceTokenPath   string
 
 	redirectURL         *url.URL // the url to receive requests at
 	whitelistDomains    []string
 	provider            providers.Provider
+	providers           []*NamedProvider
+	providerValidators  map[string]func(string) bool
+	providerUserMaps    map[string]*UserMap
+	denyList            *DenyList
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
+	LDAP                *LDAPAuthenticator
+	APIKeys             *APIKeys
+	ClientCerts         *ClientCertAuthenticator
+	APIKeyHeader        string
+	userLoginLimiter    *LoginLimiter
+	ipLoginLimiter      *LoginLimiter
 	DisplayHtpasswdForm bool
 	serveMux            http.Handler
 	SetXAuthRequest     bool
+	ForwardAuth         bool
 	PassBasicAuth       bool
 	SkipProviderButton  bool
+	DeviceFlow          bool
 	PassUserHeaders     bool
 	BasicAuthPassword   string
 	PassAccessToken     bool
-	ClientIPHeader      string
+	tokenExchangeCache  *TokenExchangeCache
+	bearerSessions      *BearerSessionCache
+	maxAuthAges         []*MaxAuthAge
+	authorizationRules  []*AuthorizationRule
+	accessPolicies      []*AccessPolicy
 	CookieCipher        *cookie.Cipher
 	skipAuthRegex       []string
 	skipAuthStripHdrs   bool
 	skipAuthPreflight   bool
 	compiledRegex       []*regexp.Regexp
+	skipAuthRules       []*SkipAuthRule
+	trustedIPs          IPSet
+	clientIPResolver    *ClientIPResolver
 	templates           *template.Template
 	Footer              string
 }
 
 type UpstreamProxy struct {
-	upstream  string
-	handler   http.Handler
-	wsHandler http.Handler
-	auth      hmacauth.HmacAuth
+	upstream      string
+	handler       http.Handler
+	wsHandler     http.Handler
+	auth          hmacauth.HmacAuth
+	tokenExchange *TokenExchange
 }
 
 func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -128,6 +156,11 @@ func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.HmacAuth) (restProxy http.Handler) {
 	proxy := httputil.NewSingleHostReverseProxy(u)
 	proxy.FlushInterval = opts.FlushInterval
+	if opts.SSLInsecureSkipVerify {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		proxy.Transport = transport
+	}
 
 	u.Path = ""
 	if !opts.PassHostHeader {
@@ -146,7 +179,7 @@ func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.Hma
 			wsProxy.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 		}
 	}
-	return &UpstreamProxy{u.Host, proxy, wsProxy, auth}
+	return &UpstreamProxy{u.Host, proxy, wsProxy, auth, nil}
 }
 
 func preventCaching(rw http.ResponseWriter) {
@@ -154,26 +187,33 @@ func preventCaching(rw http.ResponseWriter) {
 }
 
 func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
-	serveMux := http.NewServeMux()
+	serveMux := NewHostMux()
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
 		auth = hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key),
 			SignatureHeader, SignatureHeaders)
 	}
-	for _, u := range opts.proxyURLs {
+	for _, upstream := range opts.upstreams {
+		u, host := upstream.URL, upstream.Host
 		path := u.Path
 		switch u.Scheme {
 		case "http", "https":
-			log.Printf("mapping path %q => upstream %q", path, u)
+			log.Printf("mapping host %q path %q => upstream %q", host, path, u)
+			tokenExchange := opts.tokenExchanges[upstream.String()]
 			proxy := NewWebSocketOrRestReverseProxy(u, opts, auth)
-			serveMux.Handle(path, proxy)
+			if tokenExchange != nil {
+				log.Printf("exchanging access tokens for upstream %q audience=%q resource=%q scope=%q",
+					upstream, tokenExchange.Audience, tokenExchange.Resource, tokenExchange.Scope)
+				proxy.(*UpstreamProxy).tokenExchange = tokenExchange
+			}
+			serveMux.Handle(host, path, proxy)
 		case "file":
 			if u.Fragment != "" {
 				path = u.Fragment
 			}
-			log.Printf("mapping path %q => file system %q", path, u.Path)
+			log.Printf("mapping host %q path %q => file system %q", host, path, u.Path)
 			proxy := NewFileServer(path, u.Path)
-			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil, nil})
+			serveMux.Handle(host, path, &UpstreamProxy{path, proxy, nil, nil, nil})
 		default:
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
@@ -181,13 +221,28 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	for _, u := range opts.CompiledRegex {
 		log.Printf("compiled skip-auth-regex => %q", u)
 	}
+	for _, r := range opts.skipAuthRules {
+		log.Printf("compiled skip-auth rule => %s", r)
+	}
+	for _, n := range opts.trustedIPs {
+		log.Printf("skipping authentication for trusted network %s", n)
+	}
 
 	redirectURL := opts.redirectURL
 	if redirectURL.Path == "" {
 		redirectURL.Path = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
 	}
 
-	log.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	providerValidators := make(map[string]func(string) bool)
+	providerUserMaps := make(map[string]*UserMap)
+	for _, np := range opts.namedProviders {
+		log.Printf("OAuthProxy configured for %s Client ID: %s", np.Provider.Data().ProviderName, np.Provider.Data().ClientID)
+		if len(np.Options.EmailDomains) != 0 || np.Options.AuthenticatedEmailsFile != "" {
+			um := NewUserMap(np.Options.AuthenticatedEmailsFile, nil, func() {})
+			providerValidators[np.Name] = NewUserMapValidator(np.Options.EmailDomains, um)
+			providerUserMaps[np.Name] = um
+		}
+	}
 	refresh := "disabled"
 	if opts.CookieRefresh != time.Duration(0) {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
@@ -198,6 +253,11 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		opts.CookieHttpOnly, opts.CookieSecure, opts.CookieSameSite,
 		opts.CookieExpire, refresh)
 
+	denyList, err := NewDenyList(opts.DenyFile, nil, func() {})
+	if err != nil {
+		log.Fatalf("failed opening deny-file=%q, %s", opts.DenyFile, err)
+	}
+
 	var cipher *cookie.Cipher
 	if opts.PassAccessToken || (opts.CookieRefresh != time.Duration(0)) {
 		var err error
@@ -227,9 +287,19 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		SAMLMetadataPath:  fmt.Sprintf("%s/saml/metadata", opts.ProxyPrefix),
+		SAMLACSPath:       fmt.Sprintf("%s/saml/acs", opts.ProxyPrefix),
+		DeviceAuthPath:    fmt.Sprintf("%s/device/authorize", opts.ProxyPrefix),
+		DeviceTokenPath:   fmt.Sprintf("%s/device/token", opts.ProxyPrefix),
 
 		ProxyPrefix:        opts.ProxyPrefix,
 		provider:           opts.provider,
+		providers:          opts.namedProviders,
+		providerValidators: providerValidators,
+		providerUserMaps:   providerUserMaps,
+		denyList:           denyList,
+		userLoginLimiter:   NewLoginLimiter(opts.LoginMaxFailures, opts.LoginBackoff, opts.LoginLockout),
+		ipLoginLimiter:     NewLoginLimiter(opts.LoginMaxFailuresPerIP, opts.LoginBackoff, opts.LoginLockout),
 		serveMux:           serveMux,
 		redirectURL:        redirectURL,
 		whitelistDomains:   opts.WhitelistDomains,
@@ -237,13 +307,24 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		skipAuthStripHdrs:  opts.SkipAuthStripHeaders,
 		skipAuthPreflight:  opts.SkipAuthPreflight,
 		compiledRegex:      opts.CompiledRegex,
-		SetXAuthRequest:    opts.SetXAuthRequest,
+		skipAuthRules:      opts.skipAuthRules,
+		trustedIPs:         opts.trustedIPs,
+		clientIPResolver:   opts.clientIPResolver,
+		SetXAuthRequest:    opts.SetXAuthRequest || opts.ForwardAuth,
+		ForwardAuth:        opts.ForwardAuth,
 		PassBasicAuth:      opts.PassBasicAuth,
 		PassUserHeaders:    opts.PassUserHeaders,
 		BasicAuthPassword:  opts.BasicAuthPassword,
 		PassAccessToken:    opts.PassAccessToken,
 		SkipProviderButton: opts.SkipProviderButton,
-		ClientIPHeader:     opts.RealClientIPHeader,
+		APIKeyHeader:       opts.APIKeyHeader,
+		LDAP:               opts.ldap,
+		DeviceFlow:         opts.DeviceFlow,
+		tokenExchangeCache: NewTokenExchangeCache(),
+		bearerSessions:     NewBearerSessionCache(),
+		maxAuthAges:        opts.maxAuthAges,
+		authorizationRules: opts.authorizationRules,
+		accessPolicies:     opts.accessPolicies,
 		CookieCipher:       cipher,
 		templates:          loadTemplates(opts.CustomTemplatesDir),
 		Footer:             opts.Footer,
@@ -268,26 +349,113 @@ func (p *OAuthProxy) GetRedirectURI(host string) string {
 	return u.String()
 }
 
+// GetSAMLACSURL returns the assertion consumer service URL, which shares the
+// scheme and host of the redirect URL
+func (p *OAuthProxy) GetSAMLACSURL(host string) string {
+	u, _ := url.Parse(p.GetRedirectURI(host))
+	u.Path = p.SAMLACSPath
+	u.RawQuery = ""
+	return u.String()
+}
+
 func (p *OAuthProxy) displayCustomLoginForm() bool {
-	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
+	return p.passwordLogin() && p.DisplayHtpasswdForm
+}
+
+// passwordLogin reports whether users may sign in with a password
+func (p *OAuthProxy) passwordLogin() bool {
+	return p.HtpasswdFile != nil || p.LDAP != nil
+}
+
+// getProvider returns the provider registered under name. The empty name
+// selects the default provider.
+func (p *OAuthProxy) getProvider(name string) (providers.Provider, bool) {
+	if name == "" {
+		// without a top level provider every provider is named, so state and
+		// sessions missing the name must not fall back to the first one and
+		// the proxy wide validator
+		if len(p.providers) != 0 && p.providers[0].Name != "" {
+			return nil, false
+		}
+		return p.provider, true
+	}
+	for _, np := range p.providers {
+		if np.Name == name {
+			return np.Provider, true
+		}
+	}
+	return nil, false
+}
+
+// selectProvider returns the provider chosen by the "provider" request
+// parameter, or the first configured provider when none is given
+func (p *OAuthProxy) selectProvider(req *http.Request) (string, providers.Provider, bool) {
+	name := req.FormValue("provider")
+	if name == "" && len(p.providers) != 0 {
+		name = p.providers[0].Name
+	}
+	provider, ok := p.getProvider(name)
+	return name, provider, ok
+}
+
+// validatorFor returns the email validator for sessions issued by the named
+// provider, falling back to the proxy wide validator
+func (p *OAuthProxy) validatorFor(name string) func(string) bool {
+	if v, ok := p.providerValidators[name]; ok {
+		return v
+	}
+	return p.Validator
+}
+
+// addUserGroups adds the groups the authenticated emails file assigns to the
+// session's email to the session
+func (p *OAuthProxy) addUserGroups(name string, session *providers.SessionState) {
+	um, ok := p.providerUserMaps[name]
+	if !ok {
+		um = p.UserMap
+	}
+	if um == nil || session.Email == "" {
+		return
+	}
+	for _, g := range um.Groups(session.Email) {
+		found := false
+		for _, sg := range session.Groups {
+			found = found || sg == g
+		}
+		if !found {
+			session.Groups = append(session.Groups, g)
+		}
+	}
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(provider providers.Provider, host, code, idTokenNonce string) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
 	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
+	if np, ok := provider.(providers.NonceProvider); ok {
+		s, err = np.RedeemWithNonce(redirectURI, code, idTokenNonce)
+	} else {
+		s, err = provider.Redeem(redirectURI, code)
+	}
 	if err != nil {
 		return
 	}
+	return s, p.enrichSession(provider, s)
+}
 
+// enrichSession looks up the email and user name of a freshly redeemed
+// session when the token response did not carry them
+func (p *OAuthProxy) enrichSession(provider providers.Provider, s *providers.SessionState) (err error) {
+	if s.AuthTime.IsZero() {
+		s.AuthTime = time.Now()
+	}
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		s.Email, err = provider.GetEmailAddress(s)
 	}
 
 	if s.User == "" {
-		s.User, err = p.provider.GetUserName(s)
+		s.User, err = provider.GetUserName(s)
 		if err != nil && err.Error() == "not implemented" {
 			err = nil
 		}
@@ -412,6 +580,7 @@ func (p *OAuthProxy) stripAuthHeaders(req *http.Request) {
 	if p.PassUserHeaders {
 		req.Header.Del("X-Forwarded-User")
 		req.Header.Del("X-Forwarded-Email")
+		req.Header.Del("X-Forwarded-Groups")
 	}
 	if p.PassAccessToken {
 		req.Header.Del("X-Forwarded-Access-Token")
@@ -455,8 +624,14 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		return
 	}
 
+	signInProviders := p.providers
+	if len(signInProviders) == 0 {
+		signInProviders = []*NamedProvider{{DisplayName: p.provider.Data().ProviderName}}
+	}
+
 	t := struct {
 		ProviderName  string
+		Providers     []*NamedProvider
 		SignInMessage template.HTML
 		CustomLogin   bool
 		Redirect      string
@@ -465,6 +640,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		Footer        template.HTML
 	}{
 		ProviderName:  p.provider.Data().ProviderName,
+		Providers:     signInProviders,
 		SignInMessage: template.HTML(p.SignInMessage),
 		CustomLogin:   p.displayCustomLoginForm(),
 		Redirect:      redirect_url,
@@ -475,21 +651,26 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
 }
 
-func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (string, bool) {
-	if req.Method != "POST" || p.HtpasswdFile == nil {
-		return "", false
+func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (*providers.SessionState, bool) {
+	if req.Method != "POST" || !p.passwordLogin() {
+		return nil, false
 	}
 	user := req.FormValue("username")
 	passwd := req.FormValue("password")
 	if user == "" {
-		return "", false
+		return nil, false
 	}
 	// check auth
-	if p.HtpasswdFile.Validate(user, passwd) {
-		log.Printf("authenticated %q via HtpasswdFile", user)
-		return user, true
+	session := p.checkPassword(req, user, passwd)
+	if session == nil {
+		return nil, false
 	}
-	return "", false
+	if err := p.refuseSession(session); err != nil {
+		log.Printf("%s %s", p.getRemoteAddr(req), err)
+		return nil, false
+	}
+	log.Printf("authenticated %q via password", user)
+	return session, true
 }
 
 func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error) {
@@ -549,7 +730,17 @@ func (p *OAuthProxy) IsValidRedirect(redirect string) bool {
 
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
-	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
+	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path) || p.matchesSkipAuthRule(req) || p.IsTrustedIPRequest(req)
+}
+
+// matchesSkipAuthRule reports whether a skip-auth rule matches req
+func (p *OAuthProxy) matchesSkipAuthRule(req *http.Request) bool {
+	for _, r := range p.skipAuthRules {
+		if r.Matches(req) {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
@@ -565,13 +756,25 @@ func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
 func (p *OAuthProxy) getRemoteAddr(req *http.Request) (s string) {
 	s = req.RemoteAddr
 
-	hval := extractClientIP(req, p.ClientIPHeader)
-	if hval != "" {
-		s += fmt.Sprintf(" (%q)", hval)
+	peer := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if client := p.clientIPResolver.LogClient(req); client != peer {
+		s += fmt.Sprintf(" (%q)", client)
 	}
 	return
 }
 
+// clientIP returns the IP address of the client, or the peer address of the
+// request when it has none
+func (p *OAuthProxy) clientIP(req *http.Request) string {
+	if ip := p.clientIPResolver.ClientIP(req); ip != nil {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
@@ -591,13 +794,30 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.OAuthCallback(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.SAMLMetadataPath:
+		p.SAMLMetadata(rw, req)
+	case path == p.SAMLACSPath:
+		p.SAMLACS(rw, req)
+	case path == p.DeviceAuthPath:
+		p.DeviceAuthorize(rw, req)
+	case path == p.DeviceTokenPath:
+		p.DeviceToken(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
 }
 
 func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
-	user, ok := p.ManualSignIn(rw, req)
+	if req.Method == "POST" && p.passwordLogin() {
+		user := req.FormValue("username")
+		if wait := p.loginRetryAfter(req, user); wait > 0 {
+			log.Printf("%s security: refusing sign in for %q, locked out for %s", p.getRemoteAddr(req), user, wait)
+			setRetryAfter(rw, wait)
+			p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "Too many failed sign in attempts, try again later")
+			return
+		}
+	}
+	session, ok := p.ManualSignIn(rw, req)
 	if ok {
 		redirect, err := p.GetRedirect(req)
 		if err != nil {
@@ -605,7 +825,6 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 		preventCaching(rw)
-		session := &providers.SessionState{User: user}
 		p.SaveSession(rw, req, session)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
@@ -625,20 +844,124 @@ func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
 
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 	preventCaching(rw)
+	name, provider, ok := p.selectProvider(req)
+	if !ok {
+		p.ErrorPage(rw, 400, "Bad Request", fmt.Sprintf("unknown provider %q", name))
+		return
+	}
 	nonce, err := cookie.Nonce()
 	if err != nil {
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	p.SetCSRFCookie(rw, req, nonce)
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
 		p.ErrorPage(rw, 400, "Bad Request", err.Error())
 		return
 	}
-	redirectURI := p.GetRedirectURI(req.Host)
-	state := fmt.Sprintf("%v:%v", nonce, redirect)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, state), 302)
+	p.redirectToProvider(rw, req, name, provider, nonce, redirect, req.Host)
+}
+
+// redirectToProvider sends the user to sign in with provider, returning to
+// redirect afterwards. host is the host the callback is served on unless the
+// redirect URL names one.
+func (p *OAuthProxy) redirectToProvider(rw http.ResponseWriter, req *http.Request, name string, provider providers.Provider, nonce, redirect, host string) {
+	redirectURI := p.GetRedirectURI(host)
+	if _, ok := provider.(*providers.SAMLProvider); ok {
+		redirectURI = p.GetSAMLACSURL(host)
+	}
+	csrfToken, state := encodeState(nonce, name, redirect)
+	loginURL := provider.GetLoginURL(redirectURI, state)
+	if np, ok := provider.(providers.NonceProvider); ok {
+		// a separate nonce, so the ID token cannot be tied to the public state
+		idTokenNonce, err := cookie.Nonce()
+		if err != nil {
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		loginURL = np.GetLoginURLWithNonce(redirectURI, state, idTokenNonce)
+		csrfToken = encodeCSRFCookie(csrfToken, idTokenNonce)
+	}
+	if maxAge, ok := p.loginMaxAge(req, redirect); ok {
+		loginURL = reauthLoginURL(provider, loginURL, maxAge)
+	}
+	p.SetCSRFCookie(rw, req, csrfToken)
+	http.Redirect(rw, req, loginURL, 302)
+}
+
+// loginMaxAge returns the max_age in seconds to sign in with: the max_age
+// parameter of req, else the max-auth-age of the page the user returns to,
+// so a first visit is not refused for an old single sign-on
+func (p *OAuthProxy) loginMaxAge(req *http.Request, redirect string) (int, bool) {
+	if maxAge, err := strconv.Atoi(req.FormValue("max_age")); err == nil && maxAge >= 0 {
+		return maxAge, true
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return 0, false
+	}
+	maxAge, ok := p.maxAuthAge(u.Path)
+	return int(maxAge / time.Second), ok
+}
+
+// reauthLoginURL asks the provider to authenticate the user again. OIDC
+// providers get max_age, others the widely supported prompt=login.
+func reauthLoginURL(provider providers.Provider, loginURL string, maxAge int) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	if _, ok := provider.(*providers.OIDCProvider); ok {
+		params.Set("max_age", strconv.Itoa(maxAge))
+	} else {
+		params.Del("approval_prompt")
+		params.Set("prompt", "login")
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// encodeCSRFCookie appends the OIDC nonce expected in the ID token to the
+// CSRF token
+func encodeCSRFCookie(csrfToken, idTokenNonce string) string {
+	return fmt.Sprintf("%s|%s", csrfToken, idTokenNonce)
+}
+
+// decodeCSRFCookie splits a CSRF cookie value built by encodeCSRFCookie.
+// Cookies without an ID token nonce decode with an empty nonce.
+func decodeCSRFCookie(value string) (csrfToken, idTokenNonce string) {
+	s := strings.SplitN(value, "|", 2)
+	if len(s) == 2 {
+		return s[0], s[1]
+	}
+	return value, ""
+}
+
+// encodeState builds the OAuth state parameter "nonce[.provider]:redirect".
+// The provider is left out for the default provider so single provider
+// deployments keep the original format. The part before the first colon is
+// also stored in the CSRF cookie, binding the provider to the browser that
+// started the flow.
+func encodeState(nonce, provider, redirect string) (csrfToken, state string) {
+	csrfToken = nonce
+	if provider != "" {
+		csrfToken = fmt.Sprintf("%s.%s", nonce, provider)
+	}
+	return csrfToken, fmt.Sprintf("%s:%s", csrfToken, redirect)
+}
+
+// decodeState splits an OAuth state parameter built by encodeState
+func decodeState(state string) (csrfToken, provider, redirect string, err error) {
+	s := strings.SplitN(state, ":", 2)
+	if len(s) != 2 {
+		return "", "", "", errors.New("Invalid State")
+	}
+	csrfToken = s[0]
+	if i := strings.Index(csrfToken, "."); i != -1 {
+		provider = csrfToken[i+1:]
+	}
+	return csrfToken, provider, s[1], nil
 }
 
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
@@ -657,38 +980,162 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	csrfToken, name, redirect, err := decodeState(req.Form.Get("state"))
+	if err != nil {
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+	provider, ok := p.getProvider(name)
+	if !ok {
+		log.Printf("%s unknown provider %q in state", remoteAddr, name)
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid State")
+		return
+	}
+
+	c, err := req.Cookie(p.CSRFCookieName)
+	if err != nil {
+		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
+		return
+	}
+	p.ClearCSRFCookie(rw, req)
+	cookieToken, idTokenNonce := decodeCSRFCookie(c.Value)
+	if cookieToken != csrfToken {
+		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
+		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		return
+	}
+	if _, ok := provider.(providers.NonceProvider); ok && idTokenNonce == "" {
+		log.Printf("%s missing id_token nonce in csrf cookie", remoteAddr)
+		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		return
+	}
+
+	session, err := p.redeemCode(provider, req.Host, req.Form.Get("code"), idTokenNonce)
+	if err == providers.ErrInvalidNonce {
+		log.Printf("%s id_token nonce mismatch, potential replay", remoteAddr)
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid ID Token")
+		return
+	}
+	if _, ok := err.(*providers.AuthContextError); ok {
+		log.Printf("%s %s", remoteAddr, err)
+		p.ErrorPage(rw, 403, "Permission Denied", "Insufficient Authentication")
+		return
+	}
 	if err != nil {
 		log.Printf("%s error redeeming code %s", remoteAddr, err)
 		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 		return
 	}
+	session.Provider = name
 
-	s := strings.SplitN(req.Form.Get("state"), ":", 2)
-	if len(s) != 2 {
-		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
+	if !p.IsValidRedirect(redirect) {
+		redirect = "/"
+	}
+	// the provider may not have honoured max_age; refuse rather than loop
+	if u, err := url.Parse(redirect); err == nil && p.authTooOld(u.Path, session) {
+		log.Printf("%s authentication at %s is too old for %s", remoteAddr, session.AuthTime, u.Path)
+		p.ErrorPage(rw, 403, "Permission Denied", "Re-authentication Required")
+		return
+	}
+
+	if p.denyList.Denies(session) {
+		log.Printf("%s Permission Denied: %s is on the deny list", remoteAddr, session)
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+		return
+	}
+
+	// set cookie, or deny
+	if p.validatorFor(name)(session.Email) && provider.ValidateGroup(session.Email) {
+		p.addUserGroups(name, session)
+		log.Printf("%s authentication complete %s", remoteAddr, session)
+		err := p.SaveSession(rw, req, session)
+		if err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+			return
+		}
+		http.Redirect(rw, req, redirect, 302)
+	} else {
+		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+	}
+}
+
+func (p *OAuthProxy) SAMLMetadata(rw http.ResponseWriter, req *http.Request) {
+	sp, ok := p.provider.(*providers.SAMLProvider)
+	if !ok {
+		p.ErrorPage(rw, 404, "Not Found", "SAML is not configured")
+		return
+	}
+	metadata, err := sp.Metadata(p.GetSAMLACSURL(req.Host))
+	if err != nil {
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+	rw.Header().Set("Content-Type", "application/samlmetadata+xml")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(metadata)
+}
+
+func (p *OAuthProxy) SAMLACS(rw http.ResponseWriter, req *http.Request) {
+	preventCaching(rw)
+	remoteAddr := p.getRemoteAddr(req)
+
+	sp, ok := p.provider.(*providers.SAMLProvider)
+	if !ok {
+		p.ErrorPage(rw, 404, "Not Found", "SAML is not configured")
+		return
+	}
+	if req.Method != "POST" {
+		p.ErrorPage(rw, 405, "Method Not Allowed", "SAML responses must be posted")
+		return
+	}
+	err := req.ParseForm()
+	if err != nil {
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		return
+	}
+
+	relayState := req.PostForm.Get("RelayState")
+	csrfToken, _, redirect, err := decodeState(relayState)
+	if err != nil {
+		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	nonce := s[0]
-	redirect := s[1]
 	c, err := req.Cookie(p.CSRFCookieName)
 	if err != nil {
 		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
 		return
 	}
 	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
+	if c.Value != csrfToken {
 		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
 		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
 		return
 	}
 
+	session, err := sp.ConsumeResponse(p.GetSAMLACSURL(req.Host), req.PostForm.Get("SAMLResponse"), relayState)
+	if err != nil {
+		log.Printf("%s error consuming SAML response %s", remoteAddr, err)
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid SAML Response")
+		return
+	}
+	if session.AuthTime.IsZero() {
+		session.AuthTime = time.Now()
+	}
+
 	if !p.IsValidRedirect(redirect) {
 		redirect = "/"
 	}
 
-	// set cookie, or deny
+	if p.denyList.Denies(session) {
+		log.Printf("%s Permission Denied: %s is on the deny list", remoteAddr, session)
+		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+		return
+	}
+
 	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
+		p.addUserGroups("", session)
 		log.Printf("%s authentication complete %s", remoteAddr, session)
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
@@ -703,35 +1150,302 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// deviceTokenName is the HMAC key name for device flow bearer tokens, so
+// they cannot be swapped with session cookies
+func (p *OAuthProxy) deviceTokenName() string {
+	return fmt.Sprintf("%s_device", p.CookieName)
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeDeviceError(rw http.ResponseWriter, code int, errorCode, description string) {
+	writeJSON(rw, code, map[string]string{
+		"error":             errorCode,
+		"error_description": description,
+	})
+}
+
+// DeviceAuthorize starts a device authorization against the selected
+// provider and returns the user code for the CLI to display
+func (p *OAuthProxy) DeviceAuthorize(rw http.ResponseWriter, req *http.Request) {
+	preventCaching(rw)
+	remoteAddr := p.getRemoteAddr(req)
+	if !p.DeviceFlow {
+		p.ErrorPage(rw, 404, "Not Found", "device flow is not enabled")
+		return
+	}
+	if req.Method != "POST" {
+		writeDeviceError(rw, 405, "invalid_request", "device authorization must be posted")
+		return
+	}
+	name, provider, ok := p.selectProvider(req)
+	if !ok {
+		writeDeviceError(rw, 400, "invalid_request", fmt.Sprintf("unknown provider %q", name))
+		return
+	}
+	auth, err := provider.Data().StartDeviceAuthorization()
+	if err != nil {
+		log.Printf("%s error starting device authorization %s", remoteAddr, err)
+		writeDeviceError(rw, 502, "server_error", "could not start device authorization")
+		return
+	}
+	log.Printf("%s started device authorization with %s", remoteAddr, provider.Data().ProviderName)
+	writeJSON(rw, 200, struct {
+		*providers.DeviceAuthorization
+		Provider string `json:"provider,omitempty"`
+	}{auth, name})
+}
+
+// DeviceToken polls the provider with a device code. Once the user approved
+// the device it returns a proxy issued bearer token for the session.
+func (p *OAuthProxy) DeviceToken(rw http.ResponseWriter, req *http.Request) {
+	preventCaching(rw)
+	remoteAddr := p.getRemoteAddr(req)
+	if !p.DeviceFlow {
+		p.ErrorPage(rw, 404, "Not Found", "device flow is not enabled")
+		return
+	}
+	if req.Method != "POST" {
+		writeDeviceError(rw, 405, "invalid_request", "device token requests must be posted")
+		return
+	}
+	name, provider, ok := p.selectProvider(req)
+	if !ok {
+		writeDeviceError(rw, 400, "invalid_request", fmt.Sprintf("unknown provider %q", name))
+		return
+	}
+
+	session, err := provider.RedeemDeviceCode(req.FormValue("device_code"))
+	if deviceErr, ok := err.(*providers.DeviceError); ok {
+		writeDeviceError(rw, 400, deviceErr.Code, deviceErr.Description)
+		return
+	}
+	if err == nil {
+		err = p.enrichSession(provider, session)
+	}
+	if err != nil {
+		log.Printf("%s error redeeming device code %s", remoteAddr, err)
+		writeDeviceError(rw, 502, "server_error", "could not redeem device code")
+		return
+	}
+	session.Provider = name
+
+	if p.denyList.Denies(session) || !p.validatorFor(name)(session.Email) || !provider.ValidateGroup(session.Email) {
+		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
+		writeDeviceError(rw, 403, "access_denied", "Invalid Account")
+		return
+	}
+	p.addUserGroups(name, session)
+
+	value, err := provider.CookieForSession(session, p.CookieCipher)
+	if err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		writeDeviceError(rw, 500, "server_error", "Internal Error")
+		return
+	}
+	log.Printf("%s device authentication complete %s", remoteAddr, session)
+	writeJSON(rw, 200, map[string]interface{}{
+		"access_token": cookie.SignedValue(p.CookieSeed, p.deviceTokenName(), value, time.Now()),
+		"token_type":   "Bearer",
+		"expires_in":   int64(p.CookieExpire.Seconds()),
+	})
+}
+
+// bearerToken returns the device flow token of req, the key its session is
+// cached under and when it was issued. It returns an empty token when the
+// request carries no bearer token.
+func (p *OAuthProxy) bearerToken(req *http.Request) (value, key string, issued time.Time, err error) {
+	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || !strings.EqualFold(auth[0], "Bearer") {
+		return
+	}
+	c := &http.Cookie{Name: p.deviceTokenName(), Value: auth[1]}
+	val, timestamp, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
+	if !ok {
+		return "", "", issued, errors.New("Bearer token not valid")
+	}
+	// the token's signature is an HMAC only the proxy can compute
+	return val, auth[1][strings.LastIndex(auth[1], "|")+1:], timestamp, nil
+}
+
+// LoadBearerSession loads the session from a device flow token sent as
+// "Authorization: Bearer <token>", or the session it was refreshed to. It
+// returns no session and no error when the request carries no bearer token.
+func (p *OAuthProxy) LoadBearerSession(req *http.Request) (*providers.SessionState, time.Duration, error) {
+	var age time.Duration
+	val, key, timestamp, err := p.bearerToken(req)
+	if val == "" {
+		return nil, age, err
+	}
+	if session, saved, ok := p.bearerSessions.Load(key); ok {
+		return session, time.Now().Truncate(time.Second).Sub(saved), nil
+	}
+
+	session, err := p.provider.SessionFromCookie(val, p.CookieCipher)
+	if err != nil {
+		return nil, age, err
+	}
+
+	age = time.Now().Truncate(time.Second).Sub(timestamp)
+	return session, age, nil
+}
+
+// saveBearerSession caches the refreshed session of the device flow token of
+// req until the token expires
+func (p *OAuthProxy) saveBearerSession(req *http.Request, session *providers.SessionState) {
+	if _, key, issued, err := p.bearerToken(req); key != "" && err == nil {
+		p.bearerSessions.Save(key, session, issued.Add(p.CookieExpire))
+	}
+}
+
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
 	// allow caching, do not send no-cache header
 	// typically not accessed directly by browsers
 	// short caching sometimes useful to prevent multiple simultaneous refreshes
-	status := p.Authenticate(rw, req)
+	status, session := p.authenticate(rw, req)
 	if status == http.StatusAccepted {
 		rw.WriteHeader(http.StatusAccepted)
+	} else if (status == http.StatusUnauthorized || status == http.StatusForbidden && session == nil) && p.ForwardAuth {
+		p.forwardAuthStart(rw, req)
+	} else if status == http.StatusForbidden && session != nil {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+	} else if status == http.StatusTooManyRequests {
+		http.Error(rw, "too many requests", http.StatusTooManyRequests)
 	} else {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
 	}
 }
 
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
+	status, session := p.authenticate(rw, req)
 	if status == http.StatusInternalServerError {
 		p.ErrorPage(rw, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
+	} else if status == http.StatusTooManyRequests {
+		p.ErrorPage(rw, http.StatusTooManyRequests, "Too Many Requests", "Too many failed sign in attempts, try again later")
+	} else if status == http.StatusForbidden && session != nil {
+		// signed in, but an authorization rule refuses this request
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied",
+			fmt.Sprintf("%s is not authorized to access %s", rw.Header().Get("GAP-Auth"), req.URL.Path))
 	} else if status == http.StatusForbidden {
 		if p.SkipProviderButton {
 			p.OAuthStart(rw, req)
 		} else {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
+	} else if status == http.StatusUnauthorized {
+		maxAge, _ := p.maxAuthAge(req.URL.Path)
+		log.Printf("%s re-authenticating %s for %s (max age %s)", p.getRemoteAddr(req), session, req.URL.Path, maxAge)
+		params := url.Values{
+			"rd":      {req.URL.RequestURI()},
+			"max_age": {strconv.Itoa(int(maxAge / time.Second))},
+		}
+		if session.Provider != "" {
+			params.Set("provider", session.Provider)
+		}
+		http.Redirect(rw, req, fmt.Sprintf("%s?%s", p.OAuthStartPath, params.Encode()), 302)
+	} else if err := p.exchangeAccessToken(req, session); err != nil {
+		log.Printf("%s error exchanging access token for %s %s", p.getRemoteAddr(req), session, err)
+		p.ErrorPage(rw, http.StatusInternalServerError,
+			"Internal Error", "Internal Error")
 	} else {
 		p.serveMux.ServeHTTP(rw, req)
 	}
 }
 
+// maxAuthAge returns the age limit of the first max-auth-age rule matching
+// path
+func (p *OAuthProxy) maxAuthAge(path string) (time.Duration, bool) {
+	for _, m := range p.maxAuthAges {
+		if m.Path.MatchString(path) {
+			return m.Age, true
+		}
+	}
+	return 0, false
+}
+
+// originalPath returns the path of the request being authenticated. Requests
+// to the auth endpoint are about the URI their reverse proxy puts in the
+// X-Forwarded-Uri or X-Original-URI header; without one it is unknown.
+func (p *OAuthProxy) originalPath(req *http.Request) (string, bool) {
+	if req.URL.Path != p.AuthOnlyPath {
+		return req.URL.Path, true
+	}
+	for _, h := range []string{"X-Forwarded-Uri", "X-Original-URI"} {
+		uri := req.Header.Get(h)
+		if !strings.HasPrefix(uri, "/") {
+			continue
+		}
+		if u, err := url.ParseRequestURI(uri); err == nil {
+			return u.Path, true
+		}
+	}
+	return "", false
+}
+
+// authTooOld reports whether the user behind session authenticated longer
+// ago than path allows. Sessions without an authentication time are too old.
+func (p *OAuthProxy) authTooOld(path string, session *providers.SessionState) bool {
+	maxAge, ok := p.maxAuthAge(path)
+	if !ok {
+		return false
+	}
+	return session.AuthTime.IsZero() || time.Since(session.AuthTime) > maxAge
+}
+
+// authorizationRule returns the first authorization rule matching req
+func (p *OAuthProxy) authorizationRule(req *http.Request) *AuthorizationRule {
+	for _, r := range p.authorizationRules {
+		if r.Matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// exchangeAccessToken replaces X-Forwarded-Access-Token with a token minted
+// for the upstream serving req when it has a token exchange configured
+func (p *OAuthProxy) exchangeAccessToken(req *http.Request, session *providers.SessionState) error {
+	if !p.PassAccessToken || session.AccessToken == "" {
+		return nil
+	}
+	mux, ok := p.serveMux.(*HostMux)
+	if !ok {
+		return nil
+	}
+	handler, _ := mux.Handler(req)
+	upstream, ok := handler.(*UpstreamProxy)
+	if !ok || upstream.tokenExchange == nil {
+		return nil
+	}
+	provider, ok := p.getProvider(session.Provider)
+	if !ok {
+		return fmt.Errorf("unknown provider %q", session.Provider)
+	}
+	token, err := p.tokenExchangeCache.Exchange(provider, session, upstream.tokenExchange)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Forwarded-Access-Token", token)
+	return nil
+}
+
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	status, _ := p.authenticate(rw, req)
+	return status
+}
+
+// authenticate checks the request for a session and returns the resulting
+// status along with the session when the request is authenticated. Requests
+// from an authenticated session that an authorization rule or access policy
+// refuses return http.StatusForbidden together with the session, and those
+// from a session older than the max-auth-age of the original path
+// http.StatusUnauthorized together with the session.
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req *http.Request) (int, *providers.SessionState) {
 	var saveSession, clearSession, revalidated bool
 	remoteAddr := p.getRemoteAddr(req)
 
@@ -739,12 +1453,30 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	if err != nil {
 		log.Printf("%s %s", remoteAddr, err)
 	}
+	var bearer bool
+	if session == nil && p.DeviceFlow {
+		if session, sessionAge, err = p.LoadBearerSession(req); err != nil {
+			log.Printf("%s %s", remoteAddr, err)
+		}
+		bearer = session != nil
+	}
 	if session != nil && p.CookieRefresh != time.Duration(0) && sessionAge > p.CookieRefresh && session.AccessToken != "" {
 		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
 		saveSession = true
 	}
 
-	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
+	provider := p.provider
+	if session != nil {
+		var ok bool
+		if provider, ok = p.getProvider(session.Provider); !ok {
+			log.Printf("%s removing session. unknown provider %q %s", remoteAddr, session.Provider, session)
+			provider = p.provider
+			session = nil
+			clearSession = true
+		}
+	}
+
+	if ok, err := provider.RefreshSessionIfNeeded(session); err != nil {
 		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
 		clearSession = true
 		session = nil
@@ -762,7 +1494,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 
 	if saveSession && !revalidated && session != nil {
 		if session.AccessToken != "" {
-			if !p.provider.ValidateSessionState(session) {
+			if !provider.ValidateSessionState(session) {
 				log.Printf("%s removing session. error validating %s", remoteAddr, session)
 				saveSession = false
 				session = nil
@@ -773,18 +1505,28 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		}
 	}
 
-	if session != nil && session.Email != "" && !p.Validator(session.Email) {
+	if session != nil && p.denyList.Denies(session) {
+		log.Printf("%s Permission Denied: removing session %s on the deny list", remoteAddr, session)
+		session = nil
+		saveSession = false
+		clearSession = true
+	}
+
+	if session != nil && session.Email != "" && !p.validatorFor(session.Provider)(session.Email) {
 		log.Printf("%s Permission Denied: removing session %s", remoteAddr, session)
 		session = nil
 		saveSession = false
 		clearSession = true
 	}
 
-	if saveSession && session != nil {
+	// bearer tokens are held by the client, there is no cookie to update
+	if saveSession && session != nil && bearer {
+		p.saveBearerSession(req, session)
+	} else if saveSession && session != nil {
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			return http.StatusInternalServerError
+			return http.StatusInternalServerError, nil
 		}
 	}
 
@@ -792,6 +1534,25 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		p.ClearSessionCookie(rw, req)
 	}
 
+	if session == nil && p.passwordLogin() {
+		if user, _, ok := req.BasicAuth(); ok {
+			if wait := p.loginRetryAfter(req, user); wait > 0 {
+				log.Printf("%s security: refusing basic auth for %q, locked out for %s", remoteAddr, user, wait)
+				setRetryAfter(rw, wait)
+				return http.StatusTooManyRequests, nil
+			}
+		}
+	}
+
+	var apiKeyHeader string
+	if session == nil {
+		session, apiKeyHeader = p.CheckAPIKey(req)
+	}
+
+	if session == nil {
+		session = p.CheckClientCert(req)
+	}
+
 	if session == nil {
 		session, err = p.CheckBasicAuth(req)
 		if err != nil {
@@ -800,10 +1561,55 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if session == nil {
-		return http.StatusForbidden
+		return http.StatusForbidden, nil
+	}
+
+	if session.Email == "" {
+		rw.Header().Set("GAP-Auth", session.User)
+	} else {
+		rw.Header().Set("GAP-Auth", session.Email)
+	}
+
+	if rule := p.authorizationRule(req); rule != nil && !rule.Allows(session) {
+		log.Printf("%s Permission Denied: %s is not allowed %s %s by %s", remoteAddr, session, req.Method, req.URL.Path, rule)
+		return http.StatusForbidden, session
+	}
+
+	if req.URL.Path == p.AuthOnlyPath {
+		if rule := authRequestRule(req.URL.Query()); rule != nil && !rule.Allows(session) {
+			log.Printf("%s Permission Denied: %s is not allowed by auth request %q", remoteAddr, session, req.URL.RawQuery)
+			return http.StatusForbidden, session
+		}
+	}
+
+	if len(p.accessPolicies) != 0 {
+		allowed, ap := p.evaluateAccessPolicies(req, session)
+		decision := "denied"
+		if allowed {
+			decision = "allowed"
+		}
+		if ap != nil {
+			log.Printf("%s access policy %q %s %s %s %s", remoteAddr, ap.Name, decision, session, req.Method, req.URL.Path)
+		} else {
+			log.Printf("%s no access policy matched, denied %s %s %s", remoteAddr, session, req.Method, req.URL.Path)
+		}
+		if !allowed {
+			return http.StatusForbidden, session
+		}
+	}
+
+	if path, ok := p.originalPath(req); ok && p.authTooOld(path, session) {
+		log.Printf("%s re-authentication required: %s authenticated too long ago for %s", remoteAddr, session, path)
+		return http.StatusUnauthorized, session
 	}
 
 	// At this point, the user is authenticated. proxy normally
+	if bearer {
+		req.Header.Del("Authorization")
+	}
+	if apiKeyHeader != "" {
+		req.Header.Del(apiKeyHeader)
+	}
 	if p.PassBasicAuth {
 		req.SetBasicAuth(session.User, p.BasicAuthPassword)
 	}
@@ -814,12 +1620,20 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		} else {
 			req.Header.Del("X-Forwarded-Email")
 		}
+		if len(session.Groups) != 0 {
+			req.Header.Set("X-Forwarded-Groups", strings.Join(session.Groups, ","))
+		} else {
+			req.Header.Del("X-Forwarded-Groups")
+		}
 	}
 	if p.SetXAuthRequest {
 		rw.Header().Set("X-Auth-Request-User", session.User)
 		if session.Email != "" {
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
+		if len(session.Groups) != 0 {
+			rw.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+		}
 		if p.PassAccessToken && session.AccessToken != "" {
 			rw.Header().Set("X-Auth-Request-Access-Token", session.AccessToken)
 		}
@@ -831,16 +1645,11 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 			req.Header.Del("X-Forwarded-Access-Token")
 		}
 	}
-	if session.Email == "" {
-		rw.Header().Set("GAP-Auth", session.User)
-	} else {
-		rw.Header().Set("GAP-Auth", session.Email)
-	}
-	return http.StatusAccepted
+	return http.StatusAccepted, session
 }
 
 func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState, error) {
-	if p.HtpasswdFile == nil {
+	if !p.passwordLogin() {
 		return nil, nil
 	}
 	auth := req.Header.Get("Authorization")
@@ -859,9 +1668,27 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState,
 	if len(pair) != 2 {
 		return nil, fmt.Errorf("invalid format %s", b)
 	}
-	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
-		log.Printf("authenticated %q via basic auth", pair[0])
-		return &providers.SessionState{User: pair[0]}, nil
+	session := p.checkPassword(req, pair[0], pair[1])
+	if session == nil {
+		return nil, fmt.Errorf("invalid password for %s", pair[0])
+	}
+	if err := p.refuseSession(session); err != nil {
+		return nil, err
+	}
+	log.Printf("authenticated %q via basic auth", pair[0])
+	return session, nil
+}
+
+// refuseSession returns why the session of a login that bypasses the
+// provider, such as a password or API key, may not sign in: its account is on
+// the deny list, or its email fails the email validation every session is
+// held to
+func (p *OAuthProxy) refuseSession(session *providers.SessionState) error {
+	if p.denyList.Denies(session) {
+		return fmt.Errorf("Permission Denied: %s on the deny list", session)
 	}
-	return nil, fmt.Errorf("%s not in HtpasswdFile", pair[0])
+	if session.Email != "" && !p.Validator(session.Email) {
+		return fmt.Errorf("Permission Denied: %s", session)
+	}
+	return nil
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto"
 	"encoding/base64"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
@@ -11,12 +12,15 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/mbland/hmacauth"
+	"github.com/d-cheremnov/oauth2_proxy/cookie"
+	"github.com/d-cheremnov/oauth2_proxy/mockidp"
 	"github.com/d-cheremnov/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/websocket"
@@ -1018,3 +1022,895 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+func NewSAMLProxyTest() *OAuthProxy {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "https://proxy.example.com/oauth2/saml/metadata"
+	opts.Provider = "saml"
+	opts.LoginURL = "https://idp.example.com/sso"
+	opts.RedirectURL = "https://proxy.example.com/oauth2/callback"
+	opts.Validate()
+
+	opts.provider = providers.NewSAMLProvider(&providers.ProviderData{
+		ClientID: opts.ClientID,
+		LoginURL: &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/sso"},
+	})
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestSAMLMetadataEndpoint(t *testing.T) {
+	proxy := NewSAMLProxyTest()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/saml/metadata", nil)
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/samlmetadata+xml", rw.Header().Get("Content-Type"))
+	assert.Contains(t, rw.Body.String(), `Location="https://proxy.example.com/oauth2/saml/acs"`)
+}
+
+func TestSAMLMetadataEndpointWithoutSAMLProvider(t *testing.T) {
+	sip_test := NewSignInPageTest(false)
+	code, _ := sip_test.GetEndpoint("/oauth2/saml/metadata")
+	assert.Equal(t, 404, code)
+}
+
+func TestSAMLStartRedirectsToIdP(t *testing.T) {
+	proxy := NewSAMLProxyTest()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2Fapp", nil)
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 302, rw.Code)
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "idp.example.com", location.Host)
+	assert.NotEqual(t, "", location.Query().Get("SAMLRequest"))
+	assert.True(t, strings.HasSuffix(location.Query().Get("RelayState"), ":/app"))
+}
+
+func TestSAMLACSRequiresPost(t *testing.T) {
+	proxy := NewSAMLProxyTest()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/saml/acs", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 405, rw.Code)
+}
+
+func TestSAMLACSRejectsCSRFMismatch(t *testing.T) {
+	proxy := NewSAMLProxyTest()
+	rw := httptest.NewRecorder()
+	form := url.Values{"RelayState": {"nonce:/"}, "SAMLResponse": {"ignored"}}
+	req, _ := http.NewRequest("POST", "/oauth2/saml/acs", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(proxy.MakeCSRFCookie(req, "other", time.Hour, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "csrf failed")
+}
+
+type MultiProviderTest struct {
+	proxy   *OAuthProxy
+	servers []*httptest.Server
+	redeems map[string]int
+}
+
+func newMultiProviderTestServer(test *MultiProviderTest, name string) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		test.redeems[name]++
+		w.Write([]byte(`{"access_token": "` + name + `_token"}`))
+	}))
+	test.servers = append(test.servers, server)
+	u, _ := url.Parse(server.URL)
+	return u
+}
+
+func NewMultiProviderTest() *MultiProviderTest {
+	test := &MultiProviderTest{redeems: make(map[string]int)}
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"example.com"}
+	opts.Providers = []ProviderOptions{{
+		Name:         "contractors",
+		DisplayName:  "Contractor GitHub",
+		Provider:     "github",
+		ClientID:     "contractor-client",
+		ClientSecret: "contractor-secret",
+		EmailDomains: []string{"contractor.com"},
+	}}
+	opts.Validate()
+
+	google := NewTestProvider(newMultiProviderTestServer(test, "google"), "jane@example.com")
+	github := NewTestProvider(newMultiProviderTestServer(test, "github"), "joe@contractor.com")
+	github.ProviderName = "GitHub"
+	opts.provider = google
+	opts.namedProviders[0].Provider = google
+	opts.namedProviders[1].Provider = github
+	test.proxy = NewOAuthProxy(opts, func(email string) bool {
+		return strings.HasSuffix(email, "@example.com")
+	})
+	return test
+}
+
+func (test *MultiProviderTest) Close() {
+	for _, s := range test.servers {
+		s.Close()
+	}
+}
+
+func (test *MultiProviderTest) Callback(state, csrfToken string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(test.proxy.MakeCSRFCookie(req, csrfToken, time.Hour, time.Now()))
+	test.proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestMultiProviderSignInPage(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	test.proxy.ServeHTTP(rw, req)
+
+	body := rw.Body.String()
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, body, "Sign in with Google")
+	assert.Contains(t, body, "Sign in with Contractor GitHub")
+	assert.Contains(t, body, `<input type="hidden" name="provider" value="contractors">`)
+	assert.Equal(t, 1, strings.Count(body, `name="provider"`))
+}
+
+func TestMultiProviderStart(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?provider=contractors&rd=%2Fapp", nil)
+	test.proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 302, rw.Code)
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, test.servers[1].URL, "http://"+location.Host)
+	state := location.Query().Get("state")
+	assert.True(t, strings.HasSuffix(state, ".contractors:/app"), state)
+	assert.Contains(t, rw.Header().Get("Set-Cookie"), strings.TrimSuffix(state, ":/app"))
+}
+
+func TestMultiProviderStartDefault(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2Fapp", nil)
+	test.proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 302, rw.Code)
+	location, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, test.servers[0].URL, "http://"+location.Host)
+	assert.NotContains(t, location.Query().Get("state"), ".")
+}
+
+func TestMultiProviderStartUnknownProvider(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?provider=nope", nil)
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+}
+
+func TestMultiProviderCallbackUsesStateProvider(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := test.Callback("nonce.contractors:/app", "nonce.contractors")
+
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/app", rw.Header().Get("Location"))
+	assert.Equal(t, 1, test.redeems["github"])
+	assert.Equal(t, 0, test.redeems["google"])
+
+	// the session remembers its provider and is checked against that
+	// provider's email domains rather than the top level ones
+	req, _ := http.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == test.proxy.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	session, _, err := test.proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "contractors", session.Provider)
+	assert.Equal(t, "joe@contractor.com", session.Email)
+	assert.Equal(t, http.StatusAccepted, test.proxy.Authenticate(httptest.NewRecorder(), req))
+}
+
+func TestMultiProviderCallbackDefaultProvider(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := test.Callback("nonce:/", "nonce")
+
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, 1, test.redeems["google"])
+	assert.Equal(t, 0, test.redeems["github"])
+}
+
+func TestMultiProviderCallbackRejectsSwitchedProvider(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := test.Callback("nonce.contractors:/", "nonce")
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "csrf failed")
+}
+
+func TestMultiProviderCallbackUnknownProvider(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	rw := test.Callback("nonce.nope:/", "nonce.nope")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, 0, test.redeems["google"]+test.redeems["github"])
+}
+
+func TestMultiProviderWithoutDefaultRejectsUnnamed(t *testing.T) {
+	test := &MultiProviderTest{redeems: make(map[string]int)}
+	defer test.Close()
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Providers = []ProviderOptions{{
+		Name:         "contractors",
+		Provider:     "github",
+		ClientID:     "contractor-client",
+		ClientSecret: "contractor-secret",
+		EmailDomains: []string{"contractor.com"},
+	}}
+	assert.Equal(t, nil, opts.Validate())
+	github := NewTestProvider(newMultiProviderTestServer(test, "github"), "joe@example.org")
+	opts.provider = github
+	opts.namedProviders[0].Provider = github
+	test.proxy = NewOAuthProxy(opts, func(string) bool { return true })
+
+	// the state must name the provider whose email domains apply
+	rw := test.Callback("nonce:/", "nonce")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, 0, test.redeems["github"])
+	rw = test.Callback("nonce.contractors:/", "nonce.contractors")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, 1, test.redeems["github"])
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	value, _ := test.proxy.provider.CookieForSession(&providers.SessionState{Email: "joe@example.org"}, test.proxy.CookieCipher)
+	req.AddCookie(test.proxy.MakeSessionCookie(req, value, time.Hour, time.Now()))
+	rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestMultiProviderSessionFromUnknownProvider(t *testing.T) {
+	test := NewMultiProviderTest()
+	defer test.Close()
+	req, _ := http.NewRequest("GET", "/", nil)
+	value, _ := test.proxy.provider.CookieForSession(&providers.SessionState{
+		Email:    "jane@example.com",
+		Provider: "removed",
+	}, nil)
+	req.AddCookie(test.proxy.MakeSessionCookie(req, value, time.Hour, time.Now()))
+	assert.Equal(t, http.StatusForbidden, test.proxy.Authenticate(httptest.NewRecorder(), req))
+}
+
+func TestEncodeDecodeState(t *testing.T) {
+	csrfToken, state := encodeState("abc123", "", "/app:1")
+	assert.Equal(t, "abc123", csrfToken)
+	assert.Equal(t, "abc123:/app:1", state)
+
+	csrfToken, state = encodeState("abc123", "github", "/app")
+	assert.Equal(t, "abc123.github", csrfToken)
+	token, provider, redirect, err := decodeState(state)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, csrfToken, token)
+	assert.Equal(t, "github", provider)
+	assert.Equal(t, "/app", redirect)
+
+	_, _, _, err = decodeState("abc123")
+	assert.NotEqual(t, nil, err)
+}
+
+type DeviceFlowTest struct {
+	proxy    *OAuthProxy
+	server   *httptest.Server
+	approved bool
+}
+
+func NewDeviceFlowTest(enabled bool) *DeviceFlowTest {
+	test := &DeviceFlowTest{}
+	test.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch {
+		case r.URL.Path == "/device/code":
+			w.Write([]byte(`{"device_code": "dev123", "user_code": "WDJB-MJHT",
+				"verification_uri": "https://idp.example.com/device", "expires_in": 600, "interval": 5}`))
+		case !test.approved:
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "authorization_pending"}`))
+		default:
+			w.Write([]byte(`{"access_token": "upstream_token"}`))
+		}
+	}))
+
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.DeviceFlow = enabled
+	opts.Validate()
+
+	serverURL, _ := url.Parse(test.server.URL)
+	provider := NewTestProvider(serverURL, "jane@example.com")
+	provider.DeviceAuthURL = &url.URL{Scheme: "http", Host: serverURL.Host, Path: "/device/code"}
+	opts.provider = provider
+	test.proxy = NewOAuthProxy(opts, func(email string) bool {
+		return email == "jane@example.com"
+	})
+	return test
+}
+
+func (test *DeviceFlowTest) Post(path string, form url.Values) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	test.proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func (test *DeviceFlowTest) Token() string {
+	test.approved = true
+	rw := test.Post("/oauth2/device/token", url.Values{"device_code": {"dev123"}})
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	json.Unmarshal(rw.Body.Bytes(), &response)
+	return response.AccessToken
+}
+
+func TestDeviceFlowDisabled(t *testing.T) {
+	test := NewDeviceFlowTest(false)
+	defer test.server.Close()
+	rw := test.Post("/oauth2/device/authorize", nil)
+	assert.Equal(t, 404, rw.Code)
+	rw = test.Post("/oauth2/device/token", url.Values{"device_code": {"dev123"}})
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestDeviceFlowAuthorize(t *testing.T) {
+	test := NewDeviceFlowTest(true)
+	defer test.server.Close()
+	rw := test.Post("/oauth2/device/authorize", nil)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	var response map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &response))
+	assert.Equal(t, "dev123", response["device_code"])
+	assert.Equal(t, "WDJB-MJHT", response["user_code"])
+	assert.Equal(t, "https://idp.example.com/device", response["verification_uri"])
+	assert.Equal(t, float64(5), response["interval"])
+}
+
+func TestDeviceFlowAuthorizeRequiresPost(t *testing.T) {
+	test := NewDeviceFlowTest(true)
+	defer test.server.Close()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/device/authorize", nil)
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 405, rw.Code)
+}
+
+func TestDeviceFlowTokenPending(t *testing.T) {
+	test := NewDeviceFlowTest(true)
+	defer test.server.Close()
+	rw := test.Post("/oauth2/device/token", url.Values{"device_code": {"dev123"}})
+	assert.Equal(t, 400, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"error":"authorization_pending"`)
+}
+
+func TestDeviceFlowTokenAuthenticates(t *testing.T) {
+	test := NewDeviceFlowTest(true)
+	defer test.server.Close()
+	token := test.Token()
+	assert.NotEqual(t, "", token)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rw := httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, test.proxy.Authenticate(rw, req))
+	assert.Equal(t, "jane@example.com", rw.Header().Get("GAP-Auth"))
+	assert.Equal(t, "jane@example.com", req.Header.Get("X-Forwarded-Email"))
+	// the proxy token is not forwarded upstream
+	assert.False(t, strings.HasPrefix(req.Header.Get("Authorization"), "Bearer"))
+}
+
+func TestDeviceFlowTokenDeniedAccount(t *testing.T) {
+	test := NewDeviceFlowTest(true)
+	defer test.server.Close()
+	test.proxy.Validator = func(string) bool { return false }
+	test.approved = true
+	rw := test.Post("/oauth2/device/token", url.Values{"device_code": {"dev123"}})
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"error":"access_denied"`)
+}
+
+func TestDeviceFlowRejectsInvalidBearer(t *testing.T) {
+	test := NewDeviceFlowTest(true)
+	defer test.server.Close()
+	token := test.Token()
+
+	tokens := map[string]string{
+		"tampered": token + "x",
+		// a session cookie value is signed for a different name
+		"cookie": cookie.SignedValue(test.proxy.CookieSeed, test.proxy.CookieName,
+			"email:jane@example.com user:jane", time.Now()),
+	}
+	for name, value := range tokens {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+value)
+		assert.Equal(t, http.StatusForbidden, test.proxy.Authenticate(httptest.NewRecorder(), req), name)
+	}
+}
+
+func TestDeviceFlowBearerIgnoredWhenDisabled(t *testing.T) {
+	test := NewDeviceFlowTest(true)
+	defer test.server.Close()
+	token := test.Token()
+	test.proxy.DeviceFlow = false
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusForbidden, test.proxy.Authenticate(httptest.NewRecorder(), req))
+}
+
+type RefreshingTestProvider struct {
+	*TestProvider
+	refreshes int
+}
+
+func (tp *RefreshingTestProvider) RefreshSessionIfNeeded(s *providers.SessionState) (bool, error) {
+	if s.RefreshToken == "" || s.ExpiresOn.After(time.Now().Add(time.Minute)) {
+		return false, nil
+	}
+	tp.refreshes++
+	s.AccessToken = "refreshed_token"
+	s.ExpiresOn = time.Now().Add(time.Hour)
+	return true, nil
+}
+
+func TestDeviceFlowBearerRefreshIsCached(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.CookieSecret = "0123456789abcdef0123456789abcdef"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"example.com"}
+	opts.PassAccessToken = true
+	opts.DeviceFlow = true
+	assert.Equal(t, nil, opts.Validate())
+	provider := &RefreshingTestProvider{TestProvider: NewTestProvider(&url.URL{Host: "localhost"}, "jane@example.com")}
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return email == "jane@example.com"
+	})
+
+	value, err := provider.CookieForSession(&providers.SessionState{Email: "jane@example.com", User: "jane",
+		AccessToken: "upstream_token", RefreshToken: "refresh", ExpiresOn: time.Now().Add(time.Second)}, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	token := cookie.SignedValue(proxy.CookieSeed, proxy.deviceTokenName(), value, time.Now())
+
+	// the token still carries the expiring session, the refreshed one is kept
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		status, session := proxy.authenticate(httptest.NewRecorder(), req)
+		assert.Equal(t, http.StatusAccepted, status)
+		if assert.NotNil(t, session) {
+			assert.Equal(t, "refreshed_token", session.AccessToken)
+		}
+	}
+	assert.Equal(t, 1, provider.refreshes)
+}
+
+func TestBearerSessionCache(t *testing.T) {
+	c := NewBearerSessionCache()
+	now := time.Unix(1600000000, 0)
+	c.now = func() time.Time { return now }
+
+	session := &providers.SessionState{Email: "jane@example.com", AccessToken: "a"}
+	c.Save("k1", session, now.Add(time.Hour))
+	c.Save("k2", session, now.Add(time.Minute))
+	session.AccessToken = "b"
+
+	loaded, saved, ok := c.Load("k1")
+	if assert.True(t, ok) {
+		assert.Equal(t, "a", loaded.AccessToken)
+		assert.Equal(t, now, saved)
+		// callers get their own copy
+		loaded.AccessToken = "c"
+		loaded, _, _ = c.Load("k1")
+		assert.Equal(t, "a", loaded.AccessToken)
+	}
+	_, _, ok = c.Load("k3")
+	assert.False(t, ok)
+
+	// expired sessions are not loaded and are dropped on the next save
+	now = now.Add(2 * time.Minute)
+	_, _, ok = c.Load("k2")
+	assert.False(t, ok)
+	c.Save("k3", session, now.Add(time.Hour))
+	assert.Equal(t, 2, len(c.sessions))
+}
+
+func TestTokenExchangePerUpstream(t *testing.T) {
+	exchanges := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			r.ParseForm()
+			exchanges++
+			w.Write([]byte(`{"access_token": "` + r.PostForm.Get("audience") + `_token", "expires_in": 300}`))
+		default:
+			w.Write([]byte(r.Header.Get("X-Forwarded-Access-Token")))
+		}
+	}))
+	defer server.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{server.URL + "/", server.URL + "/orders/"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.PassAccessToken = true
+	opts.TokenExchanges = []string{"upstream=" + server.URL + "/orders/,audience=orders-api"}
+	assert.Equal(t, nil, opts.Validate())
+	providerURL, _ := url.Parse(server.URL)
+	opts.provider = NewTestProvider(providerURL, "jane@example.com")
+	opts.provider.(*TestProvider).ValidToken = true
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "jane@example.com", AccessToken: "user_token"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	get := func(path string) string {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+		return rw.Body.String()
+	}
+
+	assert.Equal(t, "user_token", get("/"))
+	assert.Equal(t, "orders-api_token", get("/orders/1"))
+	assert.Equal(t, "orders-api_token", get("/orders/2"))
+	assert.Equal(t, 1, exchanges)
+}
+
+type MockIdPTest struct {
+	idp      *mockidp.Server
+	upstream *httptest.Server
+	opts     *Options
+	proxy    *OAuthProxy
+}
+
+// NewMockIdPTest runs a proxy against a mock OIDC provider. configure may
+// change the options before they are validated.
+func NewMockIdPTest(t *testing.T, configure func(*Options), users ...mockidp.User) *MockIdPTest {
+	test := &MockIdPTest{}
+	var err error
+	test.idp, err = mockidp.NewServer(mockidp.Config{ClientID: "bazquux", ClientSecret: "xyzzyplugh", Users: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-Email")))
+	}))
+
+	test.opts = NewOptions()
+	test.opts.Upstreams = []string{test.upstream.URL}
+	test.opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	test.opts.CookieSecure = false
+	test.opts.ClientID = "bazquux"
+	test.opts.ClientSecret = "xyzzyplugh"
+	test.opts.Provider = "oidc"
+	test.opts.OIDCIssuerURL = test.idp.URL
+	test.opts.EmailDomains = []string{"example.com"}
+	if configure != nil {
+		configure(test.opts)
+	}
+	assert.Equal(t, nil, test.opts.Validate())
+	test.proxy = NewOAuthProxy(test.opts, NewValidator(test.opts.EmailDomains, ""))
+	return test
+}
+
+func (test *MockIdPTest) Close() {
+	test.idp.Close()
+	test.upstream.Close()
+}
+
+func (test *MockIdPTest) Serve(target string, cookies []*http.Cookie) *http.Response {
+	req, _ := http.NewRequest("GET", target, nil)
+	req.Host = "localhost"
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, req)
+	return rw.Result()
+}
+
+// Login starts a login at the proxy and signs in at the IdP, returning the
+// CSRF cookies and the callback URL the IdP redirected to
+func (test *MockIdPTest) Login(t *testing.T) ([]*http.Cookie, *url.URL) {
+	return test.LoginFrom(t, "/oauth2/start?rd=/private")
+}
+
+func (test *MockIdPTest) LoginFrom(t *testing.T, startURL string) ([]*http.Cookie, *url.URL) {
+	start := test.Serve(startURL, nil)
+	assert.Equal(t, http.StatusFound, start.StatusCode)
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(start.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "/oauth2/callback", callback.Path)
+	return start.Cookies(), callback
+}
+
+// SessionCookies returns the session cookies set by resp
+func (test *MockIdPTest) SessionCookies(resp *http.Response) []*http.Cookie {
+	var session []*http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == test.opts.CookieName {
+			session = append(session, c)
+		}
+	}
+	return session
+}
+
+// SessionCookie encodes s as a session cookie
+func (test *MockIdPTest) SessionCookie(t *testing.T, s *providers.SessionState) []*http.Cookie {
+	value, err := test.proxy.provider.CookieForSession(s, test.proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Host = "localhost"
+	return []*http.Cookie{test.proxy.MakeSessionCookie(req, value, test.proxy.CookieExpire, time.Now())}
+}
+
+func TestMockIdPLoginFlow(t *testing.T) {
+	test := NewMockIdPTest(t, nil)
+	defer test.Close()
+
+	csrf, callback := test.Login(t)
+	signedIn := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusFound, signedIn.StatusCode)
+	assert.Equal(t, "/private", signedIn.Header.Get("Location"))
+
+	page := test.Serve("/private", test.SessionCookies(signedIn))
+	assert.Equal(t, http.StatusOK, page.StatusCode)
+	body, _ := ioutil.ReadAll(page.Body)
+	assert.Equal(t, mockidp.DefaultUser.Email, string(body))
+}
+
+func TestOIDCNonceRejectsInjectedCode(t *testing.T) {
+	test := NewMockIdPTest(t, nil)
+	defer test.Close()
+
+	// a code issued for one login cannot complete another, even with a
+	// valid state and CSRF cookie
+	_, attacker := test.Login(t)
+	csrf, victim := test.Login(t)
+	q := victim.Query()
+	q.Set("code", attacker.Query().Get("code"))
+	victim.RawQuery = q.Encode()
+	resp := test.Serve(victim.RequestURI(), csrf)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "Invalid ID Token")
+}
+
+func TestOIDCNonceRequiredInCSRFCookie(t *testing.T) {
+	test := NewMockIdPTest(t, nil)
+	defer test.Close()
+
+	csrf, callback := test.Login(t)
+	csrfToken, nonce := decodeCSRFCookie(csrf[0].Value)
+	assert.NotEqual(t, "", nonce)
+	assert.Contains(t, callback.Query().Get("state"), csrfToken+":")
+	csrf[0].Value = csrfToken
+	resp := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestEncodeDecodeCSRFCookie(t *testing.T) {
+	csrfToken, nonce := decodeCSRFCookie(encodeCSRFCookie("abc.corp", "n0nce"))
+	assert.Equal(t, "abc.corp", csrfToken)
+	assert.Equal(t, "n0nce", nonce)
+	csrfToken, nonce = decodeCSRFCookie("abc")
+	assert.Equal(t, "abc", csrfToken)
+	assert.Equal(t, "", nonce)
+}
+
+func TestMaxAuthAgeReauthenticates(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.MaxAuthAge = []string{"^/admin/=15m"}
+	})
+	defer test.Close()
+
+	session := &providers.SessionState{Email: "jane@example.com", User: "jane",
+		AuthTime: time.Now().Add(-time.Hour)}
+	cookies := test.SessionCookie(t, session)
+	assert.Equal(t, http.StatusOK, test.Serve("/private", cookies).StatusCode)
+
+	resp := test.Serve("/admin/users?page=2", cookies)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	start, _ := url.Parse(resp.Header.Get("Location"))
+	assert.Equal(t, "/oauth2/start", start.Path)
+	assert.Equal(t, "/admin/users?page=2", start.Query().Get("rd"))
+	assert.Equal(t, "900", start.Query().Get("max_age"))
+
+	login := test.Serve(start.RequestURI(), nil)
+	loginURL, _ := url.Parse(login.Header.Get("Location"))
+	assert.Equal(t, "900", loginURL.Query().Get("max_age"))
+
+	csrf, callback := test.LoginFrom(t, start.RequestURI())
+	signedIn := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusFound, signedIn.StatusCode)
+	assert.Equal(t, "/admin/users?page=2", signedIn.Header.Get("Location"))
+	assert.Equal(t, http.StatusOK, test.Serve("/admin/users?page=2", test.SessionCookies(signedIn)).StatusCode)
+
+	// sessions without an authentication time are treated as too old
+	session.AuthTime = time.Time{}
+	assert.Equal(t, http.StatusFound, test.Serve("/admin/", test.SessionCookie(t, session)).StatusCode)
+}
+
+func TestMaxAuthAgeAuthEndpoint(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.MaxAuthAge = []string{"^/admin/=15m"}
+	})
+	defer test.Close()
+	cookies := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane",
+		AuthTime: time.Now().Add(-time.Hour)})
+
+	auth := func(header, uri string) int {
+		req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+		req.Host = "localhost"
+		if header != "" {
+			req.Header.Set(header, uri)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		test.proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, auth("X-Original-URI", "/admin/users?page=2"))
+	assert.Equal(t, http.StatusUnauthorized, auth("X-Forwarded-Uri", "/admin/"))
+	assert.Equal(t, http.StatusAccepted, auth("X-Original-URI", "/private"))
+	// without the original URI the path is unknown
+	assert.Equal(t, http.StatusAccepted, auth("", ""))
+}
+
+func TestMaxAuthAgeForwardAuth(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.MaxAuthAge = []string{"^/admin/=15m"}
+		o.ForwardAuth = true
+	})
+	defer test.Close()
+	cookies := test.SessionCookie(t, &providers.SessionState{Email: "jane@example.com", User: "jane",
+		AuthTime: time.Now().Add(-time.Hour)})
+
+	req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+	req.Host = "localhost"
+	req.Header.Set("X-Forwarded-Host", "localhost")
+	req.Header.Set("X-Forwarded-Uri", "/admin/users")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	loginURL, _ := url.Parse(rw.Header().Get("Location"))
+	assert.Equal(t, "900", loginURL.Query().Get("max_age"))
+}
+
+func TestMaxAuthAgeFirstVisit(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.MaxAuthAge = []string{"^/admin/=15m"}
+	})
+	defer test.Close()
+
+	// without a session the sign in page starts the login for the page
+	assert.Equal(t, http.StatusForbidden, test.Serve("/admin/users", nil).StatusCode)
+	login := test.Serve("/oauth2/start?rd=%2Fadmin%2Fusers", nil)
+	loginURL, _ := url.Parse(login.Header.Get("Location"))
+	assert.Equal(t, "900", loginURL.Query().Get("max_age"))
+
+	login = test.Serve("/oauth2/start?rd=%2Fprivate", nil)
+	loginURL, _ = url.Parse(login.Header.Get("Location"))
+	assert.Equal(t, "", loginURL.Query().Get("max_age"))
+
+	csrf, callback := test.LoginFrom(t, "/oauth2/start?rd=%2Fadmin%2Fusers")
+	signedIn := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusFound, signedIn.StatusCode)
+	assert.Equal(t, "/admin/users", signedIn.Header.Get("Location"))
+}
+
+func TestMaxAuthAgeRejectsStaleLogin(t *testing.T) {
+	// an IdP that ignores max_age reports the original authentication
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.MaxAuthAge = []string{"^/admin/=15m"}
+	}, mockidp.User{Subject: "jane", Email: "jane@example.com",
+		Claims: map[string]interface{}{"auth_time": time.Now().Add(-time.Hour).Unix()}})
+	defer test.Close()
+
+	csrf, callback := test.LoginFrom(t, "/oauth2/start?rd=/admin/&max_age=900")
+	resp := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	csrf, callback = test.Login(t)
+	assert.Equal(t, http.StatusFound, test.Serve(callback.RequestURI(), csrf).StatusCode)
+}
+
+func TestOIDCRequiredAcr(t *testing.T) {
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.OIDCAcrValues = "urn:example:mfa"
+		o.OIDCRequiredAcr = []string{"urn:example:mfa"}
+	}, mockidp.User{Subject: "jane", Email: "jane@example.com",
+		Claims: map[string]interface{}{"acr": "urn:example:pwd"}})
+	defer test.Close()
+
+	start := test.Serve("/oauth2/start?rd=/", nil)
+	loginURL, _ := url.Parse(start.Header.Get("Location"))
+	assert.Equal(t, "urn:example:mfa", loginURL.Query().Get("acr_values"))
+
+	csrf, callback := test.Login(t)
+	resp := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "Insufficient Authentication")
+}
+
+func TestReauthLoginURL(t *testing.T) {
+	loginURL := "https://provider.example.com/authorize?approval_prompt=force&state=x"
+	github := providers.New("github", &providers.ProviderData{})
+	assert.Equal(t, "https://provider.example.com/authorize?prompt=login&state=x",
+		reauthLoginURL(github, loginURL, 900))
+	oidc := providers.New("oidc", &providers.ProviderData{})
+	assert.Equal(t, "https://provider.example.com/authorize?approval_prompt=force&max_age=900&state=x",
+		reauthLoginURL(oidc, loginURL, 900))
+}
+
+func TestMockIdPAuthenticatedEmailsFileGroups(t *testing.T) {
+	f, _ := ioutil.TempFile("", "test_auth_emails_")
+	defer os.Remove(f.Name())
+	f.WriteString("*@example.com, staff\n")
+	f.Close()
+
+	test := NewMockIdPTest(t, func(o *Options) {
+		o.SetXAuthRequest = true
+	}, mockidp.User{Subject: "jane", Email: "jane@example.com"})
+	defer test.Close()
+	test.proxy.UserMap = NewUserMap(f.Name(), nil, func() {})
+
+	csrf, callback := test.Login(t)
+	signedIn := test.Serve(callback.RequestURI(), csrf)
+	assert.Equal(t, http.StatusFound, signedIn.StatusCode)
+
+	auth := test.Serve("/oauth2/auth", test.SessionCookies(signedIn))
+	assert.Equal(t, http.StatusAccepted, auth.StatusCode)
+	assert.Equal(t, "jane@example.com", auth.Header.Get("X-Auth-Request-Email"))
+	assert.Equal(t, "staff", auth.Header.Get("X-Auth-Request-Groups"))
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"crypto"
-	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -12,8 +11,10 @@ import (
 	"strings"
 	"time"
 
-	"github.com/mbland/hmacauth"
+	"github.com/BurntSushi/toml"
+	"github.com/d-cheremnov/oauth2_proxy/api"
 	"github.com/d-cheremnov/oauth2_proxy/providers"
+	"github.com/mbland/hmacauth"
 )
 
 // Configuration Options that can be set by Command Line Flag, or Config File
@@ -29,7 +30,25 @@ type Options struct {
 	TLSCertFile     string `flag:"tls-cert-file" cfg:"tls_cert_file"`
 	TLSKeyFile      string `flag:"tls-key-file" cfg:"tls_key_file"`
 
+	TLSClientCAFile  string `flag:"tls-client-ca-file" cfg:"tls_client_ca_file"`
+	TLSClientAuth    string `flag:"tls-client-auth" cfg:"tls_client_auth"`
+	TLSClientCRLFile string `flag:"tls-client-crl-file" cfg:"tls_client_crl_file"`
+
+	EnvoyAuthzAddress string `flag:"envoy-authz-address" cfg:"envoy_authz_address"`
+
+	ClientAuthMethod       string `flag:"client-auth-method" cfg:"client_auth_method"`
+	ClientAssertionKeyFile string `flag:"client-assertion-key-file" cfg:"client_assertion_key_file"`
+	ClientAssertionKeyID   string `flag:"client-assertion-key-id" cfg:"client_assertion_key_id"`
+
+	ProviderCAFile         string        `flag:"provider-ca-file" cfg:"provider_ca_file"`
+	ProviderClientCertFile string        `flag:"provider-client-cert-file" cfg:"provider_client_cert_file"`
+	ProviderClientKeyFile  string        `flag:"provider-client-key-file" cfg:"provider_client_key_file"`
+	ProviderTimeout        time.Duration `flag:"provider-timeout" cfg:"provider_timeout"`
+	ProviderDialTimeout    time.Duration `flag:"provider-dial-timeout" cfg:"provider_dial_timeout"`
+	ProviderProxy          string        `flag:"provider-proxy" cfg:"provider_proxy"`
+
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
+	DenyFile                 string   `flag:"deny-file" cfg:"deny_file"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
 	BitbucketTeam            string   `flag:"bitbucket-team" cfg:"bitbucket_team"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
@@ -41,11 +60,30 @@ type Options struct {
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file"`
+	APIKeysFile              string   `flag:"api-keys-file" cfg:"api_keys_file"`
+	APIKeyHeader             string   `flag:"api-key-header" cfg:"api_key_header"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
 	Banner                   string   `flag:"banner" cfg:"banner"`
 	Footer                   string   `flag:"footer" cfg:"footer"`
 
+	LoginMaxFailures      int           `flag:"login-max-failures" cfg:"login_max_failures"`
+	LoginMaxFailuresPerIP int           `flag:"login-max-failures-per-ip" cfg:"login_max_failures_per_ip"`
+	LoginBackoff          time.Duration `flag:"login-backoff" cfg:"login_backoff"`
+	LoginLockout          time.Duration `flag:"login-lockout" cfg:"login_lockout"`
+
+	LDAPURL            string        `flag:"ldap-url" cfg:"ldap_url"`
+	LDAPStartTLS       bool          `flag:"ldap-start-tls" cfg:"ldap_start_tls"`
+	LDAPCAFile         string        `flag:"ldap-ca-file" cfg:"ldap_ca_file"`
+	LDAPBindDN         string        `flag:"ldap-bind-dn" cfg:"ldap_bind_dn"`
+	LDAPBindPassword   string        `flag:"ldap-bind-password" cfg:"ldap_bind_password" env:"OAUTH2_PROXY_LDAP_BIND_PASSWORD"`
+	LDAPBaseDN         string        `flag:"ldap-base-dn" cfg:"ldap_base_dn"`
+	LDAPUserFilter     string        `flag:"ldap-user-filter" cfg:"ldap_user_filter"`
+	LDAPEmailAttribute string        `flag:"ldap-email-attribute" cfg:"ldap_email_attribute"`
+	LDAPGroupAttribute string        `flag:"ldap-group-attribute" cfg:"ldap_group_attribute"`
+	LDAPPoolSize       int           `flag:"ldap-pool-size" cfg:"ldap_pool_size"`
+	LDAPTimeout        time.Duration `flag:"ldap-timeout" cfg:"ldap_timeout"`
+
 	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
 	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
 	CookieDomain   string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
@@ -62,12 +100,17 @@ type Options struct {
 	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
 	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password"`
 	PassAccessToken       bool     `flag:"pass-access-token" cfg:"pass_access_token"`
+	TokenExchanges        []string `flag:"token-exchange" cfg:"token_exchanges"`
 	PassHostHeader        bool     `flag:"pass-host-header" cfg:"pass_host_header"`
 	SkipProviderButton    bool     `flag:"skip-provider-button" cfg:"skip_provider_button"`
+	DeviceFlow            bool     `flag:"device-flow" cfg:"device_flow"`
 	PassUserHeaders       bool     `flag:"pass-user-headers" cfg:"pass_user_headers"`
 	SSLInsecureSkipVerify bool     `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify"`
 	SetXAuthRequest       bool     `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
+	ForwardAuth           bool     `flag:"forward-auth" cfg:"forward_auth"`
 	SkipAuthPreflight     bool     `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	TrustedIPs            []string `flag:"trusted-ip" cfg:"trusted_ips"`
+	TrustedProxyIPs       []string `flag:"trusted-proxy-ip" cfg:"trusted_proxy_ips"`
 
 	FlushInterval time.Duration `flag:"flush-interval" cfg:"flush_interval"`
 
@@ -79,6 +122,7 @@ type Options struct {
 	SkipOIDCDiscovery bool   `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery"`
 	LoginURL          string `flag:"login-url" cfg:"login_url"`
 	RedeemURL         string `flag:"redeem-url" cfg:"redeem_url"`
+	DeviceAuthURL     string `flag:"device-auth-url" cfg:"device_auth_url"`
 	ProfileURL        string `flag:"profile-url" cfg:"profile_url"`
 	ProtectedResource string `flag:"resource" cfg:"resource"`
 	ValidateURL       string `flag:"validate-url" cfg:"validate_url"`
@@ -86,18 +130,58 @@ type Options struct {
 	Prompt            string `flag:"prompt" cfg:"prompt"`
 	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt"` // Deprecated by OIDC 1.0
 
+	OIDCAcrValues   string   `flag:"oidc-acr-values" cfg:"oidc_acr_values"`
+	OIDCRequiredAcr []string `flag:"oidc-required-acr" cfg:"oidc_required_acr"`
+	OIDCRequiredAmr []string `flag:"oidc-required-amr" cfg:"oidc_required_amr"`
+	MaxAuthAge      []string `flag:"max-auth-age" cfg:"max_auth_age"`
+
+	SAMLIDPCertFile     string `flag:"saml-idp-cert-file" cfg:"saml_idp_cert_file"`
+	SAMLIDPEntityID     string `flag:"saml-idp-entity-id" cfg:"saml_idp_entity_id"`
+	SAMLEmailAttribute  string `flag:"saml-email-attribute" cfg:"saml_email_attribute"`
+	SAMLUserAttribute   string `flag:"saml-user-attribute" cfg:"saml_user_attribute"`
+	SAMLGroupsAttribute string `flag:"saml-groups-attribute" cfg:"saml_groups_attribute"`
+
 	RequestLogging       bool   `flag:"request-logging" cfg:"request_logging"`
 	RequestLoggingFormat string `flag:"request-logging-format" cfg:"request_logging_format"`
 	RealClientIPHeader   string `flag:"real-client-ip-header" cfg:"real_client_ip_header"`
 
 	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
 
+	// Providers are additional named providers, read from [[providers]]
+	// tables in the config file
+	Providers []ProviderOptions
+	// AuthorizationRules restrict paths to some users, read from
+	// [[authorization_rules]] tables in the config file
+	AuthorizationRules []AuthorizationRuleOptions
+	// AccessPolicies are expressions deciding access, read from
+	// [[access_policies]] tables in the config file
+	AccessPolicies []AccessPolicyOptions
+	// SkipAuthRules bypass authentication for some requests, read from
+	// [[skip_auth_rules]] tables in the config file
+	SkipAuthRules []SkipAuthRuleOptions
+
 	// internal values that are set after config validation
-	redirectURL   *url.URL
-	proxyURLs     []*url.URL
-	CompiledRegex []*regexp.Regexp
-	provider      providers.Provider
-	signatureData *SignatureData
+	redirectURL        *url.URL
+	upstreams          []*Upstream
+	CompiledRegex      []*regexp.Regexp
+	skipAuthRules      []*SkipAuthRule
+	trustedIPs         IPSet
+	clientIPResolver   *ClientIPResolver
+	ldap               *LDAPAuthenticator
+	provider           providers.Provider
+	namedProviders     []*NamedProvider
+	tokenExchanges     map[string]*TokenExchange
+	maxAuthAges        []*MaxAuthAge
+	authorizationRules []*AuthorizationRule
+	accessPolicies     []*AccessPolicy
+	signatureData      *SignatureData
+}
+
+// MaxAuthAge requires requests for paths matching Path to come from a
+// session whose user authenticated within Age
+type MaxAuthAge struct {
+	Path *regexp.Regexp
+	Age  time.Duration
 }
 
 type SignatureData struct {
@@ -105,6 +189,68 @@ type SignatureData struct {
 	key  string
 }
 
+// ProviderOptions configures one named provider. Settings not listed here,
+// such as the provider HTTP client, are shared with the top level provider.
+type ProviderOptions struct {
+	Name        string `toml:"name"`
+	DisplayName string `toml:"display_name"`
+
+	Provider                 string   `toml:"provider"`
+	ClientID                 string   `toml:"client_id"`
+	ClientSecret             string   `toml:"client_secret"`
+	ClientAuthMethod         string   `toml:"client_auth_method"`
+	ClientAssertionKeyFile   string   `toml:"client_assertion_key_file"`
+	ClientAssertionKeyID     string   `toml:"client_assertion_key_id"`
+	LoginURL                 string   `toml:"login_url"`
+	RedeemURL                string   `toml:"redeem_url"`
+	DeviceAuthURL            string   `toml:"device_auth_url"`
+	ProfileURL               string   `toml:"profile_url"`
+	ValidateURL              string   `toml:"validate_url"`
+	ProtectedResource        string   `toml:"resource"`
+	Scope                    string   `toml:"scope"`
+	Prompt                   string   `toml:"prompt"`
+	ApprovalPrompt           string   `toml:"approval_prompt"`
+	OIDCIssuerURL            string   `toml:"oidc_issuer_url"`
+	OIDCJwksURL              string   `toml:"oidc_jwks_url"`
+	SkipOIDCDiscovery        bool     `toml:"skip_oidc_discovery"`
+	OIDCAcrValues            string   `toml:"oidc_acr_values"`
+	OIDCRequiredAcr          []string `toml:"oidc_required_acr"`
+	OIDCRequiredAmr          []string `toml:"oidc_required_amr"`
+	AzureTenant              string   `toml:"azure_tenant"`
+	BitbucketTeam            string   `toml:"bitbucket_team"`
+	GitHubOrg                string   `toml:"github_org"`
+	GitHubTeams              []string `toml:"github_teams"`
+	GitLabGroups             []string `toml:"gitlab_groups"`
+	GoogleGroups             []string `toml:"google_groups"`
+	GoogleAdminEmail         string   `toml:"google_admin_email"`
+	GoogleServiceAccountJSON string   `toml:"google_service_account_json"`
+
+	// EmailDomains and AuthenticatedEmailsFile replace the top level email
+	// restrictions for users of this provider when either is set
+	EmailDomains            []string `toml:"email_domains"`
+	AuthenticatedEmailsFile string   `toml:"authenticated_emails_file"`
+}
+
+// NamedProvider is a provider offered on the sign in page. The top level
+// provider has an empty Name.
+type NamedProvider struct {
+	Name        string
+	DisplayName string
+	Provider    providers.Provider
+	Options     ProviderOptions
+}
+
+// LoadProviderOptions reads the [[providers]] tables of a config file
+func LoadProviderOptions(path string) ([]ProviderOptions, error) {
+	var cfg struct {
+		Providers []ProviderOptions `toml:"providers"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.Providers, err
+}
+
+var providerNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
 func NewOptions() *Options {
 	return &Options{
 		ProxyPrefix:          "/oauth2",
@@ -127,9 +273,27 @@ func NewOptions() *Options {
 		PassHostHeader:       true,
 		Prompt:               "", // Change to "login" when ApprovalPrompt deprecated/removed
 		ApprovalPrompt:       "force",
+		ProviderTimeout:      time.Duration(30) * time.Second,
+		ProviderDialTimeout:  time.Duration(30) * time.Second,
+		SAMLEmailAttribute:   "email",
+		SAMLGroupsAttribute:  "groups",
 		RequestLogging:       true,
 		RequestLoggingFormat: defaultRequestLoggingFormat,
 		RealClientIPHeader:   "X-Real-IP",
+		APIKeyHeader:         "X-API-Key",
+
+		LoginMaxFailures:      5,
+		LoginMaxFailuresPerIP: 20,
+		LoginBackoff:          time.Second,
+		LoginLockout:          15 * time.Minute,
+
+		TLSClientAuth: "optional",
+
+		LDAPUserFilter:     "(uid=%s)",
+		LDAPEmailAttribute: "mail",
+		LDAPGroupAttribute: "memberOf",
+		LDAPPoolSize:       4,
+		LDAPTimeout:        10 * time.Second,
 	}
 }
 
@@ -145,26 +309,22 @@ func parseURL(to_parse string, urltype string, msgs []string) (*url.URL, []strin
 func (o *Options) Validate() error {
 	msgs := make([]string, 0)
 
-	if o.SSLInsecureSkipVerify {
-		// TODO: Accept a certificate bundle.
-		default_transport, ok := http.DefaultTransport.(*http.Transport)
-		if ok {
-			default_transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		} else {
-			msgs = append(msgs, "error setting insecure tls config: DefaultTransport is unexpected type")
-		}
-	}
-
 	if o.CookieSecret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
-	if o.ClientID == "" {
+	if o.ClientID == "" && len(o.Providers) == 0 {
 		msgs = append(msgs, "missing setting: client-id")
 	}
-	if o.ClientSecret == "" {
+	if o.ClientAuthMethod == "" && o.ClientAssertionKeyFile != "" {
+		o.ClientAuthMethod = providers.PrivateKeyJWT
+	}
+	if o.ClientSecret == "" && (o.ClientID != "" || len(o.Providers) == 0) && o.Provider != "saml" && o.ClientAuthMethod != providers.PrivateKeyJWT {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
-	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
+	// emails read from the LDAP directory are validated like provider emails
+	ldapEmails := o.LDAPURL != "" && o.LDAPEmailAttribute != ""
+	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 &&
+		(ldapEmails || (o.HtpasswdFile == "" && o.LDAPURL == "" && o.TLSClientCAFile == "")) {
 		msgs = append(msgs, "missing setting for email validation: email-domain or authenticated-emails-file required."+
 			"\n      use email-domain=* to authorize all email addresses")
 	}
@@ -172,27 +332,45 @@ func (o *Options) Validate() error {
 	o.redirectURL, msgs = parseURL(o.RedirectURL, "redirect", msgs)
 
 	for _, u := range o.Upstreams {
-		upstreamURL, err := url.Parse(u)
+		upstream, err := parseUpstream(u)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("error parsing upstream: %s", err))
 		} else {
-			if upstreamURL.Path == "" {
-				upstreamURL.Path = "/"
-			}
-			o.proxyURLs = append(o.proxyURLs, upstreamURL)
+			o.upstreams = append(o.upstreams, upstream)
 		}
 	}
 
-	for _, u := range o.SkipAuthRegex {
-		CompiledRegex, err := regexp.Compile(u)
-		if err != nil {
-			msgs = append(msgs, fmt.Sprintf("error compiling regex=%q %s", u, err))
-			continue
+	msgs = parseTokenExchanges(o, msgs)
+	msgs = parseMaxAuthAges(o, msgs)
+	msgs = parseAuthorizationRules(o, msgs)
+	msgs = parseAccessPolicies(o, msgs)
+
+	msgs = parseSkipAuthRules(o, msgs)
+	o.trustedIPs, msgs = parseIPSet("trusted-ip", o.TrustedIPs, msgs)
+	trustedProxyIPs, msgs := parseIPSet("trusted-proxy-ip", o.TrustedProxyIPs, msgs)
+	o.clientIPResolver = &ClientIPResolver{Header: o.RealClientIPHeader, TrustedProxies: trustedProxyIPs}
+	msgs = parseLDAP(o, msgs)
+
+	if o.TLSClientCAFile != "" {
+		if o.TLSCertFile == "" {
+			msgs = append(msgs, "tls-client-ca-file requires tls-cert-file and tls-key-file")
 		}
-		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
+		if o.TLSClientAuth != "optional" && o.TLSClientAuth != "require" {
+			msgs = append(msgs, fmt.Sprintf("invalid tls-client-auth=%q expected optional or require", o.TLSClientAuth))
+		}
+	} else if o.TLSClientCRLFile != "" {
+		msgs = append(msgs, "tls-client-crl-file requires tls-client-ca-file")
 	}
 
-	msgs = parseProviderInfo(o, msgs)
+	// the top level provider is optional when named providers are configured
+	if o.ClientID != "" || len(o.Providers) == 0 {
+		msgs = parseProviderInfo(o, msgs)
+		o.namedProviders = []*NamedProvider{{
+			DisplayName: o.provider.Data().ProviderName,
+			Provider:    o.provider,
+		}}
+	}
+	msgs = parseNamedProviders(o, msgs)
 
 	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
 		valid_cookie_secret_size := false
@@ -242,6 +420,7 @@ func (o *Options) Validate() error {
 			"X-Real-IP",
 			"X-Forwarded-For",
 			"X-ProxyUser-IP",
+			"Forwarded",
 		}
 		for _, s := range realClientIPHeaders {
 			if o.RealClientIPHeader == s {
@@ -268,8 +447,11 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		Prompt:         o.Prompt,
 		ApprovalPrompt: o.ApprovalPrompt,
 	}
+	msgs = parseClientAuth(o, p, msgs)
+	msgs = parseProviderClient(o, p, msgs)
 	p.LoginURL, msgs = parseURL(o.LoginURL, "login", msgs)
 	p.RedeemURL, msgs = parseURL(o.RedeemURL, "redeem", msgs)
+	p.DeviceAuthURL, msgs = parseURL(o.DeviceAuthURL, "device-auth", msgs)
 	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
 	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
@@ -304,10 +486,26 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
 			}
 		}
+	case *providers.SAMLProvider:
+		p.IDPEntityID = o.SAMLIDPEntityID
+		p.EmailAttribute = o.SAMLEmailAttribute
+		p.UserAttribute = o.SAMLUserAttribute
+		p.GroupsAttribute = o.SAMLGroupsAttribute
+		if o.LoginURL == "" {
+			msgs = append(msgs, "missing setting: login-url")
+		}
+		if o.SAMLIDPCertFile == "" {
+			msgs = append(msgs, "missing setting: saml-idp-cert-file")
+		} else if err := p.SetIDPCertificateFile(o.SAMLIDPCertFile); err != nil {
+			msgs = append(msgs, err.Error())
+		}
 	case *providers.OIDCProvider:
 		if o.OIDCIssuerURL == "" {
 			msgs = append(msgs, "missing-setting: oidc-issuer-url")
 		}
+		p.AcrValues = o.OIDCAcrValues
+		p.RequiredAcr = o.OIDCRequiredAcr
+		p.RequiredAmr = o.OIDCRequiredAmr
 		if o.SkipOIDCDiscovery {
 			if o.LoginURL == "" {
 				msgs = append(msgs, "missing setting: login-url")
@@ -330,6 +528,199 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 			}
 		}
 	}
+	if _, ok := o.provider.(*providers.OIDCProvider); !ok {
+		if o.OIDCAcrValues != "" || len(o.OIDCRequiredAcr) != 0 || len(o.OIDCRequiredAmr) != 0 {
+			msgs = append(msgs, "oidc-acr-values, oidc-required-acr and oidc-required-amr require the oidc provider")
+		}
+	}
+	return msgs
+}
+
+// parseMaxAuthAges parses max-auth-age options of the form
+// "<path regex>=<duration>"
+func parseMaxAuthAges(o *Options, msgs []string) []string {
+	o.maxAuthAges = nil
+	for _, spec := range o.MaxAuthAge {
+		i := strings.LastIndex(spec, "=")
+		if i == -1 {
+			msgs = append(msgs, fmt.Sprintf("invalid max-auth-age=%q expected <path regex>=<duration>", spec))
+			continue
+		}
+		path, err := regexp.Compile(spec[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid max-auth-age=%q %s", spec, err))
+			continue
+		}
+		age, err := time.ParseDuration(spec[i+1:])
+		if err != nil || age <= 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid max-auth-age=%q duration must be positive", spec))
+			continue
+		}
+		o.maxAuthAges = append(o.maxAuthAges, &MaxAuthAge{Path: path, Age: age})
+	}
+	return msgs
+}
+
+func parseTokenExchanges(o *Options, msgs []string) []string {
+	if len(o.TokenExchanges) == 0 {
+		return msgs
+	}
+	if !o.PassAccessToken {
+		msgs = append(msgs, "token-exchange requires pass-access-token")
+	}
+	upstreams := make(map[string]bool)
+	for _, u := range o.upstreams {
+		upstreams[u.String()] = true
+	}
+	o.tokenExchanges = make(map[string]*TokenExchange)
+	for _, spec := range o.TokenExchanges {
+		te, err := parseTokenExchange(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid token-exchange=%q %s", spec, err))
+			continue
+		}
+		if !upstreams[te.Upstream] {
+			msgs = append(msgs, fmt.Sprintf("invalid token-exchange=%q upstream %q is not configured", spec, te.Upstream))
+			continue
+		}
+		o.tokenExchanges[te.Upstream] = te
+	}
+	return msgs
+}
+
+func parseNamedProviders(o *Options, msgs []string) []string {
+	seen := make(map[string]bool)
+	for i, po := range o.Providers {
+		prefix := fmt.Sprintf("providers[%d]", i)
+		if po.Name != "" {
+			prefix = fmt.Sprintf("providers[%s]", po.Name)
+		}
+		if !providerNameRegexp.MatchString(po.Name) {
+			msgs = append(msgs, fmt.Sprintf("%s: name must be set and contain only letters, digits, '-' or '_'", prefix))
+			continue
+		}
+		if seen[po.Name] {
+			msgs = append(msgs, fmt.Sprintf("%s: duplicate provider name", prefix))
+			continue
+		}
+		seen[po.Name] = true
+
+		// start from the top level options so shared settings carry over,
+		// then replace everything that is specific to a provider
+		c := *o
+		c.Provider = po.Provider
+		if c.Provider == "" {
+			c.Provider = "google"
+		}
+		c.ClientID = po.ClientID
+		c.ClientSecret = po.ClientSecret
+		c.ClientAuthMethod = po.ClientAuthMethod
+		c.ClientAssertionKeyFile = po.ClientAssertionKeyFile
+		c.ClientAssertionKeyID = po.ClientAssertionKeyID
+		c.LoginURL = po.LoginURL
+		c.RedeemURL = po.RedeemURL
+		c.DeviceAuthURL = po.DeviceAuthURL
+		c.ProfileURL = po.ProfileURL
+		c.ValidateURL = po.ValidateURL
+		c.ProtectedResource = po.ProtectedResource
+		c.Scope = po.Scope
+		c.Prompt = po.Prompt
+		c.ApprovalPrompt = po.ApprovalPrompt
+		if c.ApprovalPrompt == "" {
+			c.ApprovalPrompt = "force"
+		}
+		c.OIDCIssuerURL = po.OIDCIssuerURL
+		c.OIDCJwksURL = po.OIDCJwksURL
+		c.SkipOIDCDiscovery = po.SkipOIDCDiscovery
+		c.OIDCAcrValues = po.OIDCAcrValues
+		c.OIDCRequiredAcr = po.OIDCRequiredAcr
+		c.OIDCRequiredAmr = po.OIDCRequiredAmr
+		c.AzureTenant = po.AzureTenant
+		c.BitbucketTeam = po.BitbucketTeam
+		c.GitHubOrg = po.GitHubOrg
+		c.GitHubTeams = po.GitHubTeams
+		c.GitLabGroups = po.GitLabGroups
+		c.GoogleGroups = po.GoogleGroups
+		c.GoogleAdminEmail = po.GoogleAdminEmail
+		c.GoogleServiceAccountJSON = po.GoogleServiceAccountJSON
+		if c.ClientAuthMethod == "" && c.ClientAssertionKeyFile != "" {
+			c.ClientAuthMethod = providers.PrivateKeyJWT
+		}
+
+		var providerMsgs []string
+		if c.Provider == "saml" {
+			providerMsgs = append(providerMsgs, "saml is only supported as the top level provider")
+		}
+		if c.ClientID == "" {
+			providerMsgs = append(providerMsgs, "missing setting: client_id")
+		}
+		if c.ClientSecret == "" && c.ClientAuthMethod != providers.PrivateKeyJWT {
+			providerMsgs = append(providerMsgs, "missing setting: client_secret")
+		}
+		if len(providerMsgs) == 0 {
+			providerMsgs = parseProviderInfo(&c, providerMsgs)
+		}
+		if len(providerMsgs) != 0 {
+			for _, m := range providerMsgs {
+				msgs = append(msgs, fmt.Sprintf("%s: %s", prefix, m))
+			}
+			continue
+		}
+
+		displayName := po.DisplayName
+		if displayName == "" {
+			displayName = c.provider.Data().ProviderName
+		}
+		o.namedProviders = append(o.namedProviders, &NamedProvider{
+			Name:        po.Name,
+			DisplayName: displayName,
+			Provider:    c.provider,
+			Options:     po,
+		})
+	}
+	if len(o.namedProviders) != 0 {
+		o.provider = o.namedProviders[0].Provider
+	}
+	return msgs
+}
+
+func parseProviderClient(o *Options, p *providers.ProviderData, msgs []string) []string {
+	client, err := api.NewClient(api.ClientOptions{
+		CAFile:             o.ProviderCAFile,
+		CertFile:           o.ProviderClientCertFile,
+		KeyFile:            o.ProviderClientKeyFile,
+		InsecureSkipVerify: o.SSLInsecureSkipVerify,
+		Timeout:            o.ProviderTimeout,
+		DialTimeout:        o.ProviderDialTimeout,
+		ProxyURL:           o.ProviderProxy,
+	})
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error configuring provider http client: %s", err))
+	}
+	p.HTTPClient = client
+	return msgs
+}
+
+func parseClientAuth(o *Options, p *providers.ProviderData, msgs []string) []string {
+	switch o.ClientAuthMethod {
+	case "", providers.ClientSecretPost, providers.ClientSecretBasic:
+	case providers.PrivateKeyJWT:
+		if o.ClientAssertionKeyFile == "" {
+			return append(msgs, "missing setting: client-assertion-key-file")
+		}
+	default:
+		return append(msgs, fmt.Sprintf("unsupported client-auth-method %q", o.ClientAuthMethod))
+	}
+	p.ClientAuthMethod = o.ClientAuthMethod
+
+	if o.ClientAssertionKeyFile != "" {
+		key, err := providers.LoadClientAssertionKey(o.ClientAssertionKeyFile)
+		if err != nil {
+			return append(msgs, fmt.Sprintf("invalid client-assertion-key-file=%q %s", o.ClientAssertionKeyFile, err))
+		}
+		p.ClientAssertionKey = key
+		p.ClientAssertionKeyID = o.ClientAssertionKeyID
+	}
 	return msgs
 }
 
@@ -3,10 +3,16 @@ package main
 import (
 	"crypto"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -108,12 +114,60 @@ func TestProxyURLs(t *testing.T) {
 	o := testOptions()
 	o.Upstreams = append(o.Upstreams, "http://127.0.0.1:8081")
 	assert.Equal(t, nil, o.Validate())
-	expected := []*url.URL{
-		&url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/"},
+	expected := []*Upstream{
+		{URL: &url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/"}},
 		// note the '/' was added
-		&url.URL{Scheme: "http", Host: "127.0.0.1:8081", Path: "/"},
+		{URL: &url.URL{Scheme: "http", Host: "127.0.0.1:8081", Path: "/"}},
+	}
+	assert.Equal(t, expected, o.upstreams)
+}
+
+func TestHostUpstreams(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = append(o.Upstreams,
+		"Grafana.example.com=http://127.0.0.1:3000/",
+		"*.kibana.example.com=http://127.0.0.1:5601/app/?a=b",
+		"docs.example.com=file:///var/www/docs/#/docs/")
+	assert.Equal(t, nil, o.Validate())
+	expected := []*Upstream{
+		{URL: &url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/"}},
+		{Host: "grafana.example.com", URL: &url.URL{Scheme: "http", Host: "127.0.0.1:3000", Path: "/"}},
+		{Host: "*.kibana.example.com", URL: &url.URL{Scheme: "http", Host: "127.0.0.1:5601", Path: "/app/", RawQuery: "a=b"}},
+		{Host: "docs.example.com", URL: &url.URL{Scheme: "file", Path: "/var/www/docs/", Fragment: "/docs/"}},
+	}
+	assert.Equal(t, expected, o.upstreams)
+}
+
+func TestHostUpstreamsError(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = append(o.Upstreams, "a.*.example.com=http://127.0.0.1:3000/")
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `error parsing upstream: invalid host "a.*.example.com"`)
+}
+
+func TestHostSkipAuthRegex(t *testing.T) {
+	o := testOptions()
+	o.SkipAuthRegex = []string{"/foo/.*", "status.example.com=^/health$", "*.example.com=^/public/"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 1, len(o.CompiledRegex))
+	assert.Equal(t, "/foo/.*", o.CompiledRegex[0].String())
+	assert.Equal(t, 2, len(o.skipAuthRules))
+	assert.Equal(t, "status.example.com", o.skipAuthRules[0].Host)
+	assert.Equal(t, "^/health$", o.skipAuthRules[0].Path.String())
+	assert.Equal(t, "*.example.com", o.skipAuthRules[1].Host)
+}
+
+func TestSkipAuthRegexWithEquals(t *testing.T) {
+	o := testOptions()
+	o.SkipAuthRegex = []string{"(?i)a=b", "^/search\\?q=", "[a-z]+=1"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 0, len(o.skipAuthRules))
+	if assert.Equal(t, 3, len(o.CompiledRegex)) {
+		assert.Equal(t, "(?i)a=b", o.CompiledRegex[0].String())
+		assert.Equal(t, "^/search\\?q=", o.CompiledRegex[1].String())
+		assert.Equal(t, "[a-z]+=1", o.CompiledRegex[2].String())
 	}
-	assert.Equal(t, expected, o.proxyURLs)
 }
 
 func TestProxyURLsError(t *testing.T) {
@@ -287,6 +341,240 @@ func TestSkipOIDCDiscovery(t *testing.T) {
 	assert.Equal(t, nil, o.Validate())
 }
 
+func TestClientAuthMethodUnsupported(t *testing.T) {
+	o := testOptions()
+	o.ClientAuthMethod = "tls_client_auth"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{`unsupported client-auth-method "tls_client_auth"`}), err.Error())
+}
+
+func TestPrivateKeyJWTRequiresKeyFile(t *testing.T) {
+	o := testOptions()
+	o.ClientSecret = ""
+	o.ClientAuthMethod = "private_key_jwt"
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{"missing setting: client-assertion-key-file"}), err.Error())
+}
+
+func TestClientAssertionKeyFileMakesSecretOptional(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f, _ := ioutil.TempFile("", "client-assertion-key")
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	f.Close()
+
+	o := testOptions()
+	o.ClientSecret = ""
+	o.ClientAssertionKeyFile = f.Name()
+	o.ClientAssertionKeyID = "key-1"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "private_key_jwt", o.ClientAuthMethod)
+	assert.Equal(t, "private_key_jwt", o.provider.Data().ClientAuthMethod)
+	assert.Equal(t, "key-1", o.provider.Data().ClientAssertionKeyID)
+	assert.NotEqual(t, nil, o.provider.Data().ClientAssertionKey)
+}
+
+func TestProviderHTTPClient(t *testing.T) {
+	o := testOptions()
+	o.ProviderTimeout = 5 * time.Second
+	assert.Equal(t, nil, o.Validate())
+	client := o.provider.Data().Client()
+	assert.NotEqual(t, http.DefaultClient, client)
+	assert.Equal(t, 5*time.Second, client.Timeout)
+}
+
+func TestProviderHTTPClientInvalid(t *testing.T) {
+	o := testOptions()
+	o.ProviderClientCertFile = "client.pem"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"error configuring provider http client: " +
+		"both a client certificate and key are required for mTLS"}), err.Error())
+}
+
+func TestSSLInsecureSkipVerifyLeavesDefaultTransport(t *testing.T) {
+	o := testOptions()
+	o.SSLInsecureSkipVerify = true
+	assert.Equal(t, nil, o.Validate())
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil {
+		assert.False(t, c.InsecureSkipVerify)
+	}
+	transport := o.provider.Data().Client().Transport.(*http.Transport)
+	assert.True(t, transport.TLSClientConfig.InsecureSkipVerify)
+}
+
+func TestTokenExchange(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/", "http://127.0.0.1:8081"}
+	o.PassAccessToken = true
+	o.CookieSecret = "0123456789abcdef"
+	o.TokenExchanges = []string{"upstream=http://127.0.0.1:8081,audience=orders-api"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, map[string]*TokenExchange{
+		"http://127.0.0.1:8081/": {Upstream: "http://127.0.0.1:8081/", Audience: "orders-api"},
+	}, o.tokenExchanges)
+}
+
+func TestTokenExchangeHostUpstream(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8081/", "orders.example.com=http://127.0.0.1:8081/"}
+	o.PassAccessToken = true
+	o.CookieSecret = "0123456789abcdef"
+	o.TokenExchanges = []string{"upstream=orders.example.com=http://127.0.0.1:8081,audience=orders-api"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, map[string]*TokenExchange{
+		"orders.example.com=http://127.0.0.1:8081/": {Upstream: "orders.example.com=http://127.0.0.1:8081/", Audience: "orders-api"},
+	}, o.tokenExchanges)
+
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+	for _, host := range []string{"orders.example.com", "app.example.com"} {
+		req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+		h, _ := proxy.serveMux.(*HostMux).Handler(req)
+		assert.Equal(t, host == "orders.example.com", h.(*UpstreamProxy).tokenExchange != nil, host)
+	}
+
+	o.TokenExchanges = []string{"upstream=grafana.example.com=http://127.0.0.1:8081,audience=orders-api"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `upstream "grafana.example.com=http://127.0.0.1:8081/" is not configured`)
+}
+
+func TestTokenExchangeInvalid(t *testing.T) {
+	o := testOptions()
+	o.TokenExchanges = []string{
+		"upstream=http://127.0.0.1:9000/,audience=orders-api",
+		"upstream=http://127.0.0.1:8080/",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"token-exchange requires pass-access-token",
+		"invalid token-exchange=\"upstream=http://127.0.0.1:9000/,audience=orders-api\" " +
+			"upstream \"http://127.0.0.1:9000/\" is not configured",
+		"invalid token-exchange=\"upstream=http://127.0.0.1:8080/\" " +
+			"one of audience, resource or scope is required",
+	}), err.Error())
+}
+
+func TestMaxAuthAge(t *testing.T) {
+	o := testOptions()
+	o.MaxAuthAge = []string{"^/admin/=15m", "^/a=b/=1h"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.maxAuthAges))
+	assert.Equal(t, "^/admin/", o.maxAuthAges[0].Path.String())
+	assert.Equal(t, 15*time.Minute, o.maxAuthAges[0].Age)
+	assert.Equal(t, "^/a=b/", o.maxAuthAges[1].Path.String())
+	assert.Equal(t, time.Hour, o.maxAuthAges[1].Age)
+}
+
+func TestMaxAuthAgeInvalid(t *testing.T) {
+	o := testOptions()
+	o.MaxAuthAge = []string{"^/admin/", "^/admin/=soon", "^/admin/=-1m", "(=1m"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"invalid max-auth-age=\"^/admin/\" expected <path regex>=<duration>",
+		"invalid max-auth-age=\"^/admin/=soon\" duration must be positive",
+		"invalid max-auth-age=\"^/admin/=-1m\" duration must be positive",
+		"invalid max-auth-age=\"(=1m\" error parsing regexp: missing closing ): `(`",
+	}), err.Error())
+}
+
+func TestOIDCAuthContextRequiresOIDC(t *testing.T) {
+	o := testOptions()
+	o.OIDCRequiredAmr = []string{"otp"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"oidc-acr-values, oidc-required-acr and oidc-required-amr require the oidc provider",
+	}), err.Error())
+}
+
+func TestNamedProviders(t *testing.T) {
+	o := testOptions()
+	o.Providers = []ProviderOptions{{
+		Name:         "contractors",
+		Provider:     "github",
+		ClientID:     "github-client",
+		ClientSecret: "github-secret",
+		GitHubOrg:    "acme",
+	}}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.namedProviders))
+	assert.Equal(t, "", o.namedProviders[0].Name)
+	assert.Equal(t, "Google", o.namedProviders[0].DisplayName)
+	assert.Equal(t, "contractors", o.namedProviders[1].Name)
+	assert.Equal(t, "GitHub", o.namedProviders[1].DisplayName)
+	assert.Equal(t, "github-client", o.namedProviders[1].Provider.Data().ClientID)
+	assert.Equal(t, "bazquux", o.provider.Data().ClientID)
+}
+
+func TestNamedProvidersWithoutTopLevelProvider(t *testing.T) {
+	o := testOptions()
+	o.ClientID = ""
+	o.ClientSecret = ""
+	o.Providers = []ProviderOptions{
+		{Name: "employees", ClientID: "google-client", ClientSecret: "google-secret"},
+		{Name: "contractors", Provider: "github", ClientID: "github-client", ClientSecret: "github-secret"},
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.namedProviders))
+	assert.Equal(t, "employees", o.namedProviders[0].Name)
+	assert.Equal(t, "google-client", o.provider.Data().ClientID)
+}
+
+func TestNamedProvidersInvalid(t *testing.T) {
+	o := testOptions()
+	o.Providers = []ProviderOptions{
+		{ClientID: "a", ClientSecret: "b"},
+		{Name: "bad name", ClientID: "a", ClientSecret: "b"},
+		{Name: "one", Provider: "github"},
+		{Name: "two", Provider: "github", ClientID: "a", ClientSecret: "b"},
+		{Name: "two", Provider: "github", ClientID: "a", ClientSecret: "b"},
+		{Name: "idp", Provider: "saml", ClientID: "a", ClientSecret: "b"},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"providers[0]: name must be set and contain only letters, digits, '-' or '_'",
+		"providers[bad name]: name must be set and contain only letters, digits, '-' or '_'",
+		"providers[one]: missing setting: client_id",
+		"providers[one]: missing setting: client_secret",
+		"providers[two]: duplicate provider name",
+		"providers[idp]: saml is only supported as the top level provider",
+	}), err.Error())
+}
+
+func TestLoadProviderOptions(t *testing.T) {
+	f, _ := ioutil.TempFile("", "oauth2_proxy.cfg")
+	defer os.Remove(f.Name())
+	f.WriteString(`
+client_id = "top-level"
+
+[[providers]]
+name = "contractors"
+display_name = "Contractors"
+provider = "github"
+client_id = "github-client"
+client_secret = "github-secret"
+github_teams = ["a", "b"]
+email_domains = ["contractor.com"]
+`)
+	f.Close()
+
+	providerOptions, err := LoadProviderOptions(f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []ProviderOptions{{
+		Name:         "contractors",
+		DisplayName:  "Contractors",
+		Provider:     "github",
+		ClientID:     "github-client",
+		ClientSecret: "github-secret",
+		GitHubTeams:  []string{"a", "b"},
+		EmailDomains: []string{"contractor.com"},
+	}}, providerOptions)
+}
+
 func TestSecretBytesEncoded(t *testing.T) {
 	for _, secretSize := range []int{16, 24, 32} {
 		t.Run(fmt.Sprintf("%d", secretSize), func(t *testing.T) {
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+// checkPassword validates user and password against the htpasswd file, then
+// the LDAP directory, and records the outcome with the login limiters. It
+// returns the session of a valid password.
+func (p *OAuthProxy) checkPassword(req *http.Request, user, password string) *providers.SessionState {
+	remoteAddr := p.getRemoteAddr(req)
+	var session *providers.SessionState
+	if p.HtpasswdFile != nil && p.HtpasswdFile.Validate(user, password) {
+		session = &providers.SessionState{User: user, Subject: user, AuthTime: time.Now()}
+	} else if p.LDAP != nil {
+		var err error
+		session, err = p.LDAP.Authenticate(user, password)
+		if err != nil && err != ErrInvalidCredentials {
+			// the directory being unavailable is not a failed login
+			log.Printf("%s error authenticating %q via LDAP: %s", remoteAddr, user, err)
+			return nil
+		}
+	}
+	if session != nil {
+		p.userLoginLimiter.Success(user)
+		p.ipLoginLimiter.Success(p.clientIP(req))
+		return session
+	}
+	if d := p.userLoginLimiter.Failure(user); d > 0 {
+		log.Printf("%s security: locking out user %q for %s after repeated failed logins", remoteAddr, user, d)
+	}
+	if d := p.ipLoginLimiter.Failure(p.clientIP(req)); d > 0 {
+		log.Printf("%s security: locking out client %s for %s after repeated failed logins", remoteAddr, p.clientIP(req), d)
+	}
+	return nil
+}
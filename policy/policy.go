@@ -0,0 +1,223 @@
+// Package policy evaluates access policies written in the Common Expression
+// Language (https://github.com/google/cel-spec):
+//
+//	"admins" in groups || email.endsWith("@sre.example.com") && request.method == "GET"
+//
+// Expressions are type checked against a declared environment when compiled,
+// have no side effects and always evaluate in bounded time.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/interpreter/functions"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// Input is what an expression is evaluated against
+type Input struct {
+	Email    string
+	User     string
+	Groups   []string
+	Provider string
+	Request  Request
+}
+
+// Request describes the HTTP request being authorized
+type Request struct {
+	Host   string
+	Path   string
+	Method string
+	IP     string
+}
+
+// requestFields are the fields of the request variable
+var requestFields = map[string]bool{"host": true, "path": true, "method": true, "ip": true}
+
+var env = mustEnv(cel.Declarations(
+	decls.NewVar("email", decls.String),
+	decls.NewVar("user", decls.String),
+	decls.NewVar("groups", decls.NewListType(decls.String)),
+	decls.NewVar("provider", decls.String),
+	decls.NewVar("request", decls.NewMapType(decls.String, decls.String)),
+	decls.NewFunction("inCIDR",
+		decls.NewInstanceOverload("string_inCIDR_string", []*exprpb.Type{decls.String, decls.String}, decls.Bool)),
+))
+
+func mustEnv(opts ...cel.EnvOption) *cel.Env {
+	e, err := cel.NewEnv(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// inCIDR reports whether the IP address ip is in the network cidr. Strings
+// that are not IP addresses are in no network.
+func inCIDR(ip, cidr ref.Val) ref.Val {
+	addr, ok := ip.(types.String)
+	network, ok2 := cidr.(types.String)
+	if !ok || !ok2 {
+		return types.NoSuchOverloadErr()
+	}
+	_, n, err := net.ParseCIDR(string(network))
+	if err != nil {
+		return types.NewErr("invalid CIDR address %q", network)
+	}
+	parsed := net.ParseIP(string(addr))
+	return types.Bool(parsed != nil && n.Contains(parsed))
+}
+
+// Program is a compiled expression
+type Program struct {
+	source  string
+	program cel.Program
+}
+
+// Compile parses and type checks an expression, which must be a bool
+func Compile(source string) (*Program, error) {
+	if !utf8.ValidString(source) {
+		return nil, fmt.Errorf("expression is not valid UTF-8")
+	}
+	ast, issues := env.Compile(source)
+	if err := issuesError(issues); err != nil {
+		return nil, err
+	}
+	if ast.ResultType().GetPrimitive() != exprpb.Type_BOOL {
+		return nil, fmt.Errorf("expression must be a bool, not a %s", cel.FormatType(ast.ResultType()))
+	}
+	if err := checkLiterals(ast.Expr()); err != nil {
+		return nil, err
+	}
+	program, err := env.Program(ast, cel.Functions(&functions.Overload{Operator: "string_inCIDR_string", Binary: inCIDR}))
+	if err != nil {
+		return nil, err
+	}
+	return &Program{source: source, program: program}, nil
+}
+
+// issuesError returns the compile errors in issues as one line
+func issuesError(issues *cel.Issues) error {
+	if issues.Err() == nil {
+		return nil
+	}
+	var msgs []string
+	for _, e := range issues.Errors() {
+		msgs = append(msgs, fmt.Sprintf("%d:%d: %s", e.Location.Line(), e.Location.Column()+1, e.Message))
+	}
+	return fmt.Errorf("%s", strings.Join(msgs, "; "))
+}
+
+// checkLiterals rejects what the type checker lets through but would fail at
+// every evaluation: unknown request fields, and invalid regular expression
+// and CIDR literals. inCIDR only takes literals.
+func checkLiterals(e *exprpb.Expr) error {
+	switch k := e.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		if id := k.SelectExpr.GetOperand().GetIdentExpr(); id != nil && id.GetName() == "request" && !requestFields[k.SelectExpr.GetField()] {
+			return fmt.Errorf("request has no field %q", k.SelectExpr.GetField())
+		}
+		return checkLiterals(k.SelectExpr.GetOperand())
+	case *exprpb.Expr_CallExpr:
+		call := k.CallExpr
+		switch call.GetFunction() {
+		case "_[_]":
+			if id := call.GetArgs()[0].GetIdentExpr(); id != nil && id.GetName() == "request" {
+				key := call.GetArgs()[1].GetConstExpr()
+				if key == nil || !requestFields[key.GetStringValue()] {
+					return fmt.Errorf("request fields must be one of host, path, method or ip")
+				}
+			}
+		case "matches":
+			if lit := call.GetArgs()[len(call.GetArgs())-1].GetConstExpr(); lit != nil {
+				if _, err := regexp.Compile(lit.GetStringValue()); err != nil {
+					return fmt.Errorf("matches: %s", err)
+				}
+			}
+		case "inCIDR":
+			lit := call.GetArgs()[0].GetConstExpr()
+			if lit == nil {
+				return fmt.Errorf("inCIDR requires a string literal")
+			}
+			if _, _, err := net.ParseCIDR(lit.GetStringValue()); err != nil {
+				return fmt.Errorf("inCIDR: %s", err)
+			}
+		}
+		if call.GetTarget() != nil {
+			if err := checkLiterals(call.GetTarget()); err != nil {
+				return err
+			}
+		}
+		for _, arg := range call.GetArgs() {
+			if err := checkLiterals(arg); err != nil {
+				return err
+			}
+		}
+	case *exprpb.Expr_ListExpr:
+		for _, el := range k.ListExpr.GetElements() {
+			if err := checkLiterals(el); err != nil {
+				return err
+			}
+		}
+	case *exprpb.Expr_StructExpr:
+		for _, entry := range k.StructExpr.GetEntries() {
+			if entry.GetMapKey() != nil {
+				if err := checkLiterals(entry.GetMapKey()); err != nil {
+					return err
+				}
+			}
+			if err := checkLiterals(entry.GetValue()); err != nil {
+				return err
+			}
+		}
+	case *exprpb.Expr_ComprehensionExpr:
+		c := k.ComprehensionExpr
+		for _, sub := range []*exprpb.Expr{c.GetIterRange(), c.GetAccuInit(), c.GetLoopCondition(), c.GetLoopStep(), c.GetResult()} {
+			if err := checkLiterals(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Eval reports whether the expression holds for in. An expression that
+// fails to evaluate returns an error.
+func (p *Program) Eval(in *Input) (bool, error) {
+	groups := in.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	out, _, err := p.program.Eval(map[string]interface{}{
+		"email":    in.Email,
+		"user":     in.User,
+		"groups":   groups,
+		"provider": in.Provider,
+		"request": map[string]string{
+			"host":   in.Request.Host,
+			"path":   in.Request.Path,
+			"method": in.Request.Method,
+			"ip":     in.Request.IP,
+		},
+	})
+	if err != nil {
+		return false, err
+	}
+	b, ok := out.(types.Bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned a %s, not a bool", out.Type().TypeName())
+	}
+	return bool(b), nil
+}
+
+func (p *Program) String() string {
+	return p.source
+}
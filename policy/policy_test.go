@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testInput = &Input{
+	Email:    "jane@sre.example.com",
+	User:     "jane",
+	Groups:   []string{"admins", "dev"},
+	Provider: "corp",
+	Request: Request{
+		Host:   "grafana.example.com",
+		Path:   "/api/dashboards",
+		Method: "GET",
+		IP:     "10.1.2.3",
+	},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`true`, true},
+		{`!true`, false},
+		{`"admins" in groups`, true},
+		{`"ops" in groups`, false},
+		{`email.endsWith("@sre.example.com")`, true},
+		{`email.startsWith('jane@')`, true},
+		{`request.path.contains("dash")`, true},
+		{`request.method == "GET"`, true},
+		{`request["method"] != "GET"`, false},
+		{`request.host.matches("^[a-z]+\\.example\\.com$")`, true},
+		{`request.ip.inCIDR("10.0.0.0/8")`, true},
+		{`request.ip.inCIDR("fd00::/8")`, false},
+		{`user in ["jane", "bob"]`, true},
+		{`provider == "corp" && size(groups) >= 2`, true},
+		{`size(user) < 4`, false},
+		{`"b" > "a"`, true},
+		{`'it\'s' == "it's"`, true},
+		{`groups.exists(g, g.startsWith("adm"))`, true},
+		{`"é" in ["é"] && size("é") == 1`, true},
+	}
+	for _, tc := range tests {
+		p, err := Compile(tc.expr)
+		if !assert.Equal(t, nil, err, tc.expr) {
+			continue
+		}
+		got, err := p.Eval(testInput)
+		assert.Equal(t, nil, err, tc.expr)
+		assert.Equal(t, tc.want, got, tc.expr)
+		assert.Equal(t, tc.expr, p.String())
+	}
+}
+
+func TestEvalPrecedence(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// && binds tighter than ||
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false && true || true`, true},
+		{`false && (true || true)`, false},
+		// ! binds tighter than && and comparisons tighter than both
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`1 + 2 * 3 == 7`, true},
+		{`"ops" in groups || email.endsWith("@sre.example.com") && request.method == "POST"`, false},
+		{`("ops" in groups || email.endsWith("@sre.example.com")) && request.method == "GET"`, true},
+		{`true ? false : true`, false},
+	}
+	for _, tc := range tests {
+		p, err := Compile(tc.expr)
+		if !assert.Equal(t, nil, err, tc.expr) {
+			continue
+		}
+		got, err := p.Eval(testInput)
+		assert.Equal(t, nil, err, tc.expr)
+		assert.Equal(t, tc.want, got, tc.expr)
+	}
+}
+
+func TestEvalEmptyInput(t *testing.T) {
+	p, err := Compile(`"admins" in groups || request.ip.inCIDR("10.0.0.0/8")`)
+	assert.Equal(t, nil, err)
+	got, err := p.Eval(&Input{})
+	assert.Equal(t, nil, err)
+	assert.False(t, got)
+}
+
+func TestEvalError(t *testing.T) {
+	p, err := Compile(`size(groups) / (size(groups) - 2) == 1`)
+	assert.Equal(t, nil, err)
+	_, err = p.Eval(testInput)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCompileTypeErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{`email`, "expression must be a bool, not a string"},
+		{`size(groups)`, "expression must be a bool, not a int"},
+		{`admin in groups`, "undeclared reference to 'admin'"},
+		{`groups in "admins"`, "found no matching overload for '@in'"},
+		{`email == 1`, "found no matching overload for '_==_'"},
+		{`true && "x"`, "found no matching overload for '_&&_'"},
+		{`!email`, "found no matching overload for '!_'"},
+		{`email.upper() == ""`, "undeclared reference to 'upper'"},
+		{`email.endsWith(1)`, "found no matching overload for 'endsWith'"},
+		{`request.port == "80"`, `request has no field "port"`},
+		{`request[user] == "80"`, "request fields must be one of"},
+		{`request.ip.inCIDR(user)`, "inCIDR requires a string literal"},
+		{`request.ip.inCIDR("10.0.0.0")`, "inCIDR: invalid CIDR address"},
+		{`email.matches("(")`, "matches: error parsing regexp"},
+	}
+	for _, tc := range tests {
+		_, err := Compile(tc.expr)
+		if assert.NotEqual(t, nil, err, tc.expr) {
+			assert.Contains(t, err.Error(), tc.err, tc.expr)
+		}
+	}
+}
+
+func TestCompileMalformed(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`(true`,
+		`true true`,
+		`email == "x`,
+		`email # "x"`,
+		`"admins" in`,
+		`&& true`,
+		`email.`,
+		`[1, 2`,
+		"email == \"\xff\"",
+		`é == "x"`,
+	} {
+		_, err := Compile(expr)
+		assert.NotEqual(t, nil, err, expr)
+	}
+}
@@ -97,7 +97,7 @@ func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
 	}
 	req.Header = getAzureHeader(s.AccessToken)
 
-	json, err := api.Request(req)
+	json, err := api.Request(p.Client(), req)
 
 	if err != nil {
 		return "", err
@@ -65,7 +65,7 @@ func (p *BitbucketProvider) GetEmailAddress(s *SessionState) (string, error) {
 		log.Printf("failed building request %s", err)
 		return "", err
 	}
-	err = api.RequestJson(req, &emails)
+	err = api.RequestJson(p.Client(), req, &emails)
 	if err != nil {
 		log.Printf("failed making request %s", err)
 		return "", err
@@ -81,7 +81,7 @@ func (p *BitbucketProvider) GetEmailAddress(s *SessionState) (string, error) {
 			log.Printf("failed building request %s", err)
 			return "", err
 		}
-		err = api.RequestJson(req, &teams)
+		err = api.RequestJson(p.Client(), req, &teams)
 		if err != nil {
 			log.Printf("failed requesting teams membership %s", err)
 			return "", err
@@ -0,0 +1,153 @@
+package providers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/cookie"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Client authentication methods for the token endpoint, as registered for
+// token_endpoint_auth_method in RFC 7591
+const (
+	ClientSecretPost  = "client_secret_post"
+	ClientSecretBasic = "client_secret_basic"
+	PrivateKeyJWT     = "private_key_jwt"
+
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime = 5 * time.Minute
+)
+
+// LoadClientAssertionKey reads a PEM encoded RSA or EC private key used to
+// sign private_key_jwt client assertions
+func LoadClientAssertionKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case *ecdsa.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func clientAssertionAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported client assertion key type %T", key)
+}
+
+// clientAssertion builds the signed JWT sent as client_assertion, with the
+// token endpoint as its audience
+func (p *ProviderData) clientAssertion() (string, error) {
+	if p.ClientAssertionKey == nil {
+		return "", errors.New("missing client assertion key")
+	}
+	alg, err := clientAssertionAlgorithm(p.ClientAssertionKey)
+	if err != nil {
+		return "", err
+	}
+	opts := &jose.SignerOptions{}
+	opts.WithType("JWT")
+	if p.ClientAssertionKeyID != "" {
+		opts.WithHeader("kid", p.ClientAssertionKeyID)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: p.ClientAssertionKey}, opts)
+	if err != nil {
+		return "", err
+	}
+	jti, err := cookie.Nonce()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   p.ClientID,
+		Subject:  p.ClientID,
+		Audience: jwt.Audience{p.RedeemURL.String()},
+		ID:       jti,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// newTokenRequest builds a POST to the token endpoint carrying params and
+// the client credentials. defaultMethod is used when no ClientAuthMethod is
+// configured.
+func (p *ProviderData) newTokenRequest(params url.Values, defaultMethod string) (*http.Request, error) {
+	method := p.ClientAuthMethod
+	if method == "" {
+		method = defaultMethod
+	}
+
+	switch method {
+	case ClientSecretPost:
+		params.Set("client_id", p.ClientID)
+		params.Set("client_secret", p.ClientSecret)
+	case ClientSecretBasic:
+	case PrivateKeyJWT:
+		assertion, err := p.clientAssertion()
+		if err != nil {
+			return nil, fmt.Errorf("could not sign client assertion: %v", err)
+		}
+		params.Set("client_id", p.ClientID)
+		params.Set("client_assertion_type", clientAssertionType)
+		params.Set("client_assertion", assertion)
+	default:
+		return nil, fmt.Errorf("unsupported client authentication method %q", method)
+	}
+
+	req, err := http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if method == ClientSecretBasic {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	return req, nil
+}
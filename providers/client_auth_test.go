@@ -0,0 +1,160 @@
+package providers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+type tokenEndpointTest struct {
+	server  *httptest.Server
+	request *http.Request
+	form    url.Values
+}
+
+func newTokenEndpointTest() *tokenEndpointTest {
+	test := &tokenEndpointTest{}
+	test.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		test.request = r
+		test.form = r.PostForm
+		w.Write([]byte(`{"access_token": "a1b2c3d4"}`))
+	}))
+	return test
+}
+
+func (test *tokenEndpointTest) providerData() *ProviderData {
+	redeemURL, _ := url.Parse(test.server.URL + "/token")
+	return &ProviderData{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedeemURL:    redeemURL,
+	}
+}
+
+func TestRedeemClientSecretPost(t *testing.T) {
+	test := newTokenEndpointTest()
+	defer test.server.Close()
+
+	session, err := test.providerData().Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1b2c3d4", session.AccessToken)
+	assert.Equal(t, "client", test.form.Get("client_id"))
+	assert.Equal(t, "secret", test.form.Get("client_secret"))
+	assert.Equal(t, "", test.request.Header.Get("Authorization"))
+}
+
+func TestRedeemClientSecretBasic(t *testing.T) {
+	test := newTokenEndpointTest()
+	defer test.server.Close()
+	p := test.providerData()
+	p.ClientAuthMethod = ClientSecretBasic
+
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	user, pass, ok := test.request.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "client", user)
+	assert.Equal(t, "secret", pass)
+	assert.Equal(t, "", test.form.Get("client_secret"))
+}
+
+func testPrivateKeyJWT(t *testing.T, key crypto.Signer, alg jose.SignatureAlgorithm) {
+	test := newTokenEndpointTest()
+	defer test.server.Close()
+	p := test.providerData()
+	p.ClientSecret = ""
+	p.ClientAuthMethod = PrivateKeyJWT
+	p.ClientAssertionKey = key
+	p.ClientAssertionKeyID = "key-1"
+
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", test.request.Header.Get("Authorization"))
+	assert.Equal(t, "", test.form.Get("client_secret"))
+	assert.Equal(t, "client", test.form.Get("client_id"))
+	assert.Equal(t, clientAssertionType, test.form.Get("client_assertion_type"))
+
+	token, err := jwt.ParseSigned(test.form.Get("client_assertion"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(alg), token.Headers[0].Algorithm)
+	assert.Equal(t, "key-1", token.Headers[0].KeyID)
+
+	var claims jwt.Claims
+	assert.Equal(t, nil, token.Claims(key.Public(), &claims))
+	assert.Equal(t, nil, claims.Validate(jwt.Expected{
+		Issuer:   "client",
+		Subject:  "client",
+		Audience: jwt.Audience{p.RedeemURL.String()},
+	}))
+	assert.NotEqual(t, "", claims.ID)
+}
+
+func TestRedeemPrivateKeyJWTWithRSAKey(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	testPrivateKeyJWT(t, key, jose.RS256)
+}
+
+func TestRedeemPrivateKeyJWTWithECKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	testPrivateKeyJWT(t, key, jose.ES384)
+}
+
+func TestRedeemPrivateKeyJWTWithoutKey(t *testing.T) {
+	test := newTokenEndpointTest()
+	defer test.server.Close()
+	p := test.providerData()
+	p.ClientAuthMethod = PrivateKeyJWT
+
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.NotEqual(t, nil, err)
+	assert.Nil(t, test.request)
+}
+
+func writeKeyFile(t *testing.T, blockType string, der []byte) string {
+	f, err := ioutil.TempFile("", "client-assertion-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	return f.Name()
+}
+
+func TestLoadClientAssertionKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+	pkcs8DER, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+
+	files := map[string]string{
+		"pkcs1": writeKeyFile(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+		"ec":    writeKeyFile(t, "EC PRIVATE KEY", ecDER),
+		"pkcs8": writeKeyFile(t, "PRIVATE KEY", pkcs8DER),
+	}
+	for name, path := range files {
+		defer os.Remove(path)
+		key, err := LoadClientAssertionKey(path)
+		assert.Equal(t, nil, err, name)
+		assert.NotEqual(t, nil, key, name)
+	}
+
+	bad := writeKeyFile(t, "CERTIFICATE", []byte("nope"))
+	defer os.Remove(bad)
+	_, err := LoadClientAssertionKey(bad)
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,167 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DeviceCodeGrantType is the grant_type used to poll the token endpoint
+// during a device authorization (RFC 8628)
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceAuthorization is the response to a device authorization request
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// DeviceError is an error returned by the token endpoint while polling with
+// a device code, such as "authorization_pending" or "slow_down"
+type DeviceError struct {
+	Code        string
+	Description string
+}
+
+func (e *DeviceError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Description)
+	}
+	return e.Code
+}
+
+// deviceTokenResponse covers both the successful and the error token
+// responses; some providers (GitHub) report errors with a 200 status
+type deviceTokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	TokenType        string      `json:"token_type"`
+	RefreshToken     string      `json:"refresh_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	IDToken          string      `json:"id_token"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+// StartDeviceAuthorization asks the provider for a device and user code
+func (p *ProviderData) StartDeviceAuthorization() (*DeviceAuthorization, error) {
+	if p.DeviceAuthURL == nil || p.DeviceAuthURL.String() == "" {
+		return nil, errors.New("device authorization is not supported by this provider")
+	}
+	params := url.Values{}
+	params.Set("client_id", p.ClientID)
+	params.Set("scope", p.Scope)
+	req, err := http.NewRequest("POST", p.DeviceAuthURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.DeviceAuthURL.String(), body)
+	}
+
+	var auth struct {
+		DeviceAuthorization
+		// Google uses verification_url instead of verification_uri
+		VerificationURL string `json:"verification_url"`
+	}
+	if err := json.Unmarshal(body, &auth); err != nil {
+		return nil, err
+	}
+	if auth.VerificationURI == "" {
+		auth.VerificationURI = auth.VerificationURL
+	}
+	if auth.DeviceCode == "" || auth.UserCode == "" || auth.VerificationURI == "" {
+		return nil, fmt.Errorf("incomplete device authorization response %s", body)
+	}
+	if auth.Interval == 0 {
+		auth.Interval = 5
+	}
+	return &auth.DeviceAuthorization, nil
+}
+
+// requestDeviceToken polls the token endpoint once with a device code.
+// A pending or refused authorization is reported as a *DeviceError.
+func (p *ProviderData) requestDeviceToken(deviceCode, defaultMethod string) (*oauth2.Token, error) {
+	if deviceCode == "" {
+		return nil, errors.New("missing device code")
+	}
+	params := url.Values{}
+	params.Set("grant_type", DeviceCodeGrantType)
+	params.Set("device_code", deviceCode)
+	req, err := p.newTokenRequest(params, defaultMethod)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var jsonResponse deviceTokenResponse
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+	if jsonResponse.Error != "" {
+		return nil, &DeviceError{Code: jsonResponse.Error, Description: jsonResponse.ErrorDescription}
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+	if jsonResponse.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  jsonResponse.AccessToken,
+		TokenType:    jsonResponse.TokenType,
+		RefreshToken: jsonResponse.RefreshToken,
+	}
+	if expiresIn, err := jsonResponse.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	if jsonResponse.IDToken != "" {
+		token = token.WithExtra(map[string]interface{}{"id_token": jsonResponse.IDToken})
+	}
+	return token, nil
+}
+
+// RedeemDeviceCode polls the token endpoint with a device code and returns
+// a session once the user has approved the device
+func (p *ProviderData) RedeemDeviceCode(deviceCode string) (*SessionState, error) {
+	token, err := p.requestDeviceToken(deviceCode, ClientSecretPost)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionState{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresOn:    token.Expiry,
+	}, nil
+}
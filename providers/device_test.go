@@ -0,0 +1,122 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDeviceServer struct {
+	server   *httptest.Server
+	approved bool
+	// errorStatus is the HTTP status used for token errors; GitHub uses 200
+	errorStatus int
+	form        url.Values
+}
+
+func newFakeDeviceServer() *fakeDeviceServer {
+	f := &fakeDeviceServer{errorStatus: 400}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.form = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device/code":
+			w.Write([]byte(`{"device_code": "dev123", "user_code": "WDJB-MJHT",
+				"verification_url": "https://example.com/device", "expires_in": 1800}`))
+		case "/token":
+			if r.PostForm.Get("device_code") != "dev123" {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"error": "expired_token"}`))
+			} else if !f.approved {
+				w.WriteHeader(f.errorStatus)
+				w.Write([]byte(`{"error": "authorization_pending"}`))
+			} else {
+				w.Write([]byte(`{"access_token": "a1b2c3d4", "refresh_token": "r1", "expires_in": 3600}`))
+			}
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return f
+}
+
+func (f *fakeDeviceServer) providerData() *ProviderData {
+	deviceAuthURL, _ := url.Parse(f.server.URL + "/device/code")
+	redeemURL, _ := url.Parse(f.server.URL + "/token")
+	return &ProviderData{
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		Scope:         "openid email",
+		DeviceAuthURL: deviceAuthURL,
+		RedeemURL:     redeemURL,
+	}
+}
+
+func TestStartDeviceAuthorization(t *testing.T) {
+	f := newFakeDeviceServer()
+	defer f.server.Close()
+
+	auth, err := f.providerData().StartDeviceAuthorization()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "dev123", auth.DeviceCode)
+	assert.Equal(t, "WDJB-MJHT", auth.UserCode)
+	assert.Equal(t, "https://example.com/device", auth.VerificationURI)
+	assert.Equal(t, int64(1800), auth.ExpiresIn)
+	assert.Equal(t, int64(5), auth.Interval)
+	assert.Equal(t, "client", f.form.Get("client_id"))
+	assert.Equal(t, "openid email", f.form.Get("scope"))
+}
+
+func TestStartDeviceAuthorizationUnsupported(t *testing.T) {
+	_, err := (&ProviderData{}).StartDeviceAuthorization()
+	assert.NotEqual(t, nil, err)
+}
+
+func TestRedeemDeviceCode(t *testing.T) {
+	f := newFakeDeviceServer()
+	defer f.server.Close()
+	p := f.providerData()
+
+	_, err := p.RedeemDeviceCode("dev123")
+	assert.Equal(t, &DeviceError{Code: "authorization_pending"}, err)
+	assert.Equal(t, DeviceCodeGrantType, f.form.Get("grant_type"))
+	assert.Equal(t, "secret", f.form.Get("client_secret"))
+
+	f.approved = true
+	session, err := p.RedeemDeviceCode("dev123")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1b2c3d4", session.AccessToken)
+	assert.Equal(t, "r1", session.RefreshToken)
+	assert.False(t, session.ExpiresOn.IsZero())
+}
+
+func TestRedeemDeviceCodeErrorWithOKStatus(t *testing.T) {
+	f := newFakeDeviceServer()
+	defer f.server.Close()
+	f.errorStatus = 200
+
+	_, err := f.providerData().RedeemDeviceCode("dev123")
+	assert.Equal(t, &DeviceError{Code: "authorization_pending"}, err)
+}
+
+func TestRedeemDeviceCodeExpired(t *testing.T) {
+	f := newFakeDeviceServer()
+	defer f.server.Close()
+
+	_, err := f.providerData().RedeemDeviceCode("other")
+	assert.Equal(t, &DeviceError{Code: "expired_token"}, err)
+
+	_, err = f.providerData().RedeemDeviceCode("")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDeviceAuthURLDefaults(t *testing.T) {
+	assert.Equal(t, "https://oauth2.googleapis.com/device/code",
+		NewGoogleProvider(&ProviderData{LoginURL: &url.URL{}, RedeemURL: &url.URL{}, ValidateURL: &url.URL{}}).DeviceAuthURL.String())
+	assert.Equal(t, "https://github.com/login/device/code",
+		NewGitHubProvider(&ProviderData{}).DeviceAuthURL.String())
+}
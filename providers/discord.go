@@ -73,7 +73,7 @@ func getUserInfo(p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
 	}
 	req.Header = getDiscordHeader(s.AccessToken)
 
-	err = api.RequestJson(req, &r)
+	err = api.RequestJson(p.Client(), req, &r)
 	if err != nil {
 		return r, err
 	}
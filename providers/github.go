@@ -34,6 +34,13 @@ func NewGitHubProvider(p *ProviderData) *GitHubProvider {
 			Path:   "/login/oauth/access_token",
 		}
 	}
+	if p.DeviceAuthURL == nil || p.DeviceAuthURL.String() == "" {
+		p.DeviceAuthURL = &url.URL{
+			Scheme: "https",
+			Host:   "github.com",
+			Path:   "/login/device/code",
+		}
+	}
 	// ValidationURL is the API Base URL
 	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
 		p.ValidateURL = &url.URL{
@@ -85,7 +92,7 @@ func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
 		}
 		req, _ := http.NewRequest("GET", endpoint.String(), nil)
 		req.Header = getGitHubHeader(accessToken)
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := p.Client().Do(req)
 		if err != nil {
 			return false, err
 		}
@@ -154,7 +161,7 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 	for i := 0; i < 10; i++ {
 		req, _ := http.NewRequest("GET", team_url, nil)
 		req.Header = getGitHubHeader(accessToken)
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := p.Client().Do(req)
 		if err != nil {
 			return false, err
 		}
@@ -235,7 +242,7 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 	}
 	req, _ := http.NewRequest("GET", endpoint.String(), nil)
 	req.Header = getGitHubHeader(s.AccessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.Client().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -287,7 +294,7 @@ func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
 	}
 
 	req.Header = getGitHubHeader(s.AccessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.Client().Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -78,7 +78,7 @@ func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
 		}
 
 		var groups groupsPage
-		err = api.RequestJson(req, &groups)
+		err = api.RequestJson(p.Client(), req, &groups)
 		if err != nil {
 			return false, err
 		}
@@ -113,7 +113,7 @@ func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
 		log.Printf("failed building request %s", err)
 		return "", err
 	}
-	json, err := api.Request(req)
+	json, err := api.Request(p.Client(), req)
 	if err != nil {
 		log.Printf("failed making request %s", err)
 		return "", err
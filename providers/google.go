@@ -1,7 +1,7 @@
 package providers
 
 import (
-	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -47,6 +47,11 @@ func NewGoogleProvider(p *ProviderData) *GoogleProvider {
 			Host: "www.googleapis.com",
 			Path: "/oauth2/v1/tokeninfo"}
 	}
+	if p.DeviceAuthURL == nil || p.DeviceAuthURL.String() == "" {
+		p.DeviceAuthURL = &url.URL{Scheme: "https",
+			Host: "oauth2.googleapis.com",
+			Path: "/device/code"}
+	}
 	if p.Scope == "" {
 		p.Scope = "profile email"
 	}
@@ -97,18 +102,15 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 
 	params := url.Values{}
 	params.Add("redirect_uri", redirectURL)
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
 	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = p.newTokenRequest(params, ClientSecretPost)
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.Client().Do(req)
 	if err != nil {
 		return
 	}
@@ -153,13 +155,13 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 // checked. CredentialsFile is the path to a json file containing a Google service
 // account credentials.
 func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
-	adminService := getAdminService(adminEmail, credentialsReader)
+	adminService := getAdminService(p.Client(), adminEmail, credentialsReader)
 	p.GroupValidator = func(email string) bool {
 		return userInGroup(adminService, groups, email)
 	}
 }
 
-func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
+func getAdminService(httpClient *http.Client, adminEmail string, credentialsReader io.Reader) *admin.Service {
 	data, err := ioutil.ReadAll(credentialsReader)
 	if err != nil {
 		log.Fatal("can't read Google credentials file:", err)
@@ -170,7 +172,8 @@ func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Serv
 	}
 	conf.Subject = adminEmail
 
-	client := conf.Client(oauth2.NoContext)
+	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, httpClient)
+	client := conf.Client(ctx)
 	adminService, err := admin.New(client)
 	if err != nil {
 		log.Fatal(err)
@@ -228,18 +231,15 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string, expires time.Duration, err error) {
 	// https://developers.google.com/identity/protocols/OAuth2WebServer#refresh
 	params := url.Values{}
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
 	params.Add("refresh_token", refreshToken)
 	params.Add("grant_type", "refresh_token")
 	var req *http.Request
-	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	req, err = p.newTokenRequest(params, ClientSecretPost)
 	if err != nil {
 		return
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := p.Client().Do(req)
 	if err != nil {
 		return
 	}
@@ -57,7 +57,7 @@ func (p *LinkedInProvider) GetEmailAddress(s *SessionState) (string, error) {
 	}
 	req.Header = getLinkedInHeader(s.AccessToken)
 
-	json, err := api.Request(req)
+	json, err := api.Request(p.Client(), req)
 	if err != nil {
 		return "", err
 	}
@@ -2,7 +2,11 @@ package providers
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"time"
 
@@ -15,6 +19,13 @@ type OIDCProvider struct {
 	*ProviderData
 
 	Verifier *oidc.IDTokenVerifier
+
+	// AcrValues is sent as acr_values in the authorization request
+	AcrValues string
+	// RequiredAcr lists acr values of which the ID token must carry one
+	RequiredAcr []string
+	// RequiredAmr lists amr values the ID token must all carry
+	RequiredAmr []string
 }
 
 func NewOIDCProvider(p *ProviderData) *OIDCProvider {
@@ -23,7 +34,7 @@ func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 }
 
 func (p *OIDCProvider) SetIssuerURL(issuerURL string) error {
-	provider, err := oidc.NewProvider(context.Background(), issuerURL)
+	provider, err := oidc.NewProvider(p.clientContext(), issuerURL)
 	if err != nil {
 		return fmt.Errorf("error looking up issuer-url=%q %s", issuerURL, err)
 	}
@@ -38,6 +49,14 @@ func (p *OIDCProvider) SetIssuerURL(issuerURL string) error {
 	if err != nil {
 		return fmt.Errorf("error parsing redeem-url=%q %s", provider.Endpoint().TokenURL, err)
 	}
+	var claims struct {
+		DeviceAuthURL string `json:"device_authorization_endpoint"`
+	}
+	if err := provider.Claims(&claims); err == nil && claims.DeviceAuthURL != "" && (p.DeviceAuthURL == nil || p.DeviceAuthURL.String() == "") {
+		if p.DeviceAuthURL, err = url.Parse(claims.DeviceAuthURL); err != nil {
+			return fmt.Errorf("error parsing device-auth-url=%q %s", claims.DeviceAuthURL, err)
+		}
+	}
 	if p.Scope == "" {
 		p.Scope = "openid email profile"
 	}
@@ -45,33 +64,133 @@ func (p *OIDCProvider) SetIssuerURL(issuerURL string) error {
 }
 
 func (p *OIDCProvider) SetVerifier(issuerURL string, jwksURL string) {
-	keySet := oidc.NewRemoteKeySet(context.Background(), jwksURL)
+	keySet := oidc.NewRemoteKeySet(p.clientContext(), jwksURL)
 	p.Verifier = oidc.NewVerifier(issuerURL, keySet, &oidc.Config{
 		ClientID: p.ClientID,
 	})
 }
 
+// clientContext makes go-oidc use the configured provider HTTP client for
+// discovery and JWKS requests
+func (p *OIDCProvider) clientContext() context.Context {
+	return oidc.ClientContext(context.Background(), p.Client())
+}
+
+// ErrInvalidNonce is returned when the ID token was not issued for the
+// authorization request that started the login
+var ErrInvalidNonce = errors.New("id_token nonce does not match")
+
 func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err error) {
+	return p.RedeemWithNonce(redirectURL, code, "")
+}
+
+// GetLoginURL adds acr_values to the authorization request when configured
+func (p *OIDCProvider) GetLoginURL(redirectURI, state string) string {
+	loginURL := p.ProviderData.GetLoginURL(redirectURI, state)
+	if p.AcrValues == "" {
+		return loginURL
+	}
+	a, _ := url.Parse(loginURL)
+	params := a.Query()
+	params.Set("acr_values", p.AcrValues)
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// GetLoginURLWithNonce adds the nonce the ID token must carry to the
+// authorization request
+func (p *OIDCProvider) GetLoginURLWithNonce(redirectURI, state, nonce string) string {
+	a, _ := url.Parse(p.GetLoginURL(redirectURI, state))
+	params := a.Query()
+	params.Set("nonce", nonce)
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+// RedeemWithNonce redeems code and rejects an ID token whose nonce claim is
+// not nonce. The check is skipped when nonce is empty.
+func (p *OIDCProvider) RedeemWithNonce(redirectURL, code, nonce string) (s *SessionState, err error) {
 	ctx := context.Background()
-	c := oauth2.Config{
-		ClientID:     p.ClientID,
-		ClientSecret: p.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			TokenURL: p.RedeemURL.String(),
-		},
-		RedirectURL: redirectURL,
-	}
-	token, err := c.Exchange(ctx, code)
+	params := url.Values{}
+	params.Add("grant_type", "authorization_code")
+	params.Add("code", code)
+	params.Add("redirect_uri", redirectURL)
+	token, err := p.requestToken(params)
 	if err != nil {
 		return nil, fmt.Errorf("token exchange: %v", err)
 	}
-	s, err = p.createSessionState(token, ctx)
+	s, err = p.createSessionState(token, ctx, nonce)
+	if _, ok := err.(*AuthContextError); ok || err == ErrInvalidNonce {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to update session: %v", err)
 	}
 	return
 }
 
+// RedeemDeviceCode polls the token endpoint with a device code and builds
+// the session from the returned ID token
+func (p *OIDCProvider) RedeemDeviceCode(deviceCode string) (*SessionState, error) {
+	token, err := p.requestDeviceToken(deviceCode, ClientSecretBasic)
+	if err != nil {
+		return nil, err
+	}
+	s, err := p.createSessionState(token, context.Background(), "")
+	if err != nil {
+		return nil, fmt.Errorf("unable to update session: %v", err)
+	}
+	return s, nil
+}
+
+// requestToken calls the token endpoint, authenticating the client with
+// client_secret_basic unless another method is configured
+func (p *OIDCProvider) requestToken(params url.Values) (*oauth2.Token, error) {
+	req, err := p.newTokenRequest(params, ClientSecretBasic)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var jsonResponse struct {
+		AccessToken  string      `json:"access_token"`
+		TokenType    string      `json:"token_type"`
+		RefreshToken string      `json:"refresh_token"`
+		ExpiresIn    json.Number `json:"expires_in"`
+		IDToken      string      `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	if jsonResponse.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+	token := &oauth2.Token{
+		AccessToken:  jsonResponse.AccessToken,
+		TokenType:    jsonResponse.TokenType,
+		RefreshToken: jsonResponse.RefreshToken,
+	}
+	if expiresIn, err := jsonResponse.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	if jsonResponse.IDToken != "" {
+		token = token.WithExtra(map[string]interface{}{"id_token": jsonResponse.IDToken})
+	}
+	return token, nil
+}
+
 func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
 		return false, nil
@@ -89,23 +208,21 @@ func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 }
 
 func (p *OIDCProvider) redeemRefreshToken(s *SessionState) (err error) {
-	c := oauth2.Config{
-		ClientID:     p.ClientID,
-		ClientSecret: p.ClientSecret,
-		Endpoint: oauth2.Endpoint{
-			TokenURL: p.RedeemURL.String(),
-		},
-	}
 	ctx := context.Background()
-	t := &oauth2.Token{
-		RefreshToken: s.RefreshToken,
-		Expiry:       time.Now().Add(-time.Hour),
-	}
-	token, err := c.TokenSource(ctx, t).Token()
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("refresh_token", s.RefreshToken)
+	token, err := p.requestToken(params)
 	if err != nil {
 		return fmt.Errorf("failed to get token: %v", err)
 	}
-	newSession, err := p.createSessionState(token, ctx)
+	if token.RefreshToken == "" {
+		// the refresh token is only rotated by some providers
+		token.RefreshToken = s.RefreshToken
+	}
+	// refreshing is not a new login, so the authentication context and
+	// time of the session are kept
+	newSession, _, err := p.verifySessionState(token, ctx, "")
 	if err != nil {
 		return fmt.Errorf("unable to update session: %v", err)
 	}
@@ -116,26 +233,79 @@ func (p *OIDCProvider) redeemRefreshToken(s *SessionState) (err error) {
 	return
 }
 
-func (p *OIDCProvider) createSessionState(token *oauth2.Token, ctx context.Context) (*SessionState, error) {
+// AuthContextError reports an ID token whose authentication context does not
+// meet the required acr or amr values
+type AuthContextError struct {
+	Reason string
+}
+
+func (e *AuthContextError) Error() string {
+	return fmt.Sprintf("insufficient authentication: %s", e.Reason)
+}
+
+type idTokenClaims struct {
+	Subject  string   `json:"sub"`
+	Email    string   `json:"email"`
+	Verified *bool    `json:"email_verified"`
+	Acr      string   `json:"acr"`
+	Amr      []string `json:"amr"`
+	AuthTime int64    `json:"auth_time"`
+}
+
+// checkAuthContext enforces RequiredAcr and RequiredAmr
+func (p *OIDCProvider) checkAuthContext(claims *idTokenClaims) error {
+	if len(p.RequiredAcr) != 0 && !containsString(p.RequiredAcr, claims.Acr) {
+		return &AuthContextError{Reason: fmt.Sprintf("acr %q is not one of %q", claims.Acr, p.RequiredAcr)}
+	}
+	for _, amr := range p.RequiredAmr {
+		if !containsString(claims.Amr, amr) {
+			return &AuthContextError{Reason: fmt.Sprintf("amr %q does not include %q", claims.Amr, amr)}
+		}
+	}
+	return nil
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// createSessionState builds the session for a new login, which must meet the
+// required authentication context
+func (p *OIDCProvider) createSessionState(token *oauth2.Token, ctx context.Context, nonce string) (*SessionState, error) {
+	s, claims, err := p.verifySessionState(token, ctx, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkAuthContext(claims); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *OIDCProvider) verifySessionState(token *oauth2.Token, ctx context.Context, nonce string) (*SessionState, *idTokenClaims, error) {
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
-		return nil, fmt.Errorf("token response did not contain an id_token")
+		return nil, nil, fmt.Errorf("token response did not contain an id_token")
 	}
 
 	// Parse and verify ID Token payload.
 	idToken, err := p.Verifier.Verify(ctx, rawIDToken)
 	if err != nil {
-		return nil, fmt.Errorf("could not verify id_token: %v", err)
+		return nil, nil, fmt.Errorf("could not verify id_token: %v", err)
+	}
+	if nonce != "" && subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, nil, ErrInvalidNonce
 	}
 
 	// Extract custom claims.
-	var claims struct {
-		Subject  string `json:"sub"`
-		Email    string `json:"email"`
-		Verified *bool  `json:"email_verified"`
-	}
-	if err := idToken.Claims(&claims); err != nil {
-		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+	claims := &idTokenClaims{}
+	if err := idToken.Claims(claims); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse id_token claims: %v", err)
 	}
 
 	if claims.Email == "" {
@@ -144,13 +314,20 @@ func (p *OIDCProvider) createSessionState(token *oauth2.Token, ctx context.Conte
 		claims.Email = claims.Subject
 	}
 	if claims.Verified != nil && !*claims.Verified {
-		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
+		return nil, nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
 	}
 
+	// without auth_time the token was issued for a fresh login
+	authTime := idToken.IssuedAt
+	if claims.AuthTime > 0 {
+		authTime = time.Unix(claims.AuthTime, 0)
+	}
 	return &SessionState{
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
 		ExpiresOn:    token.Expiry,
 		Email:        claims.Email,
-	}, nil
+		Subject:      claims.Subject,
+		AuthTime:     authTime,
+	}, claims, nil
 }
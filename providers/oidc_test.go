@@ -0,0 +1,149 @@
+package providers
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/mockidp"
+	"github.com/stretchr/testify/assert"
+)
+
+const oidcRedirectURL = "http://127.0.0.1:4180/oauth2/callback"
+
+func newOIDCTestProvider(t *testing.T, users ...mockidp.User) (*OIDCProvider, *mockidp.Server) {
+	idp, err := mockidp.NewServer(mockidp.Config{ClientID: "client", ClientSecret: "secret", Users: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewOIDCProvider(&ProviderData{ClientID: "client", ClientSecret: "secret"})
+	assert.Equal(t, nil, p.SetIssuerURL(idp.URL))
+	return p, idp
+}
+
+func mockIdPCode(t *testing.T, p *OIDCProvider) string {
+	return mockIdPCodeFor(t, p.GetLoginURL(oidcRedirectURL, "state"))
+}
+
+func mockIdPCodeFor(t *testing.T, loginURL string) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	return location.Query().Get("code")
+}
+
+func TestOIDCProviderDiscovery(t *testing.T) {
+	p, idp := newOIDCTestProvider(t)
+	defer idp.Close()
+	assert.Equal(t, idp.URL+mockidp.AuthorizePath, p.LoginURL.String())
+	assert.Equal(t, idp.URL+mockidp.TokenPath, p.RedeemURL.String())
+	assert.Equal(t, "openid email profile", p.Scope)
+}
+
+func TestOIDCProviderRedeem(t *testing.T) {
+	p, idp := newOIDCTestProvider(t)
+	defer idp.Close()
+
+	session, err := p.Redeem(oidcRedirectURL, mockIdPCode(t, p))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, mockidp.DefaultUser.Email, session.Email)
+	assert.NotEqual(t, "", session.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), session.ExpiresOn, 5*time.Second)
+
+	_, err = p.Redeem(oidcRedirectURL, "bogus")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestOIDCProviderRefreshSession(t *testing.T) {
+	p, idp := newOIDCTestProvider(t)
+	defer idp.Close()
+	session, err := p.Redeem(oidcRedirectURL, mockIdPCode(t, p))
+	assert.Equal(t, nil, err)
+
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.False(t, refreshed)
+
+	accessToken, refreshToken := session.AccessToken, session.RefreshToken
+	session.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.True(t, refreshed)
+	assert.NotEqual(t, accessToken, session.AccessToken)
+	assert.NotEqual(t, refreshToken, session.RefreshToken)
+	assert.True(t, session.ExpiresOn.After(time.Now()))
+}
+
+func TestOIDCProviderRedeemWithNonce(t *testing.T) {
+	p, idp := newOIDCTestProvider(t)
+	defer idp.Close()
+
+	loginURL, _ := url.Parse(p.GetLoginURLWithNonce(oidcRedirectURL, "state", "n-0S6"))
+	assert.Equal(t, "n-0S6", loginURL.Query().Get("nonce"))
+	assert.Equal(t, "state", loginURL.Query().Get("state"))
+
+	session, err := p.RedeemWithNonce(oidcRedirectURL, mockIdPCodeFor(t, loginURL.String()), "n-0S6")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, mockidp.DefaultUser.Email, session.Email)
+
+	_, err = p.RedeemWithNonce(oidcRedirectURL, mockIdPCodeFor(t, loginURL.String()), "other")
+	assert.Equal(t, ErrInvalidNonce, err)
+
+	// an ID token without a nonce does not satisfy an expected one
+	_, err = p.RedeemWithNonce(oidcRedirectURL, mockIdPCode(t, p), "n-0S6")
+	assert.Equal(t, ErrInvalidNonce, err)
+}
+
+func TestOIDCProviderAcrValues(t *testing.T) {
+	p, idp := newOIDCTestProvider(t)
+	defer idp.Close()
+	loginURL, _ := url.Parse(p.GetLoginURLWithNonce(oidcRedirectURL, "state", "n"))
+	assert.Equal(t, "", loginURL.Query().Get("acr_values"))
+
+	p.AcrValues = "urn:example:mfa"
+	loginURL, _ = url.Parse(p.GetLoginURLWithNonce(oidcRedirectURL, "state", "n"))
+	assert.Equal(t, "urn:example:mfa", loginURL.Query().Get("acr_values"))
+	assert.Equal(t, "n", loginURL.Query().Get("nonce"))
+}
+
+func TestOIDCProviderRequiredAuthContext(t *testing.T) {
+	authTime := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	p, idp := newOIDCTestProvider(t, mockidp.User{
+		Subject: "jane",
+		Email:   "jane@example.com",
+		Claims: map[string]interface{}{
+			"acr":       "urn:example:mfa",
+			"amr":       []string{"pwd", "otp"},
+			"auth_time": authTime.Unix(),
+		},
+	})
+	defer idp.Close()
+
+	p.RequiredAcr = []string{"urn:example:loa3", "urn:example:mfa"}
+	p.RequiredAmr = []string{"otp"}
+	session, err := p.Redeem(oidcRedirectURL, mockIdPCode(t, p))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, authTime, session.AuthTime)
+
+	// refreshing keeps the original authentication
+	session.ExpiresOn = time.Now().Add(-time.Minute)
+	p.RequiredAmr = []string{"hwk"}
+	_, err = p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, authTime, session.AuthTime)
+
+	_, err = p.Redeem(oidcRedirectURL, mockIdPCode(t, p))
+	assert.Equal(t, &AuthContextError{Reason: `amr ["pwd" "otp"] does not include "hwk"`}, err)
+
+	p.RequiredAmr = nil
+	p.RequiredAcr = []string{"urn:example:loa3"}
+	_, err = p.Redeem(oidcRedirectURL, mockIdPCode(t, p))
+	assert.Equal(t, &AuthContextError{Reason: `acr "urn:example:mfa" is not one of ["urn:example:loa3"]`}, err)
+}
@@ -1,21 +1,37 @@
 package providers
 
 import (
+	"crypto"
+	"net/http"
 	"net/url"
 )
 
 type ProviderData struct {
-	ProviderName      string
-	ClientID          string
-	ClientSecret      string
-	LoginURL          *url.URL
-	RedeemURL         *url.URL
-	ProfileURL        *url.URL
-	ProtectedResource *url.URL
-	ValidateURL       *url.URL
-	Scope             string
-	Prompt            string
-	ApprovalPrompt    string
+	ProviderName         string
+	ClientID             string
+	ClientSecret         string
+	ClientAuthMethod     string
+	ClientAssertionKey   crypto.Signer
+	ClientAssertionKeyID string
+	LoginURL             *url.URL
+	RedeemURL            *url.URL
+	DeviceAuthURL        *url.URL
+	ProfileURL           *url.URL
+	ProtectedResource    *url.URL
+	ValidateURL          *url.URL
+	Scope                string
+	Prompt               string
+	ApprovalPrompt       string
+	HTTPClient           *http.Client
 }
 
 func (p *ProviderData) Data() *ProviderData { return p }
+
+// Client returns the HTTP client for calls to the provider, falling back to
+// http.DefaultClient when none was configured
+func (p *ProviderData) Client() *http.Client {
+	if p.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return p.HTTPClient
+}
@@ -9,6 +9,7 @@ type Provider interface {
 	GetEmailAddress(*SessionState) (string, error)
 	GetUserName(*SessionState) (string, error)
 	Redeem(string, string) (*SessionState, error)
+	RedeemDeviceCode(string) (*SessionState, error)
 	ValidateGroup(string) bool
 	ValidateSessionState(*SessionState) bool
 	GetLoginURL(redirectURI, finalRedirect string) string
@@ -17,6 +18,13 @@ type Provider interface {
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
 }
 
+// NonceProvider is implemented by providers that bind the ID token to the
+// authorization request with an OpenID Connect nonce
+type NonceProvider interface {
+	GetLoginURLWithNonce(redirectURI, state, nonce string) string
+	RedeemWithNonce(redirectURI, code, nonce string) (*SessionState, error)
+}
+
 func New(provider string, p *ProviderData) Provider {
 	switch provider {
 	case "linkedin":
@@ -35,6 +43,8 @@ func New(provider string, p *ProviderData) Provider {
 		return NewDiscordProvider(p)
 	case "bitbucket":
 		return NewBitbucketProvider(p)
+	case "saml":
+		return NewSAMLProvider(p)
 	default:
 		return NewGoogleProvider(p)
 	}
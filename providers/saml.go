@@ -0,0 +1,408 @@
+package providers
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+const (
+	samlProtocolNS   = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS  = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlMetadataNS   = "urn:oasis:names:tc:SAML:2.0:metadata"
+	samlPOSTBinding  = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlEmailFormat  = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlStatusOK     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearerMethod = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// allowed difference between our clock and the IdP's when checking
+	// assertion validity windows
+	samlClockSkew = 90 * time.Second
+)
+
+// SAMLProvider acts as a SAML 2.0 service provider. The ClientID is used as
+// the SP entity ID and LoginURL as the IdP single sign-on (HTTP-Redirect
+// binding) endpoint. Assertions are posted back to the proxy's ACS endpoint
+// and must be signed by one of IDPCertificates.
+type SAMLProvider struct {
+	*ProviderData
+
+	IDPEntityID     string
+	IDPCertificates []*x509.Certificate
+	EmailAttribute  string
+	UserAttribute   string
+	GroupsAttribute string
+
+	now func() time.Time
+}
+
+func NewSAMLProvider(p *ProviderData) *SAMLProvider {
+	p.ProviderName = "SAML"
+	return &SAMLProvider{
+		ProviderData:    p,
+		EmailAttribute:  "email",
+		GroupsAttribute: "groups",
+		now:             time.Now,
+	}
+}
+
+// SetIDPCertificateFile loads the PEM encoded certificate(s) used by the
+// IdP to sign its assertions
+func (p *SAMLProvider) SetIDPCertificateFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read saml-idp-cert-file=%q %s", path, err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("could not parse saml-idp-cert-file=%q %s", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates found in saml-idp-cert-file=%q", path)
+	}
+	p.IDPCertificates = certs
+	return nil
+}
+
+// Redeem is not part of the SAML flow; assertions are consumed by
+// ConsumeResponse instead
+func (p *SAMLProvider) Redeem(redirectURL, code string) (*SessionState, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (p *SAMLProvider) ValidateSessionState(s *SessionState) bool {
+	return true
+}
+
+// requestID derives the AuthnRequest ID from the relay state, which lets
+// ConsumeResponse check InResponseTo without keeping server side state
+func (p *SAMLProvider) requestID(relayState string) string {
+	sum := sha256.Sum256([]byte(relayState))
+	return "id-" + hex.EncodeToString(sum[:])
+}
+
+type samlAuthnRequest struct {
+	XMLName                     xml.Name `xml:"samlp:AuthnRequest"`
+	SAMLP                       string   `xml:"xmlns:samlp,attr"`
+	SAML                        string   `xml:"xmlns:saml,attr"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	IssueInstant                string   `xml:"IssueInstant,attr"`
+	Destination                 string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	Issuer                      string   `xml:"saml:Issuer"`
+	NameIDPolicy                struct {
+		Format      string `xml:"Format,attr"`
+		AllowCreate bool   `xml:"AllowCreate,attr"`
+	} `xml:"samlp:NameIDPolicy"`
+}
+
+// GetLoginURL returns the IdP SSO URL carrying a deflated AuthnRequest
+// (HTTP-Redirect binding). The state is passed through as RelayState.
+func (p *SAMLProvider) GetLoginURL(acsURL, state string) string {
+	r := samlAuthnRequest{
+		SAMLP:                       samlProtocolNS,
+		SAML:                        samlAssertionNS,
+		ID:                          p.requestID(state),
+		Version:                     "2.0",
+		IssueInstant:                p.now().UTC().Format(time.RFC3339),
+		Destination:                 p.LoginURL.String(),
+		AssertionConsumerServiceURL: acsURL,
+		ProtocolBinding:             samlPOSTBinding,
+		Issuer:                      p.ClientID,
+	}
+	r.NameIDPolicy.Format = samlEmailFormat
+	r.NameIDPolicy.AllowCreate = true
+
+	raw, _ := xml.Marshal(r)
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(raw)
+	w.Close()
+
+	var a url.URL
+	a = *p.LoginURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	params.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	params.Set("RelayState", state)
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+type samlMetadata struct {
+	XMLName         xml.Name `xml:"md:EntityDescriptor"`
+	MD              string   `xml:"xmlns:md,attr"`
+	EntityID        string   `xml:"entityID,attr"`
+	SPSSODescriptor struct {
+		AuthnRequestsSigned        bool   `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool   `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat               string `xml:"md:NameIDFormat"`
+		AssertionConsumerService   struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+			Index    int    `xml:"index,attr"`
+		} `xml:"md:AssertionConsumerService"`
+	} `xml:"md:SPSSODescriptor"`
+}
+
+// Metadata renders the SP metadata document for the given ACS URL
+func (p *SAMLProvider) Metadata(acsURL string) ([]byte, error) {
+	m := samlMetadata{
+		MD:       samlMetadataNS,
+		EntityID: p.ClientID,
+	}
+	m.SPSSODescriptor.WantAssertionsSigned = true
+	m.SPSSODescriptor.ProtocolSupportEnumeration = samlProtocolNS
+	m.SPSSODescriptor.NameIDFormat = samlEmailFormat
+	m.SPSSODescriptor.AssertionConsumerService.Binding = samlPOSTBinding
+	m.SPSSODescriptor.AssertionConsumerService.Location = acsURL
+	m.SPSSODescriptor.AssertionConsumerService.Index = 1
+
+	out, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+type samlResponse struct {
+	Destination  string `xml:"Destination,attr"`
+	InResponseTo string `xml:"InResponseTo,attr"`
+	Issuer       string `xml:"Issuer"`
+	Status       struct {
+		StatusCode struct {
+			Value string `xml:"Value,attr"`
+		} `xml:"StatusCode"`
+	} `xml:"Status"`
+}
+
+type samlAssertion struct {
+	Issuer  string `xml:"Issuer"`
+	Subject struct {
+		NameID              string `xml:"NameID"`
+		SubjectConfirmation []struct {
+			Method                  string `xml:"Method,attr"`
+			SubjectConfirmationData struct {
+				InResponseTo string    `xml:"InResponseTo,attr"`
+				Recipient    string    `xml:"Recipient,attr"`
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+			} `xml:"SubjectConfirmationData"`
+		} `xml:"SubjectConfirmation"`
+	} `xml:"Subject"`
+	Conditions struct {
+		NotBefore           time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter        time.Time `xml:"NotOnOrAfter,attr"`
+		AudienceRestriction []struct {
+			Audience []string `xml:"Audience"`
+		} `xml:"AudienceRestriction"`
+	} `xml:"Conditions"`
+	Attributes []struct {
+		Name   string   `xml:"Name,attr"`
+		Values []string `xml:"AttributeValue"`
+	} `xml:"AttributeStatement>Attribute"`
+}
+
+func (a *samlAssertion) attribute(name string) []string {
+	if name == "" {
+		return nil
+	}
+	for _, attr := range a.Attributes {
+		if attr.Name == name {
+			return attr.Values
+		}
+	}
+	return nil
+}
+
+// ConsumeResponse verifies a base64 encoded SAMLResponse posted to the ACS
+// endpoint and maps the asserted subject and attributes to a session.
+// Either the Response or the Assertion must carry a valid signature.
+func (p *SAMLProvider) ConsumeResponse(acsURL, samlResponseValue, relayState string) (*SessionState, error) {
+	raw, err := base64.StdEncoding.DecodeString(samlResponseValue)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode SAMLResponse: %v", err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return nil, fmt.Errorf("could not parse SAMLResponse: %v", err)
+	}
+	root := doc.Root()
+	if root == nil || root.Tag != "Response" {
+		return nil, errors.New("SAMLResponse does not contain a Response element")
+	}
+
+	validator := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: p.IDPCertificates,
+	})
+	var assertionEl *etree.Element
+	if hasSignature(root) {
+		root, err = validator.Validate(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Response signature: %v", err)
+		}
+		assertionEl = childElement(root, "Assertion")
+	} else {
+		assertionEl = childElement(root, "Assertion")
+		if assertionEl == nil || !hasSignature(assertionEl) {
+			return nil, errors.New("neither Response nor Assertion is signed")
+		}
+		// carry namespace declarations made on the Response over to the
+		// Assertion before canonicalizing it on its own
+		ctx, err := etreeutils.NSBuildParentContext(assertionEl)
+		if err != nil {
+			return nil, err
+		}
+		if assertionEl, err = etreeutils.NSDetatch(ctx, assertionEl); err != nil {
+			return nil, err
+		}
+		assertionEl, err = validator.Validate(assertionEl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Assertion signature: %v", err)
+		}
+	}
+	if assertionEl == nil {
+		if childElement(root, "EncryptedAssertion") != nil {
+			return nil, errors.New("encrypted assertions are not supported")
+		}
+		return nil, errors.New("SAMLResponse does not contain an Assertion")
+	}
+
+	var response samlResponse
+	if err := unmarshalElement(root, &response); err != nil {
+		return nil, err
+	}
+	var assertion samlAssertion
+	if err := unmarshalElement(assertionEl, &assertion); err != nil {
+		return nil, err
+	}
+
+	if err := p.validateResponse(&response, &assertion, acsURL, p.requestID(relayState)); err != nil {
+		return nil, err
+	}
+
+	s := &SessionState{
+		User:    assertion.Subject.NameID,
+		Subject: assertion.Subject.NameID,
+		Groups:  assertion.attribute(p.GroupsAttribute),
+	}
+	if v := assertion.attribute(p.EmailAttribute); len(v) > 0 {
+		s.Email = v[0]
+	} else if strings.Contains(assertion.Subject.NameID, "@") {
+		s.Email = assertion.Subject.NameID
+	}
+	if v := assertion.attribute(p.UserAttribute); len(v) > 0 {
+		s.User = v[0]
+	}
+	return s, nil
+}
+
+func (p *SAMLProvider) validateResponse(r *samlResponse, a *samlAssertion, acsURL, requestID string) error {
+	now := p.now()
+
+	if r.Status.StatusCode.Value != samlStatusOK {
+		return fmt.Errorf("unsuccessful SAML status %q", r.Status.StatusCode.Value)
+	}
+	if r.Destination != "" && r.Destination != acsURL {
+		return fmt.Errorf("Response Destination %q does not match %q", r.Destination, acsURL)
+	}
+	if r.InResponseTo != "" && r.InResponseTo != requestID {
+		return errors.New("Response InResponseTo does not match the AuthnRequest")
+	}
+	if p.IDPEntityID != "" && a.Issuer != p.IDPEntityID {
+		return fmt.Errorf("unexpected Assertion Issuer %q", a.Issuer)
+	}
+
+	if !a.Conditions.NotBefore.IsZero() && now.Add(samlClockSkew).Before(a.Conditions.NotBefore) {
+		return errors.New("Assertion is not yet valid")
+	}
+	if !a.Conditions.NotOnOrAfter.IsZero() && !now.Add(-samlClockSkew).Before(a.Conditions.NotOnOrAfter) {
+		return errors.New("Assertion has expired")
+	}
+	for _, restriction := range a.Conditions.AudienceRestriction {
+		found := false
+		for _, audience := range restriction.Audience {
+			if audience == p.ClientID {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Assertion audience does not include %q", p.ClientID)
+		}
+	}
+
+	if a.Subject.NameID == "" {
+		return errors.New("Assertion is missing a Subject NameID")
+	}
+	for _, c := range a.Subject.SubjectConfirmation {
+		if c.Method != samlBearerMethod {
+			continue
+		}
+		data := c.SubjectConfirmationData
+		if data.Recipient != acsURL {
+			continue
+		}
+		if data.InResponseTo != requestID {
+			continue
+		}
+		if data.NotOnOrAfter.IsZero() || !now.Add(-samlClockSkew).Before(data.NotOnOrAfter) {
+			continue
+		}
+		return nil
+	}
+	return errors.New("Assertion has no valid bearer SubjectConfirmation")
+}
+
+func hasSignature(el *etree.Element) bool {
+	return childElement(el, "Signature") != nil
+}
+
+func childElement(el *etree.Element, tag string) *etree.Element {
+	for _, child := range el.ChildElements() {
+		if child.Tag == tag {
+			return child
+		}
+	}
+	return nil
+}
+
+func unmarshalElement(el *etree.Element, v interface{}) error {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("could not parse %s: %v", el.Tag, err)
+	}
+	return nil
+}
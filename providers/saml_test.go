@@ -0,0 +1,264 @@
+package providers
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testSAMLACS      = "https://proxy.example.com/oauth2/saml/acs"
+	testSAMLIssuer   = "https://idp.example.com/metadata"
+	testSAMLEntityID = "https://proxy.example.com/oauth2/saml/metadata"
+)
+
+func newSAMLProvider(ks dsig.X509KeyStore) *SAMLProvider {
+	p := NewSAMLProvider(&ProviderData{
+		ClientID: testSAMLEntityID,
+		LoginURL: &url.URL{Scheme: "https", Host: "idp.example.com", Path: "/sso"},
+	})
+	_, der, _ := ks.GetKeyPair()
+	cert, _ := x509.ParseCertificate(der)
+	p.IDPCertificates = []*x509.Certificate{cert}
+	p.IDPEntityID = testSAMLIssuer
+	return p
+}
+
+type samlTestAssertion struct {
+	InResponseTo string
+	Recipient    string
+	Audience     string
+	NotOnOrAfter time.Time
+	NameID       string
+	Attributes   map[string][]string
+}
+
+func defaultSAMLTestAssertion(p *SAMLProvider, relayState string) samlTestAssertion {
+	return samlTestAssertion{
+		InResponseTo: p.requestID(relayState),
+		Recipient:    testSAMLACS,
+		Audience:     testSAMLEntityID,
+		NotOnOrAfter: time.Now().Add(5 * time.Minute),
+		NameID:       "jdoe",
+		Attributes: map[string][]string{
+			"email":  {"jdoe@example.com"},
+			"groups": {"admins", "ops"},
+		},
+	}
+}
+
+func (a samlTestAssertion) element() *etree.Element {
+	now := time.Now().UTC().Format(time.RFC3339)
+	expires := a.NotOnOrAfter.UTC().Format(time.RFC3339)
+	el := etree.NewElement("saml:Assertion")
+	el.CreateAttr("xmlns:saml", samlAssertionNS)
+	el.CreateAttr("ID", "assertion-1")
+	el.CreateAttr("Version", "2.0")
+	el.CreateAttr("IssueInstant", now)
+	el.CreateElement("saml:Issuer").SetText(testSAMLIssuer)
+
+	subject := el.CreateElement("saml:Subject")
+	subject.CreateElement("saml:NameID").SetText(a.NameID)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", samlBearerMethod)
+	data := confirmation.CreateElement("saml:SubjectConfirmationData")
+	data.CreateAttr("InResponseTo", a.InResponseTo)
+	data.CreateAttr("Recipient", a.Recipient)
+	data.CreateAttr("NotOnOrAfter", expires)
+
+	conditions := el.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", now)
+	conditions.CreateAttr("NotOnOrAfter", expires)
+	restriction := conditions.CreateElement("saml:AudienceRestriction")
+	restriction.CreateElement("saml:Audience").SetText(a.Audience)
+
+	statement := el.CreateElement("saml:AttributeStatement")
+	for name, values := range a.Attributes {
+		attr := statement.CreateElement("saml:Attribute")
+		attr.CreateAttr("Name", name)
+		for _, v := range values {
+			attr.CreateElement("saml:AttributeValue").SetText(v)
+		}
+	}
+	return el
+}
+
+func signSAMLElement(t *testing.T, ks dsig.X509KeyStore, el *etree.Element) *etree.Element {
+	ctx := dsig.NewDefaultSigningContext(ks)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signed, err := ctx.SignEnveloped(el)
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	return signed
+}
+
+func samlTestResponse(t *testing.T, assertion *etree.Element, signer dsig.X509KeyStore) string {
+	response := etree.NewElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", samlProtocolNS)
+	response.CreateAttr("ID", "response-1")
+	response.CreateAttr("Version", "2.0")
+	response.CreateAttr("Destination", testSAMLACS)
+	status := response.CreateElement("samlp:Status")
+	status.CreateElement("samlp:StatusCode").CreateAttr("Value", samlStatusOK)
+	response.AddChild(assertion)
+	if signer != nil {
+		response = signSAMLElement(t, signer, response)
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(response)
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestSAMLProviderDefaults(t *testing.T) {
+	p := NewSAMLProvider(&ProviderData{})
+	assert.Equal(t, "SAML", p.Data().ProviderName)
+	assert.Equal(t, "email", p.EmailAttribute)
+	assert.Equal(t, "groups", p.GroupsAttribute)
+}
+
+func TestSAMLProviderGetLoginURL(t *testing.T) {
+	p := newSAMLProvider(dsig.RandomKeyStoreForTest())
+	loginURL, err := url.Parse(p.GetLoginURL(testSAMLACS, "nonce:/app"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "idp.example.com", loginURL.Host)
+	assert.Equal(t, "nonce:/app", loginURL.Query().Get("RelayState"))
+
+	deflated, err := base64.StdEncoding.DecodeString(loginURL.Query().Get("SAMLRequest"))
+	assert.Equal(t, nil, err)
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	assert.Equal(t, nil, err)
+	request := string(raw)
+	assert.Contains(t, request, "<samlp:AuthnRequest")
+	assert.Contains(t, request, fmt.Sprintf(`ID="%s"`, p.requestID("nonce:/app")))
+	assert.Contains(t, request, fmt.Sprintf(`AssertionConsumerServiceURL="%s"`, testSAMLACS))
+	assert.Contains(t, request, fmt.Sprintf("<saml:Issuer>%s</saml:Issuer>", testSAMLEntityID))
+}
+
+func TestSAMLProviderMetadata(t *testing.T) {
+	p := newSAMLProvider(dsig.RandomKeyStoreForTest())
+	metadata, err := p.Metadata(testSAMLACS)
+	assert.Equal(t, nil, err)
+	assert.Contains(t, string(metadata), fmt.Sprintf(`entityID="%s"`, testSAMLEntityID))
+	assert.Contains(t, string(metadata), fmt.Sprintf(`Location="%s"`, testSAMLACS))
+	assert.Contains(t, string(metadata), `WantAssertionsSigned="true"`)
+}
+
+func TestSAMLProviderSignedAssertion(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	p := newSAMLProvider(ks)
+	assertion := signSAMLElement(t, ks, defaultSAMLTestAssertion(p, "nonce:/").element())
+
+	session, err := p.ConsumeResponse(testSAMLACS, samlTestResponse(t, assertion, nil), "nonce:/")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe", session.User)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+	assert.Equal(t, []string{"admins", "ops"}, session.Groups)
+}
+
+func TestSAMLProviderSignedResponse(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	p := newSAMLProvider(ks)
+	a := defaultSAMLTestAssertion(p, "nonce:/")
+	a.NameID = "jdoe@example.com"
+	delete(a.Attributes, "email")
+
+	session, err := p.ConsumeResponse(testSAMLACS, samlTestResponse(t, a.element(), ks), "nonce:/")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "jdoe@example.com", session.Email)
+}
+
+func TestSAMLProviderCustomAttributes(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	p := newSAMLProvider(ks)
+	p.EmailAttribute = "mail"
+	p.UserAttribute = "uid"
+	p.GroupsAttribute = "memberOf"
+	a := defaultSAMLTestAssertion(p, "nonce:/")
+	a.Attributes = map[string][]string{
+		"mail":     {"john@example.com"},
+		"uid":      {"john"},
+		"memberOf": {"devs"},
+	}
+	assertion := signSAMLElement(t, ks, a.element())
+
+	session, err := p.ConsumeResponse(testSAMLACS, samlTestResponse(t, assertion, nil), "nonce:/")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "john", session.User)
+	assert.Equal(t, "john@example.com", session.Email)
+	assert.Equal(t, []string{"devs"}, session.Groups)
+}
+
+func TestSAMLProviderRejectsUnsigned(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	p := newSAMLProvider(ks)
+	a := defaultSAMLTestAssertion(p, "nonce:/")
+
+	_, err := p.ConsumeResponse(testSAMLACS, samlTestResponse(t, a.element(), nil), "nonce:/")
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "signed")
+}
+
+func TestSAMLProviderRejectsUntrustedSigner(t *testing.T) {
+	p := newSAMLProvider(dsig.RandomKeyStoreForTest())
+	other := dsig.RandomKeyStoreForTest()
+	assertion := signSAMLElement(t, other, defaultSAMLTestAssertion(p, "nonce:/").element())
+
+	_, err := p.ConsumeResponse(testSAMLACS, samlTestResponse(t, assertion, nil), "nonce:/")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSAMLProviderRejectsTamperedAssertion(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	p := newSAMLProvider(ks)
+	assertion := signSAMLElement(t, ks, defaultSAMLTestAssertion(p, "nonce:/").element())
+	assertion.FindElement("./Subject/NameID").SetText("admin")
+
+	_, err := p.ConsumeResponse(testSAMLACS, samlTestResponse(t, assertion, nil), "nonce:/")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSAMLProviderRejectsInvalidConditions(t *testing.T) {
+	ks := dsig.RandomKeyStoreForTest()
+	p := newSAMLProvider(ks)
+
+	tests := map[string]func(a *samlTestAssertion){
+		"expired":          func(a *samlTestAssertion) { a.NotOnOrAfter = time.Now().Add(-time.Hour) },
+		"wrong audience":   func(a *samlTestAssertion) { a.Audience = "https://other.example.com" },
+		"wrong recipient":  func(a *samlTestAssertion) { a.Recipient = "https://other.example.com/acs" },
+		"wrong request id": func(a *samlTestAssertion) { a.InResponseTo = p.requestID("other:/") },
+	}
+	for name, modify := range tests {
+		a := defaultSAMLTestAssertion(p, "nonce:/")
+		modify(&a)
+		assertion := signSAMLElement(t, ks, a.element())
+		_, err := p.ConsumeResponse(testSAMLACS, samlTestResponse(t, assertion, nil), "nonce:/")
+		assert.NotEqual(t, nil, err, name)
+	}
+}
+
+func TestSAMLProviderRejectsGarbage(t *testing.T) {
+	p := newSAMLProvider(dsig.RandomKeyStoreForTest())
+	_, err := p.ConsumeResponse(testSAMLACS, "not base64!", "nonce:/")
+	assert.NotEqual(t, nil, err)
+
+	_, err = p.ConsumeResponse(testSAMLACS, base64.StdEncoding.EncodeToString([]byte("<foo/>")), "nonce:/")
+	assert.NotEqual(t, nil, err)
+	assert.True(t, strings.Contains(err.Error(), "Response"))
+}
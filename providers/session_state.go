@@ -2,6 +2,7 @@ package providers
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +16,15 @@ type SessionState struct {
 	RefreshToken string
 	Email        string
 	User         string
+	Groups       []string
+	// Subject is the provider's stable identifier for the user, such as
+	// the OIDC sub claim; empty when the provider has none
+	Subject string
+	// Provider names the provider that issued the session when several
+	// named providers are configured; empty for the default provider
+	Provider string
+	// AuthTime is when the user last authenticated at the provider
+	AuthTime time.Time
 }
 
 func (s *SessionState) IsExpired() bool {
@@ -46,7 +56,45 @@ func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 }
 
 func (s *SessionState) accountInfo() string {
-	return fmt.Sprintf("email:%s user:%s", s.Email, s.User)
+	info := fmt.Sprintf("email:%s user:%s", s.Email, s.User)
+	if len(s.Groups) > 0 {
+		info += " groups:" + encodeGroups(s.Groups)
+	}
+	if s.Provider != "" {
+		info += " provider:" + url.QueryEscape(s.Provider)
+	}
+	if !s.AuthTime.IsZero() {
+		info += fmt.Sprintf(" auth_time:%d", s.AuthTime.Unix())
+	}
+	if s.Subject != "" {
+		info += " sub:" + url.QueryEscape(s.Subject)
+	}
+	return info
+}
+
+// encodeGroups escapes each group name so the list survives the space and
+// pipe delimited cookie format
+func encodeGroups(groups []string) string {
+	escaped := make([]string, len(groups))
+	for i, g := range groups {
+		escaped[i] = url.QueryEscape(g)
+	}
+	return strings.Join(escaped, ",")
+}
+
+func decodeGroups(v string) ([]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	var groups []string
+	for _, g := range strings.Split(v, ",") {
+		group, err := url.QueryUnescape(g)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode session groups: %v", err)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
 }
 
 func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
@@ -71,8 +119,8 @@ func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 
 func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	chunks := strings.Split(v, " ")
-	if len(chunks) != 2 {
-		return nil, fmt.Errorf("could not decode session state: expected 2 chunks got %d", len(chunks))
+	if len(chunks) < 2 {
+		return nil, fmt.Errorf("could not decode session state: expected at least 2 chunks got %d", len(chunks))
 	}
 
 	email := strings.TrimPrefix(chunks[0], "email:")
@@ -81,7 +129,32 @@ func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 		user = strings.Split(email, "@")[0]
 	}
 
-	return &SessionState{User: user, Email: email}, nil
+	s = &SessionState{User: user, Email: email}
+	for _, chunk := range chunks[2:] {
+		switch {
+		case strings.HasPrefix(chunk, "groups:"):
+			if s.Groups, err = decodeGroups(strings.TrimPrefix(chunk, "groups:")); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(chunk, "provider:"):
+			if s.Provider, err = url.QueryUnescape(strings.TrimPrefix(chunk, "provider:")); err != nil {
+				return nil, fmt.Errorf("could not decode session provider: %v", err)
+			}
+		case strings.HasPrefix(chunk, "auth_time:"):
+			ts, err := strconv.ParseInt(strings.TrimPrefix(chunk, "auth_time:"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not decode session auth time: %v", err)
+			}
+			s.AuthTime = time.Unix(ts, 0)
+		case strings.HasPrefix(chunk, "sub:"):
+			if s.Subject, err = url.QueryUnescape(strings.TrimPrefix(chunk, "sub:")); err != nil {
+				return nil, fmt.Errorf("could not decode session subject: %v", err)
+			}
+		default:
+			return nil, fmt.Errorf("could not decode session state: unexpected chunk %q", chunk)
+		}
+	}
+	return s, nil
 }
 
 func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
@@ -127,6 +127,48 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationWithGroups(t *testing.T) {
+	s := &SessionState{
+		User:   "just-user",
+		Email:  "user@domain.com",
+		Groups: []string{"admins", "ops team", "a,b|c"},
+	}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user:just-user groups:admins,ops+team,a%2Cb%7Cc", encoded)
+
+	ss, err := DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.User, ss.User)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.Groups, ss.Groups)
+}
+
+func TestSessionStateSerializationWithProvider(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		Groups:      []string{"devs"},
+		Provider:    "github",
+	}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: groups:devs provider:github", encoded)
+
+	encoded, err = s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "github", ss.Provider)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+
+	_, err = DecodeSessionState("email:user@domain.com user: bogus:1", nil)
+	assert.NotEqual(t, nil, err)
+}
+
 func TestSessionStateAccountInfo(t *testing.T) {
 	s := &SessionState{
 		Email: "user@domain.com",
@@ -150,3 +192,29 @@ func TestExpired(t *testing.T) {
 	s = &SessionState{}
 	assert.Equal(t, false, s.IsExpired())
 }
+
+func TestSessionStateSerializationWithAuthTime(t *testing.T) {
+	authTime := time.Unix(1600000000, 0)
+	s := &SessionState{Email: "user@domain.com", User: "user", AuthTime: authTime}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user:user auth_time:1600000000", encoded)
+
+	ss, err := DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, authTime, ss.AuthTime)
+
+	_, err = DecodeSessionState("email:user@domain.com user:user auth_time:soon", nil)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSessionStateSerializationWithSubject(t *testing.T) {
+	s := &SessionState{Email: "user@domain.com", User: "user", Subject: "248289761001 x"}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user:user sub:248289761001+x", encoded)
+
+	ss, err := DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "248289761001 x", ss.Subject)
+}
@@ -0,0 +1,78 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+)
+
+// Grant and token types from RFC 8693
+const (
+	TokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	AccessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// ExchangedToken is an access token minted by a token exchange. ExpiresOn
+// is zero when the provider did not report a lifetime.
+type ExchangedToken struct {
+	AccessToken string
+	ExpiresOn   time.Time
+}
+
+// ExchangeToken trades subjectToken at the token endpoint for an access
+// token restricted to the given audience, resource and scope
+func (p *ProviderData) ExchangeToken(subjectToken, audience, resource, scope string) (*ExchangedToken, error) {
+	if subjectToken == "" {
+		return nil, errors.New("missing subject token")
+	}
+	params := url.Values{}
+	params.Set("grant_type", TokenExchangeGrantType)
+	params.Set("subject_token", subjectToken)
+	params.Set("subject_token_type", AccessTokenType)
+	params.Set("requested_token_type", AccessTokenType)
+	if audience != "" {
+		params.Set("audience", audience)
+	}
+	if resource != "" {
+		params.Set("resource", resource)
+	}
+	if scope != "" {
+		params.Set("scope", scope)
+	}
+	req, err := p.newTokenRequest(params, ClientSecretPost)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var jsonResponse struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return nil, err
+	}
+	if jsonResponse.AccessToken == "" {
+		return nil, fmt.Errorf("no access token found %s", body)
+	}
+	token := &ExchangedToken{AccessToken: jsonResponse.AccessToken}
+	if expiresIn, err := jsonResponse.ExpiresIn.Int64(); err == nil && expiresIn > 0 {
+		token.ExpiresOn = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	return token, nil
+}
@@ -0,0 +1,53 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeToken(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		w.Write([]byte(`{"access_token": "orders_token", "issued_token_type": "` + AccessTokenType + `", "expires_in": 300}`))
+	}))
+	defer server.Close()
+	redeemURL, _ := url.Parse(server.URL)
+	p := &ProviderData{ClientID: "client", ClientSecret: "secret", RedeemURL: redeemURL}
+
+	token, err := p.ExchangeToken("user_token", "orders-api", "", "orders.read")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "orders_token", token.AccessToken)
+	assert.WithinDuration(t, time.Now().Add(300*time.Second), token.ExpiresOn, 5*time.Second)
+
+	assert.Equal(t, TokenExchangeGrantType, form.Get("grant_type"))
+	assert.Equal(t, "user_token", form.Get("subject_token"))
+	assert.Equal(t, AccessTokenType, form.Get("subject_token_type"))
+	assert.Equal(t, "orders-api", form.Get("audience"))
+	assert.Equal(t, "orders.read", form.Get("scope"))
+	assert.Equal(t, "", form.Get("resource"))
+	assert.Equal(t, "client", form.Get("client_id"))
+}
+
+func TestExchangeTokenErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error": "invalid_target"}`))
+	}))
+	defer server.Close()
+	redeemURL, _ := url.Parse(server.URL)
+	p := &ProviderData{ClientID: "client", ClientSecret: "secret", RedeemURL: redeemURL}
+
+	_, err := p.ExchangeToken("user_token", "orders-api", "", "")
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid_target")
+
+	_, err = p.ExchangeToken("", "orders-api", "", "")
+	assert.NotEqual(t, nil, err)
+}
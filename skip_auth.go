@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// SkipAuthRuleOptions configures one rule bypassing authentication, read
+// from [[skip_auth_rules]] tables in the config file
+type SkipAuthRuleOptions struct {
+	Host      string   `toml:"host"`
+	PathRegex string   `toml:"path_regex"`
+	Methods   []string `toml:"methods"`
+}
+
+// SkipAuthRule bypasses authentication for requests matching all of its
+// host, path and methods. An empty Host or Methods matches every request.
+type SkipAuthRule struct {
+	Host    string
+	Path    *regexp.Regexp
+	Methods []string
+}
+
+// LoadSkipAuthRules reads the [[skip_auth_rules]] tables of a config file
+func LoadSkipAuthRules(path string) ([]SkipAuthRuleOptions, error) {
+	var cfg struct {
+		SkipAuthRules []SkipAuthRuleOptions `toml:"skip_auth_rules"`
+	}
+	_, err := toml.DecodeFile(path, &cfg)
+	return cfg.SkipAuthRules, err
+}
+
+// parseSkipAuthRules compiles the skip-auth-regex options and the
+// [[skip_auth_rules]] tables. Plain regexes keep populating CompiledRegex;
+// host prefixed ones become rules without methods.
+func parseSkipAuthRules(o *Options, msgs []string) []string {
+	o.CompiledRegex = nil
+	o.skipAuthRules = nil
+	for _, u := range o.SkipAuthRegex {
+		host, regex := splitHostPrefix(u)
+		CompiledRegex, err := regexp.Compile(regex)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling regex=%q %s", u, err))
+			continue
+		}
+		if host != "" {
+			o.skipAuthRules = append(o.skipAuthRules, &SkipAuthRule{Host: host, Path: CompiledRegex})
+			continue
+		}
+		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
+	}
+
+	for i, ro := range o.SkipAuthRules {
+		prefix := fmt.Sprintf("skip_auth_rules[%d]", i)
+		rule := &SkipAuthRule{Host: strings.ToLower(ro.Host)}
+		var ruleMsgs []string
+		if rule.Host != "" && !hostPatternRegexp.MatchString(rule.Host) {
+			ruleMsgs = append(ruleMsgs, fmt.Sprintf("invalid host %q", ro.Host))
+		}
+		if ro.PathRegex == "" {
+			ruleMsgs = append(ruleMsgs, "missing setting: path_regex")
+		} else {
+			var err error
+			if rule.Path, err = regexp.Compile(ro.PathRegex); err != nil {
+				ruleMsgs = append(ruleMsgs, fmt.Sprintf("error compiling path_regex=%q %s", ro.PathRegex, err))
+			}
+		}
+		for _, m := range ro.Methods {
+			m = strings.ToUpper(m)
+			if !methodRegexp.MatchString(m) {
+				ruleMsgs = append(ruleMsgs, fmt.Sprintf("invalid method %q", m))
+			}
+			rule.Methods = append(rule.Methods, m)
+		}
+
+		if len(ruleMsgs) != 0 {
+			for _, m := range ruleMsgs {
+				msgs = append(msgs, fmt.Sprintf("%s: %s", prefix, m))
+			}
+			continue
+		}
+		o.skipAuthRules = append(o.skipAuthRules, rule)
+	}
+	return msgs
+}
+
+// Matches reports whether req may skip authentication under the rule
+func (r *SkipAuthRule) Matches(req *http.Request) bool {
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return false
+	}
+	if !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == req.Method {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *SkipAuthRule) String() string {
+	s := "SkipAuthRule{"
+	if len(r.Methods) != 0 {
+		s += "methods:" + strings.Join(r.Methods, ",") + " "
+	}
+	if r.Host != "" {
+		s += "host:" + r.Host + " "
+	}
+	return s + "path:" + r.Path.String() + "}"
+}
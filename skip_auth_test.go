@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSkipAuthRules(t *testing.T) {
+	f, _ := ioutil.TempFile("", "oauth2_proxy_cfg")
+	defer os.Remove(f.Name())
+	f.WriteString(`
+skip_auth_regex = ["^/static/"]
+
+[[skip_auth_rules]]
+methods = ["GET", "HEAD"]
+path_regex = "^/api/health$"
+
+[[skip_auth_rules]]
+host = "ci.example.com"
+methods = ["POST"]
+path_regex = "^/webhooks/github$"
+`)
+	f.Close()
+
+	rules, err := LoadSkipAuthRules(f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []SkipAuthRuleOptions{
+		{Methods: []string{"GET", "HEAD"}, PathRegex: "^/api/health$"},
+		{Host: "ci.example.com", Methods: []string{"POST"}, PathRegex: "^/webhooks/github$"},
+	}, rules)
+}
+
+func TestSkipAuthRulesValidation(t *testing.T) {
+	o := testOptions()
+	o.SkipAuthRules = []SkipAuthRuleOptions{
+		{PathRegex: "^/ok$"},
+		{Host: "ci.example.com"},
+		{Host: "ci.*.com", PathRegex: "("},
+		{Methods: []string{"get", "NOT A METHOD"}, PathRegex: "/"},
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "skip_auth_rules[1]: missing setting: path_regex")
+	assert.Contains(t, err.Error(), `skip_auth_rules[2]: invalid host "ci.*.com"`)
+	assert.Contains(t, err.Error(), `skip_auth_rules[2]: error compiling path_regex="("`)
+	assert.Contains(t, err.Error(), `skip_auth_rules[3]: invalid method "NOT A METHOD"`)
+	assert.Equal(t, 1, len(o.skipAuthRules))
+}
+
+func TestSkipAuthRules(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{"^/static/", "status.example.com=^/"}
+	opts.SkipAuthRules = []SkipAuthRuleOptions{
+		{Methods: []string{"get", "HEAD"}, PathRegex: "^/api/health$"},
+		{Host: "ci.example.com", Methods: []string{"POST"}, PathRegex: "^/webhooks/github$"},
+	}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	tests := []struct {
+		method, host, path string
+		skip               bool
+	}{
+		{"GET", "app.example.com", "/api/health", true},
+		{"HEAD", "app.example.com", "/api/health", true},
+		{"POST", "app.example.com", "/api/health", false},
+		{"GET", "app.example.com", "/api/health/details", false},
+		{"POST", "ci.example.com", "/webhooks/github", true},
+		{"POST", "ci.example.com:443", "/webhooks/github", true},
+		{"GET", "ci.example.com", "/webhooks/github", false},
+		{"POST", "app.example.com", "/webhooks/github", false},
+		// skip-auth-regex keeps working as shorthand for every method
+		{"DELETE", "app.example.com", "/static/app.js", true},
+		{"POST", "status.example.com", "/incidents", true},
+		{"POST", "app.example.com", "/incidents", false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Host = tc.host
+		assert.Equal(t, tc.skip, proxy.IsWhitelistedRequest(req), tc.method+" "+tc.host+tc.path)
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		if tc.skip {
+			assert.Equal(t, http.StatusOK, rw.Code, tc.method+" "+tc.host+tc.path)
+		} else {
+			assert.Equal(t, http.StatusForbidden, rw.Code, tc.method+" "+tc.host+tc.path)
+		}
+	}
+}
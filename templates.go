@@ -110,13 +110,16 @@ func getTemplates() *template.Template {
 </head>
 <body>
 	<div class="signin center">
-	<form method="GET" action="{{.ProxyPrefix}}/start">
-	<input type="hidden" name="rd" value="{{.Redirect}}">
 	{{ if .SignInMessage }}
 	<p>{{.SignInMessage}}</p>
 	{{ end}}
-	<button type="submit" class="btn">Sign in with {{.ProviderName}}</button><br/>
+	{{ range .Providers }}
+	<form method="GET" action="{{$.ProxyPrefix}}/start">
+	<input type="hidden" name="rd" value="{{$.Redirect}}">
+	{{ if .Name }}<input type="hidden" name="provider" value="{{.Name}}">{{ end }}
+	<button type="submit" class="btn">Sign in with {{.DisplayName}}</button><br/>
 	</form>
+	{{ end }}
 	</div>
 
 	{{ if .CustomLogin }}
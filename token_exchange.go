@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+)
+
+// tokenExchangeExpirySkew retires cached tokens shortly before they expire
+// so upstreams never receive a token that lapses in flight
+const tokenExchangeExpirySkew = 30 * time.Second
+
+// TokenExchange configures an RFC 8693 token exchange for one upstream. The
+// session access token is exchanged for a token with this audience, resource
+// and scope before it is passed upstream.
+type TokenExchange struct {
+	Upstream string
+	Audience string
+	Resource string
+	Scope    string
+}
+
+// parseTokenExchange parses a token-exchange option of the form
+// "upstream=[<host>=]<url>,audience=<aud>[,resource=<uri>][,scope=<scopes>]"
+// where scopes are space separated
+func parseTokenExchange(spec string) (*TokenExchange, error) {
+	te := &TokenExchange{}
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected key=value, got %q", part)
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "upstream":
+			u, err := parseUpstream(value)
+			if err != nil {
+				return nil, err
+			}
+			te.Upstream = u.String()
+		case "audience":
+			te.Audience = value
+		case "resource":
+			te.Resource = value
+		case "scope":
+			te.Scope = value
+		default:
+			return nil, fmt.Errorf("unknown key %q", kv[0])
+		}
+	}
+	if te.Upstream == "" {
+		return nil, fmt.Errorf("missing upstream")
+	}
+	if te.Audience == "" && te.Resource == "" && te.Scope == "" {
+		return nil, fmt.Errorf("one of audience, resource or scope is required")
+	}
+	return te, nil
+}
+
+// TokenExchangeCache holds exchanged tokens per session and upstream
+// configuration until they expire
+type TokenExchangeCache struct {
+	mu     sync.Mutex
+	tokens map[string]*providers.ExchangedToken
+	now    func() time.Time
+}
+
+func NewTokenExchangeCache() *TokenExchangeCache {
+	return &TokenExchangeCache{
+		tokens: make(map[string]*providers.ExchangedToken),
+		now:    time.Now,
+	}
+}
+
+func tokenExchangeKey(session *providers.SessionState, te *TokenExchange) string {
+	h := sha256.New()
+	for _, v := range []string{session.AccessToken, te.Audience, te.Resource, te.Scope} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Exchange returns a token for te, exchanging the session access token at
+// the provider when no unexpired token is cached
+func (c *TokenExchangeCache) Exchange(provider providers.Provider, session *providers.SessionState, te *TokenExchange) (string, error) {
+	key := tokenExchangeKey(session, te)
+	now := c.now()
+
+	c.mu.Lock()
+	token, ok := c.tokens[key]
+	c.mu.Unlock()
+	if ok && now.Before(token.ExpiresOn) {
+		return token.AccessToken, nil
+	}
+
+	token, err := provider.Data().ExchangeToken(session.AccessToken, te.Audience, te.Resource, te.Scope)
+	if err != nil {
+		return "", err
+	}
+
+	// without a reported lifetime the token may live as long as the session
+	expires := token.ExpiresOn
+	if expires.IsZero() {
+		expires = session.ExpiresOn
+	}
+	if !expires.IsZero() {
+		c.mu.Lock()
+		for k, t := range c.tokens {
+			if !now.Before(t.ExpiresOn) {
+				delete(c.tokens, k)
+			}
+		}
+		c.tokens[key] = &providers.ExchangedToken{
+			AccessToken: token.AccessToken,
+			ExpiresOn:   expires.Add(-tokenExchangeExpirySkew),
+		}
+		c.mu.Unlock()
+	}
+	return token.AccessToken, nil
+}
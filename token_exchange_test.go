@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/d-cheremnov/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTokenExchange(t *testing.T) {
+	te, err := parseTokenExchange("upstream=http://127.0.0.1:8081, audience=orders-api,scope=orders.read orders.write")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, &TokenExchange{
+		Upstream: "http://127.0.0.1:8081/",
+		Audience: "orders-api",
+		Scope:    "orders.read orders.write",
+	}, te)
+
+	te, err = parseTokenExchange("upstream=http://127.0.0.1:8081/api/,resource=https://api.example.com")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "http://127.0.0.1:8081/api/", te.Upstream)
+	assert.Equal(t, "https://api.example.com", te.Resource)
+
+	for _, spec := range []string{
+		"audience=orders-api",
+		"upstream=http://127.0.0.1:8081/",
+		"upstream=http://127.0.0.1:8081/,audience",
+		"upstream=http://127.0.0.1:8081/,issuer=foo",
+	} {
+		_, err := parseTokenExchange(spec)
+		assert.NotEqual(t, nil, err, spec)
+	}
+}
+
+type tokenExchangeServer struct {
+	server    *httptest.Server
+	exchanges int
+	expiresIn string
+}
+
+func newTokenExchangeServer() *tokenExchangeServer {
+	s := &tokenExchangeServer{expiresIn: "300"}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.exchanges++
+		w.Write([]byte(`{"access_token": "` + r.PostForm.Get("audience") + `:` +
+			r.PostForm.Get("subject_token") + `", "expires_in": ` + s.expiresIn + `}`))
+	}))
+	return s
+}
+
+func (s *tokenExchangeServer) provider() providers.Provider {
+	redeemURL, _ := url.Parse(s.server.URL)
+	return providers.New("oidc", &providers.ProviderData{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedeemURL:    redeemURL,
+	})
+}
+
+func TestTokenExchangeCache(t *testing.T) {
+	s := newTokenExchangeServer()
+	defer s.server.Close()
+	now := time.Now()
+	cache := NewTokenExchangeCache()
+	cache.now = func() time.Time { return now }
+
+	orders := &TokenExchange{Audience: "orders"}
+	billing := &TokenExchange{Audience: "billing"}
+	alice := &providers.SessionState{AccessToken: "alice"}
+	bob := &providers.SessionState{AccessToken: "bob"}
+
+	token, err := cache.Exchange(s.provider(), alice, orders)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "orders:alice", token)
+	token, _ = cache.Exchange(s.provider(), alice, orders)
+	assert.Equal(t, "orders:alice", token)
+	assert.Equal(t, 1, s.exchanges)
+
+	token, _ = cache.Exchange(s.provider(), bob, orders)
+	assert.Equal(t, "orders:bob", token)
+	token, _ = cache.Exchange(s.provider(), alice, billing)
+	assert.Equal(t, "billing:alice", token)
+	assert.Equal(t, 3, s.exchanges)
+
+	// cached tokens are retired shortly before they expire
+	now = now.Add(300*time.Second - tokenExchangeExpirySkew + time.Second)
+	cache.Exchange(s.provider(), alice, orders)
+	assert.Equal(t, 4, s.exchanges)
+}
+
+func TestTokenExchangeCacheWithoutLifetime(t *testing.T) {
+	s := newTokenExchangeServer()
+	defer s.server.Close()
+	s.expiresIn = "0"
+	cache := NewTokenExchangeCache()
+	orders := &TokenExchange{Audience: "orders"}
+
+	// nothing is cached when neither the token nor the session expire
+	session := &providers.SessionState{AccessToken: "alice"}
+	cache.Exchange(s.provider(), session, orders)
+	cache.Exchange(s.provider(), session, orders)
+	assert.Equal(t, 2, s.exchanges)
+
+	session = &providers.SessionState{AccessToken: "bob", ExpiresOn: time.Now().Add(time.Hour)}
+	cache.Exchange(s.provider(), session, orders)
+	cache.Exchange(s.provider(), session, orders)
+	assert.Equal(t, 3, s.exchanges)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// IPSet is a list of IPv4 and IPv6 networks
+type IPSet []*net.IPNet
+
+// parseIPSet parses CIDRs and bare addresses, which stand for a single host
+func parseIPSet(option string, specs []string, msgs []string) (IPSet, []string) {
+	var set IPSet
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				msgs = append(msgs, fmt.Sprintf("invalid %s=%q expected an IP address or CIDR", option, spec))
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			set = append(set, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(spec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid %s=%q %s", option, spec, err))
+			continue
+		}
+		set = append(set, ipNet)
+	}
+	return set, msgs
+}
+
+// Contains reports whether ip falls in one of the networks
+func (s IPSet) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range s {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of the immediate peer of req, or nil for peers
+// without an IP address such as unix sockets
+func peerIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ClientIPResolver finds the IP address of the client behind a chain of
+// trusted proxies
+type ClientIPResolver struct {
+	Header         string
+	TrustedProxies IPSet
+}
+
+// ClientIP returns the IP address of the client. Header is only believed
+// when the immediate peer is a trusted proxy. For X-Forwarded-For and
+// Forwarded the hops are walked from right to left and the first one that
+// is not a trusted proxy is the client.
+func (r *ClientIPResolver) ClientIP(req *http.Request) net.IP {
+	ip := peerIP(req)
+	if r == nil || r.Header == "" || !r.TrustedProxies.Contains(ip) {
+		return ip
+	}
+	hops := forwardedHops(req, r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			// an obfuscated or malformed hop ends the chain we can verify
+			break
+		}
+		ip = hop
+		if !r.TrustedProxies.Contains(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// LogClient returns the client address to log for req. Without trusted
+// proxies Header is logged as the client sent it, as it was before trusted
+// proxies could be configured, since logs make no decision on it.
+func (r *ClientIPResolver) LogClient(req *http.Request) string {
+	if r != nil && r.Header != "" && len(r.TrustedProxies) == 0 {
+		if hops := forwardedHops(req, r.Header); len(hops) != 0 && hops[0] != "" {
+			return hops[0]
+		}
+	}
+	if ip := r.ClientIP(req); ip != nil {
+		return ip.String()
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// forwardedHops returns the addresses recorded in header, closest to the
+// client first
+func forwardedHops(req *http.Request, header string) []string {
+	var hops []string
+	switch http.CanonicalHeaderKey(header) {
+	case "X-Forwarded-For":
+		for _, v := range req.Header.Values(header) {
+			for _, hop := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	case "Forwarded":
+		for _, v := range req.Header.Values(header) {
+			for _, element := range strings.Split(v, ",") {
+				if hop, ok := forwardedFor(element); ok {
+					hops = append(hops, hop)
+				}
+			}
+		}
+	default:
+		if v := strings.TrimSpace(req.Header.Get(header)); v != "" {
+			hops = append(hops, v)
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the address in the "for" parameter of an RFC 7239
+// Forwarded element, without quotes, brackets or port
+func forwardedFor(element string) (string, bool) {
+	for _, pair := range strings.Split(element, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "for") {
+			continue
+		}
+		node := strings.Trim(kv[1], `"`)
+		if strings.HasPrefix(node, "[") {
+			if end := strings.Index(node, "]"); end != -1 {
+				return node[1:end], true
+			}
+			return node, true
+		}
+		if host, _, err := net.SplitHostPort(node); err == nil {
+			return host, true
+		}
+		return node, true
+	}
+	return "", false
+}
+
+// IsTrustedIPRequest reports whether req comes from a trusted network and
+// may skip authentication
+func (p *OAuthProxy) IsTrustedIPRequest(req *http.Request) bool {
+	return len(p.trustedIPs) != 0 && p.trustedIPs.Contains(p.clientIPResolver.ClientIP(req))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPSet(t *testing.T) {
+	set, msgs := parseIPSet("trusted-ip", []string{"10.0.0.0/8", "192.0.2.7", "fd00::/8", "2001:db8::1", "10.0.0.0/33", "not-an-ip"}, nil)
+	assert.Equal(t, []string{
+		`invalid trusted-ip="10.0.0.0/33" invalid CIDR address: 10.0.0.0/33`,
+		`invalid trusted-ip="not-an-ip" expected an IP address or CIDR`,
+	}, msgs)
+	assert.Equal(t, 4, len(set))
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"::ffff:192.0.2.7", true},
+		{"fd12::1", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.contains, set.Contains(net.ParseIP(tc.ip)), tc.ip)
+	}
+	assert.False(t, set.Contains(nil))
+}
+
+func TestTrustedIPBypass(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.TrustedIPs = []string{"10.0.0.0/8", "fd00::/8"}
+	opts.TrustedProxyIPs = []string{"192.0.2.1"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		trusted    bool
+	}{
+		{"trusted IPv4 peer", "10.1.2.3:5000", "", true},
+		{"trusted IPv6 peer", "[fd00::5]:5000", "", true},
+		{"untrusted peer", "198.51.100.1:5000", "", false},
+		{"untrusted peer spoofing header", "198.51.100.1:5000", "10.1.2.3", false},
+		{"trusted proxy forwarding trusted client", "192.0.2.1:5000", "10.1.2.3", true},
+		{"trusted proxy forwarding untrusted client", "192.0.2.1:5000", "198.51.100.1", false},
+		{"trusted proxy without header", "192.0.2.1:5000", "", false},
+		{"trusted peer spoofing untrusted header", "10.1.2.3:5000", "198.51.100.1", true},
+		{"unix socket", "@", "", false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		assert.Equal(t, tc.trusted, proxy.IsWhitelistedRequest(req), tc.name)
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		if tc.trusted {
+			assert.Equal(t, http.StatusOK, rw.Code, tc.name)
+		} else {
+			assert.Equal(t, http.StatusForbidden, rw.Code, tc.name)
+		}
+	}
+}
+
+func TestClientIPResolver(t *testing.T) {
+	proxies, _ := parseIPSet("trusted-proxy-ip", []string{"127.0.0.1", "10.0.0.0/24", "2001:db8::/32"}, nil)
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		values     []string
+		expected   string
+	}{
+		{"no header configured", "", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"untrusted peer spoofing", "X-Forwarded-For", "198.51.100.1:5000", []string{"10.0.0.5"}, "198.51.100.1"},
+		{"trusted peer without header", "X-Forwarded-For", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"single hop", "X-Real-IP", "127.0.0.1:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"rightmost untrusted hop", "X-Forwarded-For", "127.0.0.1:5000", []string{"1.2.3.4, 203.0.113.9, 10.0.0.7"}, "203.0.113.9"},
+		{"hops across header lines", "X-Forwarded-For", "127.0.0.1:5000", []string{"1.2.3.4", "203.0.113.9", "10.0.0.7"}, "203.0.113.9"},
+		{"all hops trusted", "X-Forwarded-For", "127.0.0.1:5000", []string{"10.0.0.8, 10.0.0.7"}, "10.0.0.8"},
+		{"malformed hop", "X-Forwarded-For", "127.0.0.1:5000", []string{"203.0.113.9, garbage, 10.0.0.7"}, "10.0.0.7"},
+		{"forwarded", "Forwarded", "127.0.0.1:5000", []string{`for=1.2.3.4, for=203.0.113.9;proto=https, for=10.0.0.7`}, "203.0.113.9"},
+		{"forwarded ipv6", "Forwarded", "[::1]:5000", []string{`for="[2001:db8:cafe::17]:4711"`}, "::1"},
+		{"forwarded from ipv6 proxy", "Forwarded", "[2001:db8::1]:5000", []string{`for=192.0.2.60;proto=http;by=203.0.113.43`, `For="[2001:db9::17]:4711"`}, "2001:db9::17"},
+		{"forwarded with port", "Forwarded", "127.0.0.1:5000", []string{`for="203.0.113.9:8080"`}, "203.0.113.9"},
+		{"forwarded obfuscated", "Forwarded", "127.0.0.1:5000", []string{`for=_hidden, for=10.0.0.7`}, "10.0.0.7"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		for _, v := range tc.values {
+			req.Header.Add(tc.header, v)
+		}
+		r := &ClientIPResolver{Header: tc.header, TrustedProxies: proxies}
+		assert.Equal(t, tc.expected, r.ClientIP(req).String(), tc.name)
+	}
+
+	var r *ClientIPResolver
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.1:5000"
+	assert.Equal(t, "192.0.2.1", r.ClientIP(req).String())
+}
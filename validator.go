@@ -5,20 +5,41 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+// UserEntry is one line of the authenticated emails file: an email address
+// or glob pattern, optional groups and an optional expiry
+type UserEntry struct {
+	Pattern string
+	Groups  []string
+	Expires time.Time
+}
+
+// expired reports whether access granted by the entry has ended at now
+func (e *UserEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+type userEntries struct {
+	exact    map[string]*UserEntry
+	patterns []*UserEntry
+}
+
 type UserMap struct {
 	usersFile string
 	m         unsafe.Pointer
+	now       func() time.Time
 }
 
 func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
-	um := &UserMap{usersFile: usersFile}
-	m := make(map[string]bool)
-	atomic.StorePointer(&um.m, unsafe.Pointer(&m))
+	um := &UserMap{usersFile: usersFile, now: time.Now}
+	m := &userEntries{exact: make(map[string]*UserEntry)}
+	atomic.StorePointer(&um.m, unsafe.Pointer(m))
 	if usersFile != "" {
 		log.Printf("using authenticated emails file %s", usersFile)
 		WatchForUpdates(usersFile, done, func() {
@@ -30,12 +51,36 @@ func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	return um
 }
 
+// Lookup returns the entry granting access to email. Exact addresses are
+// checked before patterns, which are tried in file order; expired entries
+// are skipped.
+func (um *UserMap) Lookup(email string) (*UserEntry, bool) {
+	m := (*userEntries)(atomic.LoadPointer(&um.m))
+	now := um.now()
+	if e, ok := m.exact[email]; ok && !e.expired(now) {
+		return e, true
+	}
+	for _, e := range m.patterns {
+		if ok, _ := path.Match(e.Pattern, email); ok && !e.expired(now) {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
 func (um *UserMap) IsValid(email string) (result bool) {
-	m := *(*map[string]bool)(atomic.LoadPointer(&um.m))
-	_, result = m[email]
+	_, result = um.Lookup(email)
 	return
 }
 
+// Groups returns the groups the authenticated emails file assigns to email
+func (um *UserMap) Groups(email string) []string {
+	if e, ok := um.Lookup(strings.ToLower(email)); ok {
+		return e.Groups
+	}
+	return nil
+}
+
 func (um *UserMap) LoadAuthenticatedEmailsFile() {
 	r, err := os.Open(um.usersFile)
 	if err != nil {
@@ -46,22 +91,62 @@ func (um *UserMap) LoadAuthenticatedEmailsFile() {
 	csv_reader.Comma = ','
 	csv_reader.Comment = '#'
 	csv_reader.TrimLeadingSpace = true
+	csv_reader.FieldsPerRecord = -1
 	records, err := csv_reader.ReadAll()
 	if err != nil {
 		log.Printf("error reading authenticated-emails-file=%q, %s", um.usersFile, err)
 		return
 	}
-	updated := make(map[string]bool)
+	updated := &userEntries{exact: make(map[string]*UserEntry)}
 	for _, r := range records {
-		address := strings.ToLower(strings.TrimSpace(r[0]))
-		updated[address] = true
+		e, err := parseUserEntry(r)
+		if err != nil {
+			log.Printf("skipping entry %q in authenticated-emails-file=%q, %s", strings.Join(r, ","), um.usersFile, err)
+			continue
+		}
+		if strings.ContainsAny(e.Pattern, "*?[") {
+			updated.patterns = append(updated.patterns, e)
+		} else {
+			updated.exact[e.Pattern] = e
+		}
+	}
+	atomic.StorePointer(&um.m, unsafe.Pointer(updated))
+}
+
+// parseUserEntry parses a record of the form email[,groups[,expires]].
+// Groups are separated by spaces and expires is a date (access ends when it
+// starts, in UTC) or an RFC 3339 timestamp.
+func parseUserEntry(r []string) (*UserEntry, error) {
+	if len(r) > 3 {
+		return nil, fmt.Errorf("expected at most 3 columns")
+	}
+	e := &UserEntry{Pattern: strings.ToLower(strings.TrimSpace(r[0]))}
+	if _, err := path.Match(e.Pattern, ""); err != nil {
+		return nil, err
+	}
+	if len(r) > 1 {
+		e.Groups = strings.Fields(r[1])
 	}
-	atomic.StorePointer(&um.m, unsafe.Pointer(&updated))
+	if len(r) > 2 {
+		if v := strings.TrimSpace(r[2]); v != "" {
+			var err error
+			if e.Expires, err = time.Parse("2006-01-02", v); err != nil {
+				if e.Expires, err = time.Parse(time.RFC3339, v); err != nil {
+					return nil, fmt.Errorf("invalid expiry %q", v)
+				}
+			}
+		}
+	}
+	return e, nil
 }
 
 func newValidatorImpl(domains []string, usersFile string, done <-chan bool, onUpdate func()) func(string) bool {
-	validUsers := NewUserMap(usersFile, done, onUpdate)
+	return NewUserMapValidator(domains, NewUserMap(usersFile, done, onUpdate))
+}
 
+// NewUserMapValidator returns a validator accepting emails in domains or in
+// validUsers
+func NewUserMapValidator(domains []string, validUsers *UserMap) func(string) bool {
 	var allowAll bool
 	for i, domain := range domains {
 		if domain == "*" {
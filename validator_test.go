@@ -5,6 +5,9 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 type ValidatorTest struct {
@@ -207,3 +210,40 @@ func TestValidatorOverwriteEmailListDirectly(t *testing.T) {
 		t.Error("email added to list should validate")
 	}
 }
+
+func TestUserMapGroupsPatternsAndExpiry(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"# email, groups, expires",
+		"jane@example.com, admins sre",
+		"Bob@example.com,,2030-01-01",
+		"old@example.com, sre, 2020-06-30T12:00:00Z",
+		"*.contractor@example.com, contractors, 2030-01-01",
+		"*@partner.example.org",
+		"broken@example.com,,tomorrow",
+		"[@example.com",
+	})
+	um := NewUserMap(vt.authEmailFileName, vt.done, func() {})
+	now := time.Date(2029, 12, 31, 23, 0, 0, 0, time.UTC)
+	um.now = func() time.Time { return now }
+
+	assert.True(t, um.IsValid("jane@example.com"))
+	assert.Equal(t, []string{"admins", "sre"}, um.Groups("Jane@example.com"))
+	assert.True(t, um.IsValid("bob@example.com"))
+	assert.Empty(t, um.Groups("bob@example.com"))
+	assert.False(t, um.IsValid("old@example.com"))
+	assert.Equal(t, []string(nil), um.Groups("old@example.com"))
+	assert.True(t, um.IsValid("alice.contractor@example.com"))
+	assert.Equal(t, []string{"contractors"}, um.Groups("alice.contractor@example.com"))
+	assert.False(t, um.IsValid("alice@example.com"))
+	assert.True(t, um.IsValid("anyone@partner.example.org"))
+	assert.False(t, um.IsValid("broken@example.com"))
+
+	// entries stop validating once they expire, without reloading the file
+	now = now.Add(time.Hour)
+	assert.False(t, um.IsValid("bob@example.com"))
+	assert.False(t, um.IsValid("alice.contractor@example.com"))
+	assert.True(t, um.IsValid("jane@example.com"))
+}